@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func analyze() *cobra.Command {
+	var rules []string
+	var listRules bool
+	localCmd := &cobra.Command{
+		Use:   "analyze [FILE...]",
+		Short: "Report broken references and common misconfigurations in xDS config",
+		Long: "Fetch LDS, CDS, RDS and EDS for the proxy, or load them from saved json output, and run lint " +
+			"rules over them: routes to unknown clusters, missing route configurations, clusters without " +
+			"(healthy) endpoints, overlapping matches, TLS mismatches and more. Use --list-rules to see all rules.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if listRules {
+				fmt.Println(outputLintRules())
+				return
+			}
+			var dump *configDump
+			var err error
+			if len(args) != 0 {
+				dump, err = loadConfigDump(args)
+			} else {
+				ctx, cancel := commandContext()
+				defer cancel()
+				pilotClient := newPilotClient(ctx)
+				defer func() {
+					pilotClient.close()
+				}()
+				pod := findProxy()
+				dump, err = fetchConfigDump(ctx, pilotClient, pod)
+			}
+			if err != nil {
+				fatalf("Cannot get config: %v", err)
+			}
+			findings, err := runLintRules(dump, rules)
+			if err != nil {
+				fatalf("Cannot analyze config: %v", err)
+			}
+			if outputFormat == "json" {
+				output, err := json.MarshalIndent(findings, "", "  ")
+				if err != nil {
+					fatalf("Cannot convert to JSON: %v", err)
+				}
+				writeOutput(string(output))
+				return
+			}
+			fmt.Println(outputFindings(findings))
+		},
+	}
+	localCmd.Flags().StringSliceVarP(&rules, "rules", "", nil, "Run only the rules with these IDs")
+	localCmd.Flags().BoolVarP(&listRules, "list-rules", "", false, "List the available rules")
+	return localCmd
+}
+
+// finding is a problem found in the config of a proxy.
+type finding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Resource string `json:"resource"`
+	Message  string `json:"message"`
+}
+
+func outputFindings(findings []finding) string {
+	if len(findings) == 0 {
+		return "No issues found."
+	}
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "RULE\tSEVERITY\tRESOURCE\tMESSAGE")
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Rule, f.Severity, f.Resource, f.Message)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func outputLintRules() string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "RULE\tSEVERITY\tDESCRIPTION")
+	for _, rule := range lintRules {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", rule.id, rule.severity, rule.description)
+	}
+	w.Flush()
+	return buf.String()
+}
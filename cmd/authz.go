@@ -0,0 +1,808 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	httprbac "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rbac/v2"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	netrbac "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/rbac/v2"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	"github.com/envoyproxy/go-control-plane/pkg/conversion"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/spf13/cobra"
+
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+)
+
+const (
+	// HTTPRBACFilter is the name of the HTTP filter Istio generates from AuthorizationPolicy.
+	HTTPRBACFilter = "envoy.filters.http.rbac"
+
+	// NetworkRBACFilter is the name of the network filter Istio generates from AuthorizationPolicy for
+	// TCP services.
+	NetworkRBACFilter = "envoy.filters.network.rbac"
+)
+
+func authz() *cobra.Command {
+	handler := &authzHandler{}
+	localCmd := makeXDSCmd("authz", handler)
+	localCmd.Short = "Show the RBAC rules of listeners and evaluate requests against them"
+	localCmd.Long = "Decode the RBAC filters generated from AuthorizationPolicy in each filter chain and show " +
+		"their policies as allow/deny rules. With --evaluate, predict whether a request to --port is allowed " +
+		"by the filter chain each listener selects for it, mTLS if --principal is set and plaintext otherwise."
+	localCmd.Flags().Uint32VarP(&handler.port, "port", "p", 0, "Show only filter chains for this destination port")
+	localCmd.Flags().BoolVarP(&handler.evaluate, "evaluate", "", false, "Evaluate a request to --port against the rules")
+	localCmd.Flags().StringVarP(&handler.principal, "principal", "", "",
+		"Principal of the client, e.g. cluster.local/ns/default/sa/sleep. Leave blank for plaintext")
+	localCmd.Flags().StringVarP(&handler.sourceIP, "source-ip", "", "", "Source IP of the request")
+	localCmd.Flags().StringVarP(&handler.sni, "sni", "", "", "TLS server name of the request")
+	localCmd.Flags().StringSliceVarP(&handler.applicationProtocols, "alpn", "", nil,
+		"Application protocols of the connection. Defaults to those of an Istio mTLS connection if --principal "+
+			"is set, http/1.1 otherwise")
+	localCmd.Flags().StringVarP(&handler.host, "host", "", "", "Host header of the request")
+	localCmd.Flags().StringVarP(&handler.path, "path", "", "/", "Request path")
+	localCmd.Flags().StringVarP(&handler.method, "method", "", "GET", "Request method")
+	localCmd.Flags().StringArrayVarP(&handler.headers, "header", "H", nil, "Request header as name:value. Can be repeated")
+	localCmd.PreRun = func(cmd *cobra.Command, args []string) {
+		if handler.evaluate && handler.port == 0 {
+			fatalf("--evaluate requires --port")
+		}
+	}
+	return localCmd
+}
+
+type authzHandler struct {
+	port                 uint32
+	evaluate             bool
+	principal            string
+	sourceIP             string
+	sni                  string
+	applicationProtocols []string
+	host                 string
+	path                 string
+	method               string
+	headers              []string
+
+	// IP of the pod, the destination of inbound requests.
+	podIP string
+}
+
+func (c *authzHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	c.podIP = pod.IP
+	return newRequest(pod, "lds")
+}
+
+func (c *authzHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
+	var filters []*rbacFilter
+	var listeners []*xdsapi.Listener
+	for _, res := range resp.Resources {
+		l := &xdsapi.Listener{}
+		if err := ptypes.UnmarshalAny(res, l); err != nil {
+			return fmt.Errorf("cannot unmarshal any proto to listener: %v", err)
+		}
+		listeners = append(listeners, l)
+		for _, f := range retrieveRBACFilters(l) {
+			if c.port == 0 || f.Port == c.port {
+				filters = append(filters, f)
+			}
+		}
+	}
+	sort.SliceStable(filters, func(i, j int) bool {
+		if filters[i].Listener != filters[j].Listener {
+			return filters[i].Listener < filters[j].Listener
+		}
+		return filters[i].chain < filters[j].chain
+	})
+
+	if c.evaluate {
+		filters = selectRBACFilters(listeners, filters, c.connection())
+		results := evaluateRBACFilters(filters, c.request())
+		if outputFormat == "json" {
+			output, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				return err
+			}
+			writeOutput(string(output))
+			return nil
+		}
+		fmt.Println(outputAuthzResults(results))
+		return nil
+	}
+
+	if outputFormat == "json" {
+		if filters == nil {
+			filters = []*rbacFilter{}
+		}
+		output, err := json.MarshalIndent(filters, "", "  ")
+		if err != nil {
+			return err
+		}
+		writeOutput(string(output))
+		return nil
+	}
+	fmt.Println(outputRBACFilters(filters))
+	return nil
+}
+
+// istioMTLSProtocols are the application protocols a sidecar negotiates for mTLS connections.
+var istioMTLSProtocols = []string{"istio-peer-exchange", "istio", "istio-http/1.1"}
+
+// connection returns the connection carrying the request, which selects the filter chain.
+func (c *authzHandler) connection() *connectionInfo {
+	conn := &connectionInfo{
+		destinationIP:        net.ParseIP(c.podIP),
+		destinationPort:      c.port,
+		sourceIP:             net.ParseIP(c.sourceIP),
+		serverName:           c.sni,
+		transportProtocol:    "raw_buffer",
+		applicationProtocols: c.applicationProtocols,
+	}
+	if c.principal != "" || c.sni != "" {
+		conn.transportProtocol = "tls"
+	}
+	if conn.applicationProtocols == nil {
+		conn.applicationProtocols = []string{"http/1.1"}
+		if c.principal != "" {
+			conn.applicationProtocols = istioMTLSProtocols
+		}
+	}
+	return conn
+}
+
+func (c *authzHandler) request() *authzRequest {
+	r := &authzRequest{
+		principal:       strings.TrimPrefix(c.principal, "spiffe://"),
+		sourceIP:        net.ParseIP(c.sourceIP),
+		destinationPort: c.port,
+		sni:             c.sni,
+		http: &httpRequest{
+			host:    c.host,
+			path:    c.path,
+			method:  c.method,
+			headers: map[string]string{},
+		},
+	}
+	for _, h := range c.headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			log.Warnf("Ignore malformed header %q", h)
+			continue
+		}
+		r.http.headers[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return r
+}
+
+// rbacFilter is the rules, or shadow rules, of an RBAC filter of a filter chain.
+type rbacFilter struct {
+	Listener    string        `json:"listener"`
+	FilterChain string        `json:"filterChain"`
+	Port        uint32        `json:"port"`
+	Filter      string        `json:"filter"`
+	Shadow      bool          `json:"shadow,omitempty"`
+	Action      string        `json:"action"`
+	Policies    []*rbacPolicy `json:"policies"`
+
+	chain int
+	rules *rbac.RBAC
+}
+
+// rbacPolicy is a policy matching requests from any of the principals to any of the permissions.
+type rbacPolicy struct {
+	Name string   `json:"name"`
+	From []string `json:"from"`
+	To   []string `json:"to"`
+}
+
+// retrieveHTTPFilterConfig decodes the config of an HTTP filter, either typed or struct, into out.
+func retrieveHTTPFilterConfig(filter *hcm.HttpFilter, out proto.Message) error {
+	switch c := filter.GetConfigType().(type) {
+	case *hcm.HttpFilter_TypedConfig:
+		return ptypes.UnmarshalAny(c.TypedConfig, out)
+	case *hcm.HttpFilter_Config:
+		return conversion.StructToMessage(c.Config, out)
+	}
+	return fmt.Errorf("filter %s has no config", filter.Name)
+}
+
+// retrieveRBACFilters returns the RBAC filters of all filter chains of the listener, network filters
+// before HTTP filters as Envoy applies them.
+func retrieveRBACFilters(l *xdsapi.Listener) []*rbacFilter {
+	var filters []*rbacFilter
+	for i, chain := range l.FilterChains {
+		port := retrieveFilterChainPort(chain)
+		if port == 0 {
+			port = retrieveListenerPort(l)
+		}
+		add := func(name string, rules, shadowRules *rbac.RBAC) {
+			for _, r := range []*rbac.RBAC{rules, shadowRules} {
+				if r == nil {
+					continue
+				}
+				filters = append(filters, &rbacFilter{
+					Listener:    l.Name,
+					FilterChain: describeFilterChainProtocols(i, chain),
+					Port:        port,
+					Filter:      name,
+					Shadow:      r == shadowRules,
+					Action:      r.Action.String(),
+					Policies:    newRBACPolicies(r),
+					chain:       i,
+					rules:       r,
+				})
+			}
+		}
+		for _, filter := range chain.Filters {
+			switch filter.Name {
+			case NetworkRBACFilter:
+				config := &netrbac.RBAC{}
+				if err := retrieveFilterConfig(filter, config); err != nil {
+					log.Errorf("Cannot decode %s config of listener %s: %v", filter.Name, l.Name, err)
+					continue
+				}
+				add(filter.Name, config.Rules, config.ShadowRules)
+			case HTTPListener:
+				manager := &hcm.HttpConnectionManager{}
+				if err := retrieveFilterConfig(filter, manager); err != nil {
+					log.Errorf("Cannot decode %s config of listener %s: %v", filter.Name, l.Name, err)
+					continue
+				}
+				for _, httpFilter := range manager.HttpFilters {
+					if httpFilter.Name != HTTPRBACFilter {
+						continue
+					}
+					config := &httprbac.RBAC{}
+					if err := retrieveHTTPFilterConfig(httpFilter, config); err != nil {
+						log.Errorf("Cannot decode %s config of listener %s: %v", httpFilter.Name, l.Name, err)
+						continue
+					}
+					add(httpFilter.Name, config.Rules, config.ShadowRules)
+				}
+			}
+		}
+	}
+	return filters
+}
+
+func newRBACPolicies(r *rbac.RBAC) []*rbacPolicy {
+	policies := []*rbacPolicy{}
+	for _, name := range sortedPolicyNames(r) {
+		policy := r.Policies[name]
+		p := &rbacPolicy{Name: name, From: []string{}, To: []string{}}
+		for _, principal := range policy.Principals {
+			p.From = append(p.From, describePrincipal(principal))
+		}
+		for _, permission := range policy.Permissions {
+			p.To = append(p.To, describePermission(permission))
+		}
+		if policy.Condition != nil {
+			p.To = append(p.To, "condition (not shown)")
+		}
+		policies = append(policies, p)
+	}
+	return policies
+}
+
+func sortedPolicyNames(r *rbac.RBAC) []string {
+	names := make([]string, 0, len(r.Policies))
+	for name := range r.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namespaceRegex matches the regex Istio generates for the namespaces of an AuthorizationPolicy.
+var namespaceRegex = regexp.MustCompile(`^\.\*/ns/([^/]+)/\.\*$`)
+
+// describePrincipalName shows a principal matcher, recognizing Istio namespaces.
+func describePrincipalName(m *matcher.StringMatcher) string {
+	regex := m.GetSafeRegex().GetRegex()
+	if regex == "" {
+		regex = m.GetRegex()
+	}
+	if ns := namespaceRegex.FindStringSubmatch(regex); ns != nil {
+		return "namespace " + ns[1]
+	}
+	return "principal " + describeStringMatcher(m)
+}
+
+func describeHeaderMatcher(h *route.HeaderMatcher) string {
+	name := "header " + h.Name
+	switch strings.ToLower(h.Name) {
+	case ":method":
+		name = "method"
+	case ":path":
+		name = "path"
+	case ":authority", "host":
+		name = "host"
+	}
+	var value string
+	switch s := h.GetHeaderMatchSpecifier().(type) {
+	case *route.HeaderMatcher_ExactMatch:
+		value = s.ExactMatch
+	case *route.HeaderMatcher_RegexMatch:
+		value = "regex:" + s.RegexMatch
+	case *route.HeaderMatcher_SafeRegexMatch:
+		value = "regex:" + s.SafeRegexMatch.GetRegex()
+	case *route.HeaderMatcher_RangeMatch:
+		value = fmt.Sprintf("[%d,%d)", s.RangeMatch.Start, s.RangeMatch.End)
+	case *route.HeaderMatcher_PresentMatch:
+		value = "present"
+	case *route.HeaderMatcher_PrefixMatch:
+		value = "prefix:" + s.PrefixMatch
+	case *route.HeaderMatcher_SuffixMatch:
+		value = "suffix:" + s.SuffixMatch
+	}
+	if h.InvertMatch {
+		return fmt.Sprintf("not %s %s", name, value)
+	}
+	return fmt.Sprintf("%s %s", name, value)
+}
+
+func describeValueMatcher(v *matcher.ValueMatcher) string {
+	switch m := v.GetMatchPattern().(type) {
+	case *matcher.ValueMatcher_NullMatch_:
+		return "null"
+	case *matcher.ValueMatcher_DoubleMatch:
+		if r := m.DoubleMatch.GetRange(); r != nil {
+			return fmt.Sprintf("[%v,%v)", r.Start, r.End)
+		}
+		return fmt.Sprint(m.DoubleMatch.GetExact())
+	case *matcher.ValueMatcher_StringMatch:
+		return describeStringMatcher(m.StringMatch)
+	case *matcher.ValueMatcher_BoolMatch:
+		return fmt.Sprint(m.BoolMatch)
+	case *matcher.ValueMatcher_PresentMatch:
+		return "present"
+	case *matcher.ValueMatcher_ListMatch:
+		return "contains " + describeValueMatcher(m.ListMatch.GetOneOf())
+	}
+	return v.String()
+}
+
+func metadataPath(m *matcher.MetadataMatcher) string {
+	keys := make([]string, 0, len(m.Path))
+	for _, segment := range m.Path {
+		keys = append(keys, segment.GetKey())
+	}
+	return strings.Join(keys, ".")
+}
+
+// describeMetadataMatcher shows the dynamic metadata Istio authn filter sets with its attribute
+// names, other metadata as filter:path.
+func describeMetadataMatcher(m *matcher.MetadataMatcher) string {
+	path := metadataPath(m)
+	if m.Filter == "istio_authn" {
+		switch {
+		case path == "source.principal":
+			if s := m.GetValue().GetStringMatch(); s != nil {
+				return describePrincipalName(s)
+			}
+		case path == "request.auth.principal":
+			return "request principal " + describeValueMatcher(m.Value)
+		case strings.HasPrefix(path, "request.auth.claims."):
+			return fmt.Sprintf("claim %s %s", strings.TrimPrefix(path, "request.auth.claims."), describeValueMatcher(m.Value))
+		}
+		return fmt.Sprintf("%s %s", path, describeValueMatcher(m.Value))
+	}
+	return fmt.Sprintf("metadata %s:%s %s", m.Filter, path, describeValueMatcher(m.Value))
+}
+
+func describePrincipal(p *rbac.Principal) string {
+	switch id := p.GetIdentifier().(type) {
+	case *rbac.Principal_AndIds:
+		return describePrincipals(id.AndIds.GetIds(), " and ")
+	case *rbac.Principal_OrIds:
+		return describePrincipals(id.OrIds.GetIds(), " or ")
+	case *rbac.Principal_Any:
+		return "any"
+	case *rbac.Principal_Authenticated_:
+		if id.Authenticated.GetPrincipalName() == nil {
+			return "authenticated"
+		}
+		return describePrincipalName(id.Authenticated.PrincipalName)
+	case *rbac.Principal_SourceIp:
+		return fmt.Sprintf("source ip %s/%d", id.SourceIp.AddressPrefix, id.SourceIp.GetPrefixLen().GetValue())
+	case *rbac.Principal_Header:
+		return describeHeaderMatcher(id.Header)
+	case *rbac.Principal_UrlPath:
+		return "path " + describeStringMatcher(id.UrlPath.GetPath())
+	case *rbac.Principal_Metadata:
+		return describeMetadataMatcher(id.Metadata)
+	case *rbac.Principal_NotId:
+		return "not (" + describePrincipal(id.NotId) + ")"
+	}
+	return p.String()
+}
+
+func describePermission(p *rbac.Permission) string {
+	switch rule := p.GetRule().(type) {
+	case *rbac.Permission_AndRules:
+		return describePermissions(rule.AndRules.GetRules(), " and ")
+	case *rbac.Permission_OrRules:
+		return describePermissions(rule.OrRules.GetRules(), " or ")
+	case *rbac.Permission_Any:
+		return "any"
+	case *rbac.Permission_Header:
+		return describeHeaderMatcher(rule.Header)
+	case *rbac.Permission_UrlPath:
+		return "path " + describeStringMatcher(rule.UrlPath.GetPath())
+	case *rbac.Permission_DestinationIp:
+		return fmt.Sprintf("destination ip %s/%d", rule.DestinationIp.AddressPrefix, rule.DestinationIp.GetPrefixLen().GetValue())
+	case *rbac.Permission_DestinationPort:
+		return fmt.Sprintf("port %d", rule.DestinationPort)
+	case *rbac.Permission_Metadata:
+		return describeMetadataMatcher(rule.Metadata)
+	case *rbac.Permission_NotRule:
+		return "not (" + describePermission(rule.NotRule) + ")"
+	case *rbac.Permission_RequestedServerName:
+		return "sni " + describeStringMatcher(rule.RequestedServerName)
+	}
+	return p.String()
+}
+
+// joinDescriptions joins the descriptions of the items of a set, in parentheses if there are several.
+func joinDescriptions(parts []string, sep string) string {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+func describePrincipals(ids []*rbac.Principal, sep string) string {
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, describePrincipal(id))
+	}
+	return joinDescriptions(parts, sep)
+}
+
+func describePermissions(rules []*rbac.Permission, sep string) string {
+	parts := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		parts = append(parts, describePermission(rule))
+	}
+	return joinDescriptions(parts, sep)
+}
+
+func outputRBACFilters(filters []*rbacFilter) string {
+	if len(filters) == 0 {
+		return "No RBAC filters found."
+	}
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "LISTENER\tCHAIN\tFILTER\tACTION\tPOLICY\tFROM\tTO")
+	for _, f := range filters {
+		action := f.Action
+		if f.Shadow {
+			action += " (shadow)"
+		}
+		if len(f.Policies) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t-\t-\t-\n", f.Listener, f.FilterChain, f.Filter, action)
+			continue
+		}
+		for _, p := range f.Policies {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.Listener, f.FilterChain, f.Filter, action, p.Name,
+				orDash(strings.Join(p.From, " or ")), orDash(strings.Join(p.To, " or ")))
+		}
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// authzRequest is a synthetic request evaluated against RBAC rules.
+type authzRequest struct {
+	// Principal of the peer certificate without spiffe://, empty for plaintext.
+	principal       string
+	sourceIP        net.IP
+	destinationPort uint32
+	sni             string
+	// Nil for network filters, which cannot see HTTP attributes.
+	http *httpRequest
+}
+
+// authzResult is the outcome of an RBAC filter for a request.
+type authzResult struct {
+	Listener    string `json:"listener"`
+	FilterChain string `json:"filterChain"`
+	Filter      string `json:"filter"`
+	Shadow      bool   `json:"shadow,omitempty"`
+	Action      string `json:"action"`
+	// Name of the first policy matching the request.
+	MatchedPolicy string `json:"matchedPolicy,omitempty"`
+	// Policies that may match, depending on attributes not known for a synthetic request. Set only
+	// when no policy matches, as they then decide.
+	UnknownPolicies []string `json:"unknownPolicies,omitempty"`
+	// ALLOW, DENY, or UNKNOWN if an unknown policy can change the decision.
+	Decision string `json:"decision"`
+	// Rules that depend on attributes not known for a synthetic request.
+	Unevaluated []string `json:"unevaluated,omitempty"`
+}
+
+const (
+	decisionAllow   = "ALLOW"
+	decisionDeny    = "DENY"
+	decisionUnknown = "UNKNOWN"
+)
+
+// selectRBACFilters keeps the filters of the filter chain each listener selects for the connection,
+// as only those see the request.
+func selectRBACFilters(listeners []*xdsapi.Listener, filters []*rbacFilter, conn *connectionInfo) []*rbacFilter {
+	selected := map[string]int{}
+	for _, l := range listeners {
+		selected[l.Name], _ = selectFilterChain(l.FilterChains, conn)
+	}
+	var ret []*rbacFilter
+	for _, f := range filters {
+		i, ok := selected[f.Listener]
+		if ok && i < 0 {
+			log.Warnf("No filter chain of listener %s matches the connection, it would be closed", f.Listener)
+			delete(selected, f.Listener)
+		}
+		if ok && i == f.chain {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// evaluateRBACFilters evaluates the request against the filters as Envoy does: a filter with ALLOW
+// rules denies requests that no policy matches, one with DENY rules denies requests that a policy
+// matches. Shadow rules are evaluated but not enforced.
+func evaluateRBACFilters(filters []*rbacFilter, r *authzRequest) []*authzResult {
+	results := []*authzResult{}
+	for _, f := range filters {
+		req := *r
+		if f.Filter == NetworkRBACFilter {
+			req.http = nil
+		}
+		result := &authzResult{Listener: f.Listener, FilterChain: f.FilterChain, Filter: f.Filter, Shadow: f.Shadow, Action: f.Action}
+	policies:
+		for _, name := range sortedPolicyNames(f.rules) {
+			switch matchRBACPolicy(f.rules.Policies[name], &req, &result.Unevaluated) {
+			case match:
+				result.MatchedPolicy = name
+				result.UnknownPolicies = nil
+				break policies
+			case unknown:
+				result.UnknownPolicies = append(result.UnknownPolicies, name)
+			}
+		}
+		matched := result.MatchedPolicy != ""
+		switch {
+		case !matched && len(result.UnknownPolicies) != 0:
+			result.Decision = decisionUnknown
+		case matched == (f.rules.Action == rbac.RBAC_ALLOW):
+			result.Decision = decisionAllow
+		default:
+			result.Decision = decisionDeny
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// matchResult is the outcome of matching a rule against a synthetic request, which does not know all
+// the attributes of a real one.
+type matchResult int
+
+const (
+	noMatch matchResult = iota
+	match
+	// The rule depends on attributes not known for the request.
+	unknown
+)
+
+// not negates the result. What is not known stays unknown.
+func (m matchResult) not() matchResult {
+	switch m {
+	case match:
+		return noMatch
+	case noMatch:
+		return match
+	}
+	return unknown
+}
+
+func matchIf(b bool) matchResult {
+	if b {
+		return match
+	}
+	return noMatch
+}
+
+// matchAll returns match if all results match, noMatch if any does not, and unknown otherwise.
+func matchAll(n int, result func(i int) matchResult) matchResult {
+	ret := match
+	for i := 0; i < n; i++ {
+		switch result(i) {
+		case noMatch:
+			return noMatch
+		case unknown:
+			ret = unknown
+		}
+	}
+	return ret
+}
+
+// matchAny returns match if any result matches, noMatch if none does, and unknown otherwise.
+func matchAny(n int, result func(i int) matchResult) matchResult {
+	ret := noMatch
+	for i := 0; i < n; i++ {
+		switch result(i) {
+		case match:
+			return match
+		case unknown:
+			ret = unknown
+		}
+	}
+	return ret
+}
+
+func matchRBACPolicy(policy *rbac.Policy, r *authzRequest, unevaluated *[]string) matchResult {
+	if policy.Condition != nil {
+		*unevaluated = appendUnique(*unevaluated, "condition")
+		return unknown
+	}
+	permitted := matchAny(len(policy.Permissions), func(i int) matchResult {
+		return matchPermission(policy.Permissions[i], r, unevaluated)
+	})
+	if permitted == noMatch {
+		return noMatch
+	}
+	principal := matchAny(len(policy.Principals), func(i int) matchResult {
+		return matchPrincipal(policy.Principals[i], r, unevaluated)
+	})
+	if principal == noMatch {
+		return noMatch
+	}
+	if permitted == unknown || principal == unknown {
+		return unknown
+	}
+	return match
+}
+
+func matchPermission(p *rbac.Permission, r *authzRequest, unevaluated *[]string) matchResult {
+	switch rule := p.GetRule().(type) {
+	case *rbac.Permission_AndRules:
+		rules := rule.AndRules.GetRules()
+		return matchAll(len(rules), func(i int) matchResult {
+			return matchPermission(rules[i], r, unevaluated)
+		})
+	case *rbac.Permission_OrRules:
+		rules := rule.OrRules.GetRules()
+		return matchAny(len(rules), func(i int) matchResult {
+			return matchPermission(rules[i], r, unevaluated)
+		})
+	case *rbac.Permission_Any:
+		return matchIf(rule.Any)
+	case *rbac.Permission_Header:
+		return matchIf(r.http != nil && matchHeader(rule.Header, r.http))
+	case *rbac.Permission_UrlPath:
+		return matchIf(r.http != nil && matchString(rule.UrlPath.GetPath(), strings.SplitN(r.http.path, "?", 2)[0]))
+	case *rbac.Permission_DestinationIp:
+		*unevaluated = appendUnique(*unevaluated, describePermission(p))
+		return unknown
+	case *rbac.Permission_DestinationPort:
+		return matchIf(rule.DestinationPort == r.destinationPort)
+	case *rbac.Permission_Metadata:
+		return matchMetadata(rule.Metadata, r, unevaluated)
+	case *rbac.Permission_NotRule:
+		return matchPermission(rule.NotRule, r, unevaluated).not()
+	case *rbac.Permission_RequestedServerName:
+		return matchIf(matchString(rule.RequestedServerName, r.sni))
+	}
+	*unevaluated = appendUnique(*unevaluated, describePermission(p))
+	return unknown
+}
+
+func matchPrincipal(p *rbac.Principal, r *authzRequest, unevaluated *[]string) matchResult {
+	switch id := p.GetIdentifier().(type) {
+	case *rbac.Principal_AndIds:
+		ids := id.AndIds.GetIds()
+		return matchAll(len(ids), func(i int) matchResult {
+			return matchPrincipal(ids[i], r, unevaluated)
+		})
+	case *rbac.Principal_OrIds:
+		ids := id.OrIds.GetIds()
+		return matchAny(len(ids), func(i int) matchResult {
+			return matchPrincipal(ids[i], r, unevaluated)
+		})
+	case *rbac.Principal_Any:
+		return matchIf(id.Any)
+	case *rbac.Principal_Authenticated_:
+		if r.principal == "" {
+			return noMatch
+		}
+		if id.Authenticated.GetPrincipalName() == nil {
+			return match
+		}
+		// Envoy matches the URI SAN of the peer certificate.
+		return matchIf(matchString(id.Authenticated.PrincipalName, "spiffe://"+r.principal))
+	case *rbac.Principal_SourceIp:
+		return matchIf(scoreCidrRanges([]*core1.CidrRange{id.SourceIp}, r.sourceIP) >= 0)
+	case *rbac.Principal_Header:
+		return matchIf(r.http != nil && matchHeader(id.Header, r.http))
+	case *rbac.Principal_UrlPath:
+		return matchIf(r.http != nil && matchString(id.UrlPath.GetPath(), strings.SplitN(r.http.path, "?", 2)[0]))
+	case *rbac.Principal_Metadata:
+		return matchMetadata(id.Metadata, r, unevaluated)
+	case *rbac.Principal_NotId:
+		return matchPrincipal(id.NotId, r, unevaluated).not()
+	}
+	*unevaluated = appendUnique(*unevaluated, describePrincipal(p))
+	return unknown
+}
+
+// matchMetadata matches the source principal set by the Istio authn filter. Other metadata, such as
+// JWT claims, is unknown for a synthetic request.
+func matchMetadata(m *matcher.MetadataMatcher, r *authzRequest, unevaluated *[]string) matchResult {
+	if m.Filter == "istio_authn" && metadataPath(m) == "source.principal" {
+		switch v := m.GetValue().GetMatchPattern().(type) {
+		case *matcher.ValueMatcher_StringMatch:
+			return matchIf(r.principal != "" && matchString(v.StringMatch, r.principal))
+		case *matcher.ValueMatcher_PresentMatch:
+			return matchIf((r.principal != "") == v.PresentMatch)
+		}
+	}
+	*unevaluated = appendUnique(*unevaluated, describeMetadataMatcher(m))
+	return unknown
+}
+
+func outputAuthzResults(results []*authzResult) string {
+	if len(results) == 0 {
+		return "No RBAC filters for the port: allowed."
+	}
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "LISTENER\tCHAIN\tFILTER\tACTION\tMATCHED POLICY\tRESULT")
+	decisions := map[string]string{}
+	var chains []string
+	for _, r := range results {
+		action := r.Action
+		if r.Shadow {
+			action += " (shadow)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Listener, r.FilterChain, r.Filter, action, orDash(r.MatchedPolicy), r.Decision)
+		chain := r.Listener + " " + r.FilterChain
+		if _, ok := decisions[chain]; !ok {
+			decisions[chain] = decisionAllow
+			chains = append(chains, chain)
+		}
+		// Any filter denying denies the request, whatever the others would decide.
+		if !r.Shadow && decisions[chain] != decisionDeny && r.Decision != decisionAllow {
+			decisions[chain] = r.Decision
+		}
+	}
+	w.Flush()
+
+	buf.WriteString("\n")
+	for _, chain := range chains {
+		fmt.Fprintf(&buf, "Request through %s: %s\n", chain, decisions[chain])
+	}
+	var unevaluated []string
+	for _, r := range results {
+		for _, u := range r.Unevaluated {
+			unevaluated = appendUnique(unevaluated, u)
+		}
+	}
+	if len(unevaluated) != 0 {
+		fmt.Fprintf(&buf, "Not known for the request: %s\n", strings.Join(unevaluated, ", "))
+	}
+	return buf.String()
+}
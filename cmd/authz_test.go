@@ -0,0 +1,351 @@
+package cmd
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	httprbac "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rbac/v2"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func exactPrincipal(name string) *rbac.Principal {
+	return &rbac.Principal{Identifier: &rbac.Principal_Authenticated_{Authenticated: &rbac.Principal_Authenticated{
+		PrincipalName: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: "spiffe://" + name}},
+	}}}
+}
+
+func sourceIPPrincipal(prefix string, length uint32) *rbac.Principal {
+	return &rbac.Principal{Identifier: &rbac.Principal_SourceIp{SourceIp: &core1.CidrRange{
+		AddressPrefix: prefix, PrefixLen: &wrappers.UInt32Value{Value: length},
+	}}}
+}
+
+func notPrincipal(p *rbac.Principal) *rbac.Principal {
+	return &rbac.Principal{Identifier: &rbac.Principal_NotId{NotId: p}}
+}
+
+func anyPrincipal() *rbac.Principal {
+	return &rbac.Principal{Identifier: &rbac.Principal_Any{Any: true}}
+}
+
+func claimPrincipal(claim, value string) *rbac.Principal {
+	return &rbac.Principal{Identifier: &rbac.Principal_Metadata{Metadata: &matcher.MetadataMatcher{
+		Filter: "istio_authn",
+		Path: []*matcher.MetadataMatcher_PathSegment{
+			{Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: "request.auth.claims"}},
+			{Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: claim}},
+		},
+		Value: &matcher.ValueMatcher{MatchPattern: &matcher.ValueMatcher_StringMatch{StringMatch: &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Exact{Exact: value},
+		}}},
+	}}}
+}
+
+func methodPermission(method string) *rbac.Permission {
+	return &rbac.Permission{Rule: &rbac.Permission_Header{Header: &route.HeaderMatcher{
+		Name: ":method", HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: method},
+	}}}
+}
+
+func notPermission(p *rbac.Permission) *rbac.Permission {
+	return &rbac.Permission{Rule: &rbac.Permission_NotRule{NotRule: p}}
+}
+
+func destinationIPPermission(prefix string) *rbac.Permission {
+	return &rbac.Permission{Rule: &rbac.Permission_DestinationIp{DestinationIp: &core1.CidrRange{
+		AddressPrefix: prefix, PrefixLen: &wrappers.UInt32Value{Value: 32},
+	}}}
+}
+
+func anyPermission() *rbac.Permission {
+	return &rbac.Permission{Rule: &rbac.Permission_Any{Any: true}}
+}
+
+func newTestRequest(principal, sourceIP, method string) *authzRequest {
+	return &authzRequest{
+		principal:       principal,
+		sourceIP:        net.ParseIP(sourceIP),
+		destinationPort: 8080,
+		http:            &httpRequest{host: "httpbin", path: "/", method: method, headers: map[string]string{}},
+	}
+}
+
+func TestMatchPrincipal(t *testing.T) {
+	cases := []struct {
+		name      string
+		principal *rbac.Principal
+		request   *authzRequest
+		want      matchResult
+	}{
+		{"any", anyPrincipal(), newTestRequest("", "10.1.2.3", "GET"), match},
+		{"exact principal", exactPrincipal("cluster.local/ns/default/sa/sleep"),
+			newTestRequest("cluster.local/ns/default/sa/sleep", "10.1.2.3", "GET"), match},
+		{"other principal", exactPrincipal("cluster.local/ns/default/sa/sleep"),
+			newTestRequest("cluster.local/ns/other/sa/sleep", "10.1.2.3", "GET"), noMatch},
+		{"plaintext is not authenticated", exactPrincipal("cluster.local/ns/default/sa/sleep"),
+			newTestRequest("", "10.1.2.3", "GET"), noMatch},
+		{"source ip in range", sourceIPPrincipal("10.1.0.0", 16), newTestRequest("", "10.1.2.3", "GET"), match},
+		{"source ip out of range", sourceIPPrincipal("10.2.0.0", 16), newTestRequest("", "10.1.2.3", "GET"), noMatch},
+		{"source ip in /0", sourceIPPrincipal("0.0.0.0", 0), newTestRequest("", "10.1.2.3", "GET"), match},
+		{"not source ip", notPrincipal(sourceIPPrincipal("10.1.0.0", 16)), newTestRequest("", "10.1.2.3", "GET"), noMatch},
+		{"claim is unknown", claimPrincipal("iss", "example.com"), newTestRequest("", "10.1.2.3", "GET"), unknown},
+		{"not claim stays unknown", notPrincipal(claimPrincipal("iss", "example.com")),
+			newTestRequest("", "10.1.2.3", "GET"), unknown},
+		{"and with a mismatch", &rbac.Principal{Identifier: &rbac.Principal_AndIds{AndIds: &rbac.Principal_Set{Ids: []*rbac.Principal{
+			claimPrincipal("iss", "example.com"), sourceIPPrincipal("10.2.0.0", 16),
+		}}}}, newTestRequest("", "10.1.2.3", "GET"), noMatch},
+		{"or with a match", &rbac.Principal{Identifier: &rbac.Principal_OrIds{OrIds: &rbac.Principal_Set{Ids: []*rbac.Principal{
+			claimPrincipal("iss", "example.com"), sourceIPPrincipal("10.1.0.0", 16),
+		}}}}, newTestRequest("", "10.1.2.3", "GET"), match},
+		{"or with unknown", &rbac.Principal{Identifier: &rbac.Principal_OrIds{OrIds: &rbac.Principal_Set{Ids: []*rbac.Principal{
+			claimPrincipal("iss", "example.com"), sourceIPPrincipal("10.2.0.0", 16),
+		}}}}, newTestRequest("", "10.1.2.3", "GET"), unknown},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var unevaluated []string
+			if got := matchPrincipal(c.principal, c.request, &unevaluated); got != c.want {
+				t.Errorf("matchPrincipal() = %v, want %v", got, c.want)
+			}
+			if c.want == unknown && len(unevaluated) == 0 {
+				t.Errorf("unknown result without unevaluated rules")
+			}
+		})
+	}
+}
+
+func TestMatchPermission(t *testing.T) {
+	cases := []struct {
+		name       string
+		permission *rbac.Permission
+		request    *authzRequest
+		want       matchResult
+	}{
+		{"method", methodPermission("GET"), newTestRequest("", "10.1.2.3", "GET"), match},
+		{"other method", methodPermission("POST"), newTestRequest("", "10.1.2.3", "GET"), noMatch},
+		{"not method", notPermission(methodPermission("POST")), newTestRequest("", "10.1.2.3", "GET"), match},
+		{"header in network filter", methodPermission("GET"), &authzRequest{destinationPort: 8080}, noMatch},
+		{"destination ip is unknown", destinationIPPermission("10.0.0.1"), newTestRequest("", "10.1.2.3", "GET"), unknown},
+		{"not destination ip stays unknown", notPermission(destinationIPPermission("10.0.0.1")),
+			newTestRequest("", "10.1.2.3", "GET"), unknown},
+		{"port", &rbac.Permission{Rule: &rbac.Permission_DestinationPort{DestinationPort: 8080}},
+			newTestRequest("", "10.1.2.3", "GET"), match},
+		{"and with unknown", &rbac.Permission{Rule: &rbac.Permission_AndRules{AndRules: &rbac.Permission_Set{Rules: []*rbac.Permission{
+			methodPermission("GET"), destinationIPPermission("10.0.0.1"),
+		}}}}, newTestRequest("", "10.1.2.3", "GET"), unknown},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var unevaluated []string
+			if got := matchPermission(c.permission, c.request, &unevaluated); got != c.want {
+				t.Errorf("matchPermission() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func newTestRBACFilter(action rbac.RBAC_Action, policies map[string]*rbac.Policy) *rbacFilter {
+	return &rbacFilter{Listener: "virtualInbound", Filter: HTTPRBACFilter, Action: action.String(),
+		rules: &rbac.RBAC{Action: action, Policies: policies}}
+}
+
+func TestEvaluateRBACFilters(t *testing.T) {
+	allowSleep := map[string]*rbac.Policy{
+		"ns[default]-policy[allow-sleep]-rule[0]": {
+			Permissions: []*rbac.Permission{methodPermission("GET")},
+			Principals:  []*rbac.Principal{exactPrincipal("cluster.local/ns/default/sa/sleep")},
+		},
+	}
+	denyNotClaim := map[string]*rbac.Policy{
+		"ns[default]-policy[deny-jwt]-rule[0]": {
+			Permissions: []*rbac.Permission{anyPermission()},
+			Principals:  []*rbac.Principal{notPrincipal(claimPrincipal("iss", "example.com"))},
+		},
+	}
+	cases := []struct {
+		name         string
+		filters      []*rbacFilter
+		request      *authzRequest
+		wantDecision []string
+		wantMatched  []string
+	}{
+		{
+			name:         "allow policy matches",
+			filters:      []*rbacFilter{newTestRBACFilter(rbac.RBAC_ALLOW, allowSleep)},
+			request:      newTestRequest("cluster.local/ns/default/sa/sleep", "10.1.2.3", "GET"),
+			wantDecision: []string{decisionAllow},
+			wantMatched:  []string{"ns[default]-policy[allow-sleep]-rule[0]"},
+		},
+		{
+			name:         "no allow policy matches",
+			filters:      []*rbacFilter{newTestRBACFilter(rbac.RBAC_ALLOW, allowSleep)},
+			request:      newTestRequest("cluster.local/ns/default/sa/sleep", "10.1.2.3", "POST"),
+			wantDecision: []string{decisionDeny},
+			wantMatched:  []string{""},
+		},
+		{
+			name:         "deny policy matches",
+			filters:      []*rbacFilter{newTestRBACFilter(rbac.RBAC_DENY, allowSleep)},
+			request:      newTestRequest("cluster.local/ns/default/sa/sleep", "10.1.2.3", "GET"),
+			wantDecision: []string{decisionDeny},
+			wantMatched:  []string{"ns[default]-policy[allow-sleep]-rule[0]"},
+		},
+		{
+			name:         "unknown deny policy",
+			filters:      []*rbacFilter{newTestRBACFilter(rbac.RBAC_DENY, denyNotClaim)},
+			request:      newTestRequest("", "10.1.2.3", "GET"),
+			wantDecision: []string{decisionUnknown},
+			wantMatched:  []string{""},
+		},
+		{
+			name:         "unknown allow policy",
+			filters:      []*rbacFilter{newTestRBACFilter(rbac.RBAC_ALLOW, denyNotClaim)},
+			request:      newTestRequest("", "10.1.2.3", "GET"),
+			wantDecision: []string{decisionUnknown},
+			wantMatched:  []string{""},
+		},
+		{
+			name: "matching policy decides over an unknown one",
+			filters: []*rbacFilter{newTestRBACFilter(rbac.RBAC_DENY, map[string]*rbac.Policy{
+				// Sorted before the matching policy.
+				"ns[default]-policy[a-deny-jwt]-rule[0]":  denyNotClaim["ns[default]-policy[deny-jwt]-rule[0]"],
+				"ns[default]-policy[allow-sleep]-rule[0]": allowSleep["ns[default]-policy[allow-sleep]-rule[0]"],
+			})},
+			request:      newTestRequest("cluster.local/ns/default/sa/sleep", "10.1.2.3", "GET"),
+			wantDecision: []string{decisionDeny},
+			wantMatched:  []string{"ns[default]-policy[allow-sleep]-rule[0]"},
+		},
+		{
+			name: "deny and allow filters",
+			filters: []*rbacFilter{
+				newTestRBACFilter(rbac.RBAC_DENY, allowSleep),
+				newTestRBACFilter(rbac.RBAC_ALLOW, allowSleep),
+			},
+			request:      newTestRequest("cluster.local/ns/default/sa/sleep", "10.1.2.3", "GET"),
+			wantDecision: []string{decisionDeny, decisionAllow},
+			wantMatched:  []string{"ns[default]-policy[allow-sleep]-rule[0]", "ns[default]-policy[allow-sleep]-rule[0]"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			results := evaluateRBACFilters(c.filters, c.request)
+			var decisions []string
+			var matched []string
+			for _, r := range results {
+				decisions = append(decisions, r.Decision)
+				matched = append(matched, r.MatchedPolicy)
+			}
+			if !reflect.DeepEqual(decisions, c.wantDecision) {
+				t.Errorf("decisions = %v, want %v", decisions, c.wantDecision)
+			}
+			if !reflect.DeepEqual(matched, c.wantMatched) {
+				t.Errorf("matched policies = %q, want %q", matched, c.wantMatched)
+			}
+		})
+	}
+
+	t.Run("unknown rules are reported", func(t *testing.T) {
+		results := evaluateRBACFilters([]*rbacFilter{newTestRBACFilter(rbac.RBAC_DENY, denyNotClaim)},
+			newTestRequest("", "10.1.2.3", "GET"))
+		if len(results[0].Unevaluated) == 0 {
+			t.Errorf("no unevaluated rules for a claim")
+		}
+	})
+}
+
+// newRBACFilterChain returns a chain of an HTTP connection manager with an RBAC filter allowing the principal.
+func newRBACFilterChain(t *testing.T, match *listener.FilterChainMatch, principal *rbac.Principal) *listener.FilterChain {
+	t.Helper()
+	config, err := ptypes.MarshalAny(&httprbac.RBAC{Rules: &rbac.RBAC{
+		Action: rbac.RBAC_ALLOW,
+		Policies: map[string]*rbac.Policy{
+			"policy": {Permissions: []*rbac.Permission{anyPermission()}, Principals: []*rbac.Principal{principal}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := ptypes.MarshalAny(&hcm.HttpConnectionManager{
+		HttpFilters: []*hcm.HttpFilter{{Name: HTTPRBACFilter, ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: config}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &listener.FilterChain{
+		FilterChainMatch: match,
+		Filters:          []*listener.Filter{{Name: HTTPListener, ConfigType: &listener.Filter_TypedConfig{TypedConfig: manager}}},
+	}
+}
+
+func TestSelectRBACFilters(t *testing.T) {
+	port := &wrappers.UInt32Value{Value: 8080}
+	l := &xdsapi.Listener{
+		Name: "virtualInbound",
+		FilterChains: []*listener.FilterChain{
+			newRBACFilterChain(t, &listener.FilterChainMatch{DestinationPort: port, TransportProtocol: "tls",
+				ApplicationProtocols: []string{"istio-peer-exchange", "istio"}}, exactPrincipal("cluster.local/ns/default/sa/sleep")),
+			newRBACFilterChain(t, &listener.FilterChainMatch{DestinationPort: port, TransportProtocol: "raw_buffer",
+				ApplicationProtocols: []string{"http/1.0", "http/1.1", "h2c"}}, sourceIPPrincipal("10.1.0.0", 16)),
+			newRBACFilterChain(t, &listener.FilterChainMatch{DestinationPort: &wrappers.UInt32Value{Value: 9090}},
+				anyPrincipal()),
+		},
+	}
+	filters := retrieveRBACFilters(l)
+	cases := []struct {
+		name      string
+		conn      *connectionInfo
+		wantChain []int
+	}{
+		{"mtls", &connectionInfo{destinationPort: 8080, transportProtocol: "tls", applicationProtocols: istioMTLSProtocols}, []int{0}},
+		{"plaintext http", &connectionInfo{destinationPort: 8080, transportProtocol: "raw_buffer",
+			applicationProtocols: []string{"http/1.1"}}, []int{1}},
+		{"plaintext without alpn", &connectionInfo{destinationPort: 8080, transportProtocol: "raw_buffer"}, nil},
+		{"other port", &connectionInfo{destinationPort: 9090, transportProtocol: "raw_buffer"}, []int{2}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var chains []int
+			for _, f := range selectRBACFilters([]*xdsapi.Listener{l}, filters, c.conn) {
+				chains = append(chains, f.chain)
+			}
+			if !reflect.DeepEqual(chains, c.wantChain) {
+				t.Errorf("selected chains = %v, want %v", chains, c.wantChain)
+			}
+		})
+	}
+}
+
+func TestOutputAuthzResults(t *testing.T) {
+	result := func(decision string, shadow bool) *authzResult {
+		return &authzResult{Listener: "virtualInbound", FilterChain: "0", Filter: HTTPRBACFilter, Decision: decision, Shadow: shadow}
+	}
+	cases := []struct {
+		name    string
+		results []*authzResult
+		want    string
+	}{
+		{"all allow", []*authzResult{result(decisionAllow, false), result(decisionAllow, false)}, decisionAllow},
+		{"unknown then deny", []*authzResult{result(decisionUnknown, false), result(decisionDeny, false)}, decisionDeny},
+		{"unknown then allow", []*authzResult{result(decisionUnknown, false), result(decisionAllow, false)}, decisionUnknown},
+		{"deny then unknown", []*authzResult{result(decisionDeny, false), result(decisionUnknown, false)}, decisionDeny},
+		{"shadow deny", []*authzResult{result(decisionDeny, true), result(decisionAllow, false)}, decisionAllow},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			want := "Request through virtualInbound 0: " + c.want + "\n"
+			if got := outputAuthzResults(c.results); !strings.Contains(got, want) {
+				t.Errorf("outputAuthzResults() = %q, want it to contain %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/cobra"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+	"xdscli/pkg/xdsclient"
+)
+
+func bench() *cobra.Command {
+	b := &benchmark{}
+	localCmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Simulate many proxies connected to pilot",
+		Long: "Open concurrent ADS streams with synthetic node IDs, subscribe to CDS, EDS, LDS and RDS like Envoy, " +
+			"ACK every response and report time to first config, push fan-out latency, bytes received and errors.",
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
+			defer func() {
+				pilotClient.close()
+			}()
+
+			pods, err := b.pods()
+			if err != nil {
+				fatalf("Cannot get pods: %v", err)
+			}
+			client, _ := pilotClient.xdsClient()
+			b.run(ctx, client, pods)
+			fmt.Println(b.outputShort())
+		},
+	}
+	localCmd.Flags().IntVarP(&b.proxies, "proxies", "n", 10, "Number of concurrent proxies")
+	localCmd.Flags().DurationVarP(&b.duration, "duration", "", time.Minute, "How long to keep the streams open")
+	localCmd.Flags().DurationVarP(&b.interval, "interval", "", 10*time.Millisecond, "Delay between starting two proxies")
+	localCmd.Flags().BoolVarP(&b.realPods, "real-pods", "", false, "Use node IDs of the sidecar pods in the cluster instead of fake pods")
+	localCmd.Flags().StringVarP(&b.namespace, "namespace", "", "default", "Namespace of the fake pods")
+	return localCmd
+}
+
+type benchmark struct {
+	proxies   int
+	duration  time.Duration
+	interval  time.Duration
+	realPods  bool
+	namespace string
+
+	mu                sync.Mutex
+	firstSeen         map[string]time.Time
+	timeToFirstConfig []time.Duration
+	fanOut            []time.Duration
+	responses         map[string]int
+	bytes             map[string]int
+	errors            int
+}
+
+// pods returns the pods to simulate: fake pods, or the sidecar pods of the cluster repeated as needed.
+func (b *benchmark) pods() ([]*proxy.Pod, error) {
+	var pods []*proxy.Pod
+	if !b.realPods {
+		for i := 0; i < b.proxies; i++ {
+			pods = append(pods, &proxy.Pod{
+				Name:      fmt.Sprintf("xdscli-bench-%d", i),
+				Namespace: b.namespace,
+				IP:        fmt.Sprintf("10.255.%d.%d", (i/256)%256, i%256),
+				ProxyType: proxyType,
+			})
+		}
+		return pods, nil
+	}
+	sidecars, err := proxy.SidecarPods(resolveKubeConfigPath(kubeConfig), meta_v1.NamespaceAll, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(sidecars) == 0 {
+		return nil, fmt.Errorf("no sidecar pods found")
+	}
+	for i := 0; i < b.proxies; i++ {
+		pods = append(pods, sidecars[i%len(sidecars)])
+	}
+	return pods, nil
+}
+
+// run starts a stream per pod and waits until the duration is over or the context is done.
+func (b *benchmark) run(ctx context.Context, client *xdsclient.Client, pods []*proxy.Pod) {
+	b.firstSeen = map[string]time.Time{}
+	b.responses = map[string]int{}
+	b.bytes = map[string]int{}
+
+	ctx, cancel := context.WithTimeout(ctx, b.duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod *proxy.Pod) {
+			defer wg.Done()
+			b.runProxy(ctx, client, pod)
+		}(pod)
+		select {
+		case <-time.After(b.interval):
+		case <-ctx.Done():
+		}
+	}
+	log.Infof("Started %d proxies", len(pods))
+	wg.Wait()
+}
+
+// runProxy subscribes to the same resources as Envoy would, in the same order: CDS, EDS for the EDS
+// clusters, LDS, then RDS for the route configurations used by listeners.
+func (b *benchmark) runProxy(ctx context.Context, client *xdsclient.Client, pod *proxy.Pod) {
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		b.recordError(ctx, err)
+		return
+	}
+	defer stream.Close()
+
+	node := pod.Node()
+	start := time.Now()
+	requests := map[string]*xdsapi.DiscoveryRequest{}
+	received := map[string]bool{}
+	send := func(typeURL string, names []string, res *xdsapi.DiscoveryResponse) error {
+		req := &xdsapi.DiscoveryRequest{Node: node, TypeUrl: typeURL, ResourceNames: names}
+		if prev, ok := requests[typeURL]; ok {
+			req.VersionInfo = prev.VersionInfo
+			req.ResponseNonce = prev.ResponseNonce
+		}
+		if res != nil {
+			req.VersionInfo = res.VersionInfo
+			req.ResponseNonce = res.Nonce
+		}
+		requests[typeURL] = req
+		return stream.Send(req)
+	}
+	if err := send(v2.ClusterType, nil, nil); err != nil {
+		b.recordError(ctx, err)
+		return
+	}
+
+	initial := true
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			b.recordError(ctx, err)
+			return
+		}
+		b.recordResponse(res, !initial)
+		received[res.TypeUrl] = true
+
+		dump := newConfigDump()
+		if err := dump.add(res); err != nil {
+			log.Warnf("Proxy %s: %v", node.Id, err)
+		}
+		if err := send(res.TypeUrl, requests[res.TypeUrl].GetResourceNames(), res); err != nil {
+			b.recordError(ctx, err)
+			return
+		}
+		switch res.TypeUrl {
+		case v2.ClusterType:
+			if names := dump.edsClusterNames(); !stringsEqual(names, requests[v2.EndpointType].GetResourceNames()) {
+				err = send(v2.EndpointType, names, nil)
+			}
+			if _, ok := requests[v2.ListenerType]; !ok && err == nil {
+				err = send(v2.ListenerType, nil, nil)
+			}
+		case v2.ListenerType:
+			if names := dump.routeNames(); !stringsEqual(names, requests[v2.RouteType].GetResourceNames()) {
+				err = send(v2.RouteType, names, nil)
+			}
+		}
+		if err != nil {
+			b.recordError(ctx, err)
+			return
+		}
+
+		if initial && received[v2.ClusterType] && received[v2.ListenerType] &&
+			(received[v2.EndpointType] || requests[v2.EndpointType] == nil) &&
+			(received[v2.RouteType] || requests[v2.RouteType] == nil) {
+			initial = false
+			b.mu.Lock()
+			b.timeToFirstConfig = append(b.timeToFirstConfig, time.Since(start))
+			b.mu.Unlock()
+		}
+	}
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordResponse counts the response and, for pushes after the initial config, the delay since the
+// first proxy received the same version.
+func (b *benchmark) recordResponse(res *xdsapi.DiscoveryResponse, push bool) {
+	now := time.Now()
+	key := res.TypeUrl + "/" + res.VersionInfo
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.responses[res.TypeUrl]++
+	b.bytes[res.TypeUrl] += proto.Size(res)
+	first, ok := b.firstSeen[key]
+	if !ok {
+		first = now
+		b.firstSeen[key] = now
+	}
+	if push {
+		b.fanOut = append(b.fanOut, now.Sub(first))
+	}
+}
+
+func (b *benchmark) recordError(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		// The benchmark is over.
+		return
+	}
+	log.Warnf("Stream error: %v", err)
+	b.mu.Lock()
+	b.errors++
+	b.mu.Unlock()
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func outputLatencies(w *tabwriter.Writer, name string, durations []time.Duration) {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	fmt.Fprintf(w, "%s\t%d\t%v\t%v\t%v\t%v\n", name, len(sorted),
+		percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), percentile(sorted, 100))
+}
+
+func (b *benchmark) outputShort() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "LATENCY\tCOUNT\tP50\tP90\tP99\tMAX")
+	outputLatencies(w, "time to first config", b.timeToFirstConfig)
+	outputLatencies(w, "push fan-out", b.fanOut)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "TYPE\tRESPONSES\tBYTES")
+	for _, typeURL := range []string{v2.ClusterType, v2.EndpointType, v2.ListenerType, v2.RouteType} {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", typeURL, b.responses[typeURL], b.bytes[typeURL])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "PROXIES\t%d\n", b.proxies)
+	fmt.Fprintf(w, "ERRORS\t%d\n", b.errors)
+	w.Flush()
+	return buf.String()
+}
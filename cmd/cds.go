@@ -9,11 +9,16 @@ import (
 	"github.com/spf13/cobra"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/pkg/conversion"
 	"github.com/golang/protobuf/ptypes"
 	any "github.com/golang/protobuf/ptypes/any"
 	"istio.io/istio/pilot/pkg/model"
 
 	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
 )
 
 func cds() *cobra.Command {
@@ -24,6 +29,7 @@ func cds() *cobra.Command {
 	localCmd.Flags().StringVarP(&handler.direction, "direction", "d", "", "Filter clusters by Direction field")
 	localCmd.Flags().StringVarP(&handler.subset, "subset", "", "", "Filter clusters by substring of Subset field")
 	localCmd.Flags().Uint32VarP(&handler.port, "port", "p", 0, "Filter clusters by Port field")
+	localCmd.Flags().StringVarP(&handler.source, "source", "", "", "Filter clusters by substring of the Istio config that generated them")
 	localCmd.Flags().BoolVarP(&handler.showAll, "all", "", false, "Show all")
 	return localCmd
 }
@@ -34,11 +40,12 @@ type cdsHandler struct {
 	direction string
 	subset    string
 	port      uint32
+	source    string
 	showAll   bool
 }
 
-func (c *cdsHandler) makeRequest(pod *PodInfo) *xdsapi.DiscoveryRequest {
-	return pod.makeRequest("cds")
+func (c *cdsHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	return newRequest(pod, "cds")
 }
 
 func (c *cdsHandler) match(cluster *xdsapi.Cluster) bool {
@@ -61,6 +68,9 @@ func (c *cdsHandler) match(cluster *xdsapi.Cluster) bool {
 			return false
 		}
 	}
+	if !matchSource(c.source, []string{retrieveIstioSource(cluster.Metadata)}) {
+		return false
+	}
 	return true
 }
 
@@ -71,6 +81,7 @@ func (c *cdsHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
 	}
 	filterResp := &xdsapi.DiscoveryResponse{
 		Resources: []*any.Any{},
+		TypeUrl:   resp.TypeUrl,
 	}
 	for _, res := range resp.Resources {
 		cluster := &xdsapi.Cluster{}
@@ -94,7 +105,7 @@ func (c *cdsHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
 
 func (c *cdsHandler) output(resp *xdsapi.DiscoveryResponse) {
 	if outputFormat == "json" {
-		outputJSON(resp)
+		outputResponseJSON(resp)
 		return
 	}
 
@@ -109,24 +120,81 @@ func retrieveSocketMatch(cluster *xdsapi.Cluster) []string {
 	return ret
 }
 
+// retrieveUpstreamTLSContext returns the TLS context of a transport socket, or nil if it is not TLS.
+func retrieveUpstreamTLSContext(socket *core1.TransportSocket) *auth.UpstreamTlsContext {
+	tlsContext := &auth.UpstreamTlsContext{}
+	switch c := socket.GetConfigType().(type) {
+	case *core1.TransportSocket_TypedConfig:
+		if !ptypes.Is(c.TypedConfig, tlsContext) {
+			return nil
+		}
+		if err := ptypes.UnmarshalAny(c.TypedConfig, tlsContext); err != nil {
+			log.Errorf("Cannot unmarshal any proto to TLSContext: %v", err)
+			return nil
+		}
+		return tlsContext
+	case *core1.TransportSocket_Config:
+		if socket.Name != "tls" && socket.Name != "envoy.transport_sockets.tls" {
+			return nil
+		}
+		if err := conversion.StructToMessage(c.Config, tlsContext); err != nil {
+			log.Errorf("Cannot convert struct to TLSContext: %v", err)
+			return nil
+		}
+		return tlsContext
+	}
+	return nil
+}
+
+// retrieveClusterTransportProtocol classifies the upstream connections of a cluster as
+// TCP|TLS|MTLS, or AUTO when Istio picks mTLS per endpoint with transport socket matches.
+func retrieveClusterTransportProtocol(cluster *xdsapi.Cluster) string {
+	tlsContext := cluster.GetTlsContext()
+	if cluster.TransportSocket != nil {
+		tlsContext = retrieveUpstreamTLSContext(cluster.TransportSocket)
+	}
+	if tlsContext != nil {
+		common := tlsContext.GetCommonTlsContext()
+		if len(common.GetTlsCertificates()) != 0 || len(common.GetTlsCertificateSdsSecretConfigs()) != 0 {
+			return "MTLS"
+		}
+		return "TLS"
+	}
+	for _, m := range cluster.TransportSocketMatches {
+		if retrieveUpstreamTLSContext(m.TransportSocket) != nil {
+			return "AUTO"
+		}
+	}
+	return "TCP"
+}
+
+// retrieveEDSServiceName returns the name to use in EDS requests for the cluster.
+func retrieveEDSServiceName(cluster *xdsapi.Cluster) string {
+	if name := cluster.GetEdsClusterConfig().GetServiceName(); name != "" {
+		return name
+	}
+	return cluster.Name
+}
+
 func (c *cdsHandler) outputShort(resp *xdsapi.DiscoveryResponse) string {
 	var buf bytes.Buffer
 	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
-	fmt.Fprintln(w,  "SERVICE FQDN\tPORT\tSUBSET\tDIRECTION\tTYPE\tSOCKET_MATCH")
+	fmt.Fprintln(w,  "SERVICE FQDN\tPORT\tSUBSET\tDIRECTION\tTYPE\tSOCKET_MATCH\tSOURCE")
 	for _, res := range resp.Resources {
 		cluster := &xdsapi.Cluster{}
 		if err := ptypes.UnmarshalAny(res, cluster); err != nil {
 			log.Errorf("Cannot unmarshal any proto to cluster: %v", err)
 			continue
 		}
+		source := formatSources([]string{retrieveIstioSource(cluster.Metadata)})
 		if len(strings.Split(cluster.Name, "|")) > 3 {
 			direction, subset, fqdn, port := model.ParseSubsetKey(cluster.Name)
 			if subset == "" {
 				subset = "-"
 			}
-			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%s\t%v\n", fqdn, port, subset, direction, cluster.GetType(), retrieveSocketMatch(cluster))
+			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%s\t%v\t%s\n", fqdn, port, subset, direction, cluster.GetType(), retrieveSocketMatch(cluster), source)
 		} else {
-			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%s\t%v\n", cluster.Name, "-", "-", "-", cluster.GetType(), retrieveSocketMatch(cluster))
+			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%s\t%v\t%s\n", cluster.Name, "-", "-", "-", cluster.GetType(), retrieveSocketMatch(cluster), source)
 		}
 	}
 	w.Flush()
@@ -15,35 +15,39 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	ads "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	csds "github.com/envoyproxy/go-control-plane/envoy/service/status/v2"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	any "github.com/golang/protobuf/ptypes/any"
 	"github.com/spf13/cobra"
-	"google.golang.org/grpc"
-	v1 "k8s.io/api/core/v1"
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp" //nolint
-	"k8s.io/client-go/tools/clientcmd"
-
-	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
 
 	"istio.io/pkg/env"
 	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+	"xdscli/pkg/xdsclient"
 )
 
 const (
@@ -51,106 +55,22 @@ const (
 	localPortEnd   = 60000
 )
 
-// PodInfo holds information to identify pod.
-type PodInfo struct {
-	Name      string
-	Namespace string
-	IP        string
-	ProxyType string
-}
-
-func getAllPods(kubeconfig string) (*v1.PodList, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if err != nil {
-		return nil, err
-	}
-	clientset, err := kubernetes.NewForConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	return clientset.CoreV1().Pods(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
-}
-
-func newPodInfo(nameOrAppLabel string, kubeconfig string, proxyType string) *PodInfo {
+// findProxy returns the pod given by --proxytag, or exits if there is none.
+func findProxy() *proxy.Pod {
+	kubeconfig := resolveKubeConfigPath(kubeConfig)
 	log.Debugf("Using kube config at %s", kubeconfig)
-	pods, err := getAllPods(kubeconfig)
+	pod, err := proxy.Find(kubeconfig, proxyTag, proxyType)
 	if err != nil {
-		log.Errorf(err.Error())
-		return nil
-	}
-	
-	for _, pod := range pods.Items {
-		log.Debugf("pod %q", pod.Name)
-		if pod.Name == nameOrAppLabel {
-			log.Debugf("Found pod %s.%s~%s matching name %q", pod.Name, pod.Namespace, pod.Status.PodIP, nameOrAppLabel)
-			return &PodInfo{
-				Name:      pod.Name,
-				Namespace: pod.Namespace,
-				IP:        pod.Status.PodIP,
-				ProxyType: proxyType,
-			}
-		}
-		if app, ok := pod.ObjectMeta.Labels["app"]; ok && app == nameOrAppLabel {
-			log.Debugf("Found pod %s.%s~%s matching app label %q", pod.Name, pod.Namespace, pod.Status.PodIP, nameOrAppLabel)
-			return &PodInfo{
-				Name:      pod.Name,
-				Namespace: pod.Namespace,
-				IP:        pod.Status.PodIP,
-				ProxyType: proxyType,
-			}
-		}
-		if istio, ok := pod.ObjectMeta.Labels["istio"]; ok && istio == nameOrAppLabel {
-			log.Debugf("Found pod %s.%s~%s matching app label %q", pod.Name, pod.Namespace, pod.Status.PodIP, nameOrAppLabel)
-			return &PodInfo{
-				Name:      pod.Name,
-				Namespace: pod.Namespace,
-				IP:        pod.Status.PodIP,
-			}
-		}
-	}
-	log.Warnf("Cannot find pod with name or app label matching %q in registry.", nameOrAppLabel)
-	return nil
-}
-
-func (p PodInfo) makeNodeID() string {	
-	if p.ProxyType != "" {
-		return fmt.Sprintf("%s~%s~%s.%s~%s.svc.cluster.local", p.ProxyType, p.IP, p.Name, p.Namespace, p.Namespace)
+		fatalf("Cannot find proxy %q: %v", proxyTag, err)
 	}
-	if strings.HasPrefix(p.Name, "istio-ingressgateway") || strings.HasPrefix(p.Name, "istio-egressgateway") {
-		return fmt.Sprintf("router~%s~%s.%s~%s.svc.cluster.local", p.IP, p.Name, p.Namespace, p.Namespace)
-	}
-	if strings.HasPrefix(p.Name, "istio-ingress") {
-		return fmt.Sprintf("ingress~%s~%s.%s~%s.svc.cluster.local", p.IP, p.Name, p.Namespace, p.Namespace)
-	}
-	return fmt.Sprintf("sidecar~%s~%s.%s~%s.svc.cluster.local", p.IP, p.Name, p.Namespace, p.Namespace)
-}
-
-func configTypeToTypeURL(configType string) string {
-	switch configType {
-	case "lds":
-		return v2.ListenerType
-	case "cds":
-		return v2.ClusterType
-	case "rds":
-		return v2.RouteType
-	case "eds":
-		return v2.EndpointType
-	default:
-		panic(fmt.Sprintf("Unknown type %s", configType))
-	}
-}
-
-func (p PodInfo) makeRequest(configType string) *xdsapi.DiscoveryRequest {
-	return &xdsapi.DiscoveryRequest{
-		Node: &core1.Node{
-			Id: p.makeNodeID(),
-		},
-		TypeUrl: configTypeToTypeURL(configType)}
+	log.Debugf("Found pod %s.%s~%s matching %q", pod.Name, pod.Namespace, pod.IP, proxyTag)
+	return pod
 }
 
-func (p PodInfo) appendResources(req *xdsapi.DiscoveryRequest, resources []string) *xdsapi.DiscoveryRequest {
-	req.ResourceNames = resources
-	return req
+// newRequest returns the initial request of the proxy for the resources of the type, given by short
+// name (lds, cds...) or type URL.
+func newRequest(pod *proxy.Pod, configType string, names ...string) *xdsapi.DiscoveryRequest {
+	return xdsclient.NewRequest(pod.Node(), configTypeToTypeURL(configType), names)
 }
 
 var homeVar = env.RegisterStringVar("HOME", "", "")
@@ -165,75 +85,160 @@ func resolveKubeConfigPath(kubeConfig string) string {
 }
 
 // nolint: golint
-func portForwardPilot(kubeConfig, pilotURL string) (*os.Process, string, error) {
+func portForwardPilot(ctx context.Context, kubeConfig, pilotURL string) (*os.Process, string, error) {
 	if pilotURL != "" {
 		// No need to port-forward, url is already provided.
 		return nil, pilotURL, nil
 	}
 	log.Debug("Pilot url is not provided, try to port-forward pilot pod.")
 
-	podName := ""
-	pods, err := getAllPods(kubeConfig)
+	pods, err := proxy.PilotPods(kubeConfig)
 	if err != nil {
 		return nil, "", err
 	}
-	for _, pod := range pods.Items {
-		if app, ok := pod.ObjectMeta.Labels["istio"]; ok && app == "pilot" {
-			podName = pod.Name
-		}
-	}
-	if podName == "" {
-		return nil, "", fmt.Errorf("cannot find istio-pilot pod")
+	return portForward(ctx, pods[len(pods)-1], "istio-system", 15010)
+}
+
+// portForwards holds the kubectl processes started by portForward, killed on SIGINT or SIGTERM and
+// by fatalf.
+var portForwards = struct {
+	sync.Mutex
+	processes []*os.Process
+}{}
+
+func killPortForwards() {
+	portForwards.Lock()
+	defer portForwards.Unlock()
+	for _, p := range portForwards.processes {
+		_ = p.Kill()
 	}
+	portForwards.processes = nil
+}
+
+// fatalf logs and exits like log.Fatalf, killing the port-forwards first as deferred cleanups do not
+// run on exit.
+func fatalf(template string, args ...interface{}) {
+	killPortForwards()
+	log.Fatalf(template, args...)
+}
 
+// portForward forwards a random local port to the port of the pod and returns the kubectl process
+// and the local address once it is reachable. The process is killed when the context is done.
+func portForward(ctx context.Context, podName, namespace string, port int) (*os.Process, string, error) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	localPort := r.Intn(localPortEnd-localPortStart) + localPortStart
-	cmd := fmt.Sprintf("kubectl port-forward %s -n istio-system %d:15010", podName, localPort)
+	cmd := fmt.Sprintf("kubectl port-forward %s -n %s %d:%d", podName, namespace, localPort, port)
 	parts := strings.Split(cmd, " ")
-	c := exec.Command(parts[0], parts[1:]...)
-	err = c.Start()
+	c := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	err := c.Start()
 	if err != nil {
 		return nil, "", err
 	}
-	// Make sure istio-pilot is reachable.
+	portForwards.Lock()
+	portForwards.processes = append(portForwards.processes, c.Process)
+	portForwards.Unlock()
+	// Make sure the pod is reachable.
 	reachable := false
 	url := fmt.Sprintf("localhost:%d", localPort)
-	for i := 0; i < 10 && !reachable; i++ {
+	for i := 0; i < 10 && !reachable && ctx.Err() == nil; i++ {
 		conn, err := net.Dial("tcp", url)
 		if err == nil {
 			_ = conn.Close()
 			reachable = true
 		}
-		time.Sleep(1 * time.Second)
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+		}
 	}
 	if !reachable {
-		return nil, "", fmt.Errorf("cannot reach local pilot url: %s", url)
+		_ = c.Process.Kill()
+		return nil, "", fmt.Errorf("cannot reach local url: %s", url)
 	}
 	return c.Process, fmt.Sprintf("localhost:%d", localPort), nil
 }
 
 // PilotClient holds information to make xDS request to pilot.
 type PilotClient struct {
-	pilotURL           string
+	// Guards client, portForwardProcess and generation, which are replaced when the port-forward is
+	// restarted while other goroutines may be streaming on the same client.
+	mu                 sync.Mutex
+	client             *xdsclient.Client
 	portForwardProcess *os.Process
+	// Incremented each time the port-forward is restarted.
+	generation int
 
 	streaming bool
+
+	// If set, responses with resources failing validation are NACKed.
+	nackOnInvalid bool
+
+	// NACKs to inject.
+	nack nackOptions
+
+	// File to read subscription changes from while watching, "-" for stdin.
+	subscriptionChanges string
+}
+
+// commandContext returns a context cancelled on SIGINT or SIGTERM, so that streams stop and
+// port-forwards are cleaned up before exiting.
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Infof("Received %v, cleaning up", sig)
+			// Killed right away, as the command may exit before deferred cleanups run.
+			killPortForwards()
+			cancel()
+		case <-ctx.Done():
+		}
+		// A second signal terminates right away.
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
 }
 
 // NewPilotClient create new pilot client. It will create a port-forward to pilot if needed.
-func newPilotClient() *PilotClient {
-	process, effectivePilotURL, err := portForwardPilot(resolveKubeConfigPath(kubeConfig), pilotURL)
+func newPilotClient(ctx context.Context) *PilotClient {
+	process, effectivePilotURL, err := portForwardPilot(ctx, resolveKubeConfigPath(kubeConfig), pilotURL)
 	if err != nil {
-		log.Fatalf("Cannot do port-forwarding for pilot: %v", err)
+		fatalf("Cannot do port-forwarding for pilot: %v", err)
 	}
 	return &PilotClient{
-		pilotURL:           effectivePilotURL,
-		portForwardProcess: process,
-		streaming:          streaming,
+		client:              newXDSClient(effectivePilotURL),
+		portForwardProcess:  process,
+		streaming:           streaming,
+		nackOnInvalid:       nackOnInvalid,
+		nack:                nack,
+		subscriptionChanges: subscriptionChanges,
 	}
 }
 
+// newXDSClient returns a client of the xDS server at url, with the timeouts and max message size of
+// the flags.
+func newXDSClient(url string) *xdsclient.Client {
+	return xdsclient.New(xdsclient.Options{
+		URL:            url,
+		Timeout:        timeout,
+		ConnectTimeout: connectTimeout,
+		MaxRecvMsgSize: maxRecvMsgSize,
+		KeepaliveTime:  keepaliveTime,
+	})
+}
+
+// xdsClient returns the client to pilot and its generation.
+func (c *PilotClient) xdsClient() (*xdsclient.Client, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client, c.generation
+}
+
 func (c *PilotClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.portForwardProcess != nil {
 		log.Debugf("Close port-forward process %d", c.portForwardProcess.Pid)
 		if err := c.portForwardProcess.Kill(); err != nil {
@@ -243,53 +248,283 @@ func (c *PilotClient) close() {
 }
 
 type xDSHandler interface {
-	makeRequest(pod *PodInfo) *xdsapi.DiscoveryRequest
+	makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest
 	onXDSResponse(resp *xdsapi.DiscoveryResponse) error
 }
 
-func (c *PilotClient) send(req *xdsapi.DiscoveryRequest, handler xDSHandler) {
+const (
+	reconnectInitialBackoff = time.Second
+	reconnectMaxBackoff     = time.Minute
+)
+
+// streamState is what a watch keeps across reconnects.
+type streamState struct {
+	ackedVersion string
+	responses    int
+	nacked       *nackReport
+	sub          *subscription
+	following    bool
+	// File to read subscription changes from, if supported for the request.
+	subscriptionChanges string
+}
+
+// send sends the request and handles the responses. In watch mode, the stream is re-established
+// with exponential backoff when it fails, resuming from the last ACKed version.
+func (c *PilotClient) send(ctx context.Context, req *xdsapi.DiscoveryRequest, handler xDSHandler) {
 	log.Infof("Send xDS request:\n%s\n", req.String())
-	conn, err := grpc.Dial(c.pilotURL, grpc.WithInsecure())
+	state := &streamState{
+		ackedVersion:        req.VersionInfo,
+		sub:                 newSubscription(),
+		subscriptionChanges: c.subscriptionChanges,
+	}
+	if state.subscriptionChanges != "" && (!c.streaming || !supportsSubscriptionChanges(req.TypeUrl)) {
+		log.Warnf("Subscription changes are only supported for eds and rds with --watch")
+		state.subscriptionChanges = ""
+	}
+
+	backoff := reconnectInitialBackoff
+	for attempt := 1; ; attempt++ {
+		client, generation := c.xdsClient()
+		received, err := c.stream(ctx, client, req, handler, state)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, xdsclient.ErrMessageTooLarge) {
+			// Reconnecting would get the same response again.
+			fatalf("Stream failed: %v. Use --max-recv-msg-size to accept it", err)
+		}
+		if !c.streaming {
+			fatalf("Stream failed: %v", err)
+		}
+		if received {
+			backoff = reconnectInitialBackoff
+		}
+		log.Warnf("Stream to %s failed: %v. Reconnecting in %v", client.URL(), err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+		if err := c.restartPortForward(ctx, generation); err != nil {
+			log.Warnf("Cannot port-forward pilot: %v", err)
+			continue
+		}
+		client, _ = c.xdsClient()
+		// A nonce from the previous stream is stale on the new one and would get the request
+		// ignored, so only the version is resumed, like Envoy does.
+		req = &xdsapi.DiscoveryRequest{
+			VersionInfo:   state.ackedVersion,
+			TypeUrl:       req.TypeUrl,
+			Node:          req.Node,
+			ResourceNames: req.ResourceNames,
+		}
+		log.Infof("Reconnecting to %s (attempt %d), resuming from version %q", client.URL(), attempt, state.ackedVersion)
+	}
+}
+
+// restartPortForward replaces the port-forward to pilot, which may have died with the stream, if
+// there is one. Streams sharing the client fail together, so only the first one to fail on the
+// client of the given generation restarts it; the others reconnect with the new one.
+func (c *PilotClient) restartPortForward(ctx context.Context, generation int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.portForwardProcess == nil || c.generation != generation {
+		return nil
+	}
+	// A failed attempt is also a new generation, so that the next failure is retried once.
+	c.generation++
+	_ = c.portForwardProcess.Kill()
+	process, url, err := portForwardPilot(ctx, resolveKubeConfigPath(kubeConfig), "")
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
-	defer func() { _ = conn.Close() }()
+	c.portForwardProcess = process
+	c.client = newXDSClient(url)
+	return nil
+}
 
-	adsClient := ads.NewAggregatedDiscoveryServiceClient(conn)
-	stream, err := adsClient.StreamAggregatedResources(context.Background())
+// stream sends the request on a new stream and handles responses until done. It returns whether
+// any response was received, and the error if the stream failed or the first response did not come
+// in time.
+func (c *PilotClient) stream(parent context.Context, client *xdsclient.Client, req *xdsapi.DiscoveryRequest,
+	handler xDSHandler, state *streamState) (bool, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	stream, err := client.Stream(ctx)
 	if err != nil {
-		log.Fatalf("Cannot call gRPC: %v", err)
+		return false, err
 	}
-	if err := stream.Send(req); err != nil {
-		log.Fatalf("Cannot send request: %v", err)
+	defer stream.Close()
+	sub := state.sub
+	sub.setStream(stream)
+	if err := sub.send(req); err != nil {
+		return false, fmt.Errorf("cannot send request: %v", err)
 	}
+	if state.subscriptionChanges != "" && !state.following {
+		state.following = true
+		go sub.followChanges(state.subscriptionChanges)
+	}
+	received := false
 	for {
 		log.Infof("Waiting for response .......... ")
 		res, err := stream.Recv()
-		if err == io.EOF {
-			break
+		if err == io.EOF && c.streaming && ctx.Err() == nil {
+			// A watch goes on until interrupted, so the server closing the stream is a failure to
+			// reconnect from.
+			return received, errors.New("stream closed by the server")
+		} else if err == io.EOF {
+			return received, nil
+		} else if err != nil && ctx.Err() != nil {
+			// Interrupted, or stopped waiting for pilot to respond to a NACK.
+			return received, nil
 		} else if err != nil {
-			panic(err.Error())
+			return received, err
+		}
+		received = true
+		state.responses++
+		log.Infof("Received %s at %s with %d resources (%s)", res.TypeUrl, res.VersionInfo, len(res.Resources), formatSize(proto.Size(res)))
+		reaction := state.nacked != nil
+		if reaction {
+			state.nacked.onResponse(res)
+			state.nacked = nil
+		}
+		invalidErr := xdsclient.ValidateResources(res)
+		if invalidErr != nil {
+			log.Warnf("Invalid resources in %s at %s: %v", res.TypeUrl, res.VersionInfo, invalidErr)
 		}
-		log.Infof("Received %s at %s with %d resources", res.TypeUrl, res.VersionInfo, len(res.Resources))
 		if err := handler.onXDSResponse(res); err != nil {
-			log.Fatalf("Error handle xDS response: %v", err)
+			fatalf("Error handle xDS response: %v", err)
 		}
-		ackReq := &xdsapi.DiscoveryRequest{
-			VersionInfo: res.VersionInfo,
-			ResponseNonce: res.Nonce,
-			TypeUrl: req.TypeUrl,
-			Node: req.Node,
-			ResourceNames: req.ResourceNames,
+		injected := false
+		ackReq := xdsclient.ACK(req, res)
+		// Only resources failing validation are NACKed: a decoding failure may be a bug of xdscli.
+		var verr *xdsclient.ValidationError
+		if errors.As(invalidErr, &verr) && len(verr.Invalid) != 0 && c.nackOnInvalid {
+			log.Infof("NACK %s at %s", res.TypeUrl, res.VersionInfo)
+			ackReq.VersionInfo = state.ackedVersion
+			ackReq.ErrorDetail = &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: strings.Join(verr.Invalid, "; "),
+			}
+		} else if c.nack.inject(state.responses, res) && (c.streaming || !reaction) {
+			log.Infof("Injected NACK %s at %s", res.TypeUrl, res.VersionInfo)
+			injected = true
+			ackReq.VersionInfo = state.ackedVersion
+			ackReq.ErrorDetail = &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: c.nack.message,
+			}
+		} else {
+			state.ackedVersion = res.VersionInfo
 		}
-		if err := stream.Send(ackReq); err != nil {
-			log.Fatalf("Cannot ACK: %v", err)
+		// The subscribed names may have changed since the request.
+		if err := sub.send(ackReq); err != nil {
+			return received, fmt.Errorf("cannot ACK: %v", err)
 		}
-	
-		if !c.streaming {
+		if injected {
+			state.nacked = newNACKReport(ctx, &c.nack, req.Node.GetId(), res, func() {
+				if !c.streaming {
+					cancel()
+				}
+			})
+		}
+
+		// Wait for the reaction of pilot to an injected NACK even if not watching.
+		if !c.streaming && state.nacked == nil {
+			return received, nil
+		}
+	}
+}
+
+// fetch sends a single request and returns the first response. The response is not ACKed.
+func (c *PilotClient) fetch(ctx context.Context, req *xdsapi.DiscoveryRequest) (*xdsapi.DiscoveryResponse, error) {
+	log.Debugf("Send xDS request:\n%s\n", req.String())
+	client, _ := c.xdsClient()
+	res, err := client.Fetch(ctx, req.Node, req.TypeUrl, req.ResourceNames)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Received %s at %s with %d resources (%s)", res.TypeUrl, res.VersionInfo, len(res.Resources), formatSize(proto.Size(res)))
+	if err := xdsclient.ValidateResources(res); err != nil {
+		log.Warnf("Invalid resources in %s at %s: %v", res.TypeUrl, res.VersionInfo, err)
+	}
+	return res, nil
+}
+
+// fetchClientStatus calls CSDS on pilot over the client of the other requests. If pilot cannot be
+// reached, the port-forward is restarted and the call retried once.
+func (c *PilotClient) fetchClientStatus(ctx context.Context, req *csds.ClientStatusRequest) (*csds.ClientStatusResponse, error) {
+	log.Debugf("Send CSDS request:\n%s\n", req.String())
+	client, generation := c.xdsClient()
+	resp, err := client.FetchClientStatus(ctx, req)
+	var connectErr *xdsclient.ConnectError
+	if !errors.As(err, &connectErr) {
+		return resp, err
+	}
+	log.Warnf("Cannot connect to %s: %v. Retrying", client.URL(), err)
+	if err := c.restartPortForward(ctx, generation); err != nil {
+		return nil, err
+	}
+	client, _ = c.xdsClient()
+	return client.FetchClientStatus(ctx, req)
+}
+
+// formatSize formats a size in bytes, e.g. 1.5MB.
+func formatSize(bytes int) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value, suffix := float64(bytes)/unit, "KB"
+	for _, s := range []string{"MB", "GB"} {
+		if value < unit {
 			break
 		}
+		value, suffix = value/unit, s
+	}
+	return fmt.Sprintf("%.1f%s", value, suffix)
+}
+
+// retrieveIstioSource returns the Istio config (VirtualService, DestinationRule, Gateway,
+// EnvoyFilter...) that generated the resource, from the "istio" filter metadata. Istio records it as
+// /apis/<group>/<version>/namespaces/<namespace>/<kind>/<name>, shortened here to <kind>/<namespace>/<name>.
+func retrieveIstioSource(md *core1.Metadata) string {
+	source := md.GetFilterMetadata()["istio"].GetFields()["config"].GetStringValue()
+	parts := strings.Split(strings.TrimPrefix(source, "/"), "/")
+	if len(parts) == 7 && parts[0] == "apis" && parts[3] == "namespaces" {
+		return fmt.Sprintf("%s/%s/%s", parts[5], parts[4], parts[6])
+	}
+	return source
+}
+
+// matchSource returns true if the filter is empty or any of the sources contains it.
+func matchSource(filter string, sources []string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, source := range sources {
+		if source != "" && strings.Contains(source, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatSources joins the non empty sources, or returns "-" if there are none.
+func formatSources(sources []string) string {
+	var ret []string
+	for _, source := range sources {
+		if source != "" {
+			ret = appendUnique(ret, source)
+		}
+	}
+	if len(ret) == 0 {
+		return "-"
 	}
+	return strings.Join(ret, ",")
 }
 
 func outputJSON(p proto.Message) {
@@ -299,12 +534,160 @@ func outputJSON(p proto.Message) {
 	var output string
 	var err error
 	if output, err = marshaller.MarshalToString(p); err != nil {
-		log.Fatalf("Cannot convert to JSON: %v", err)
+		fatalf("Cannot convert to JSON: %v", err)
 	}
 
+	writeOutput(output)
+}
+
+// outputResponseJSON writes the response in the same format as outputJSON, but converts the
+// resources one at a time, so that a large response is never held as a single JSON string.
+func outputResponseJSON(resp *xdsapi.DiscoveryResponse) {
+	out := os.Stdout
+	if len(outputFile) != 0 {
+		f, err := openOutputFile()
+		if err != nil {
+			log.Errorf("Cannot write output to file %q", outputFile)
+			return
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	if err := writeResponseJSON(w, resp); err != nil {
+		fatalf("Cannot convert to JSON: %v", err)
+	}
+	if len(outputFile) == 0 || streaming {
+		_, _ = w.WriteString("\n")
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Cannot write output: %v", err)
+	}
+}
+
+// writeResponseJSON writes the fields of the response in the order and indentation of jsonpb.
+func writeResponseJSON(w *bufio.Writer, resp *xdsapi.DiscoveryResponse) error {
+	marshaller := jsonpb.Marshaler{
+		Indent: "  ",
+	}
+	// indented marshals the message, indented to be nested at the given depth.
+	var buf bytes.Buffer
+	indented := func(m proto.Message, depth int) ([]byte, error) {
+		buf.Reset()
+		if err := marshaller.Marshal(&buf, m); err != nil {
+			return nil, err
+		}
+		lines := bytes.Split(buf.Bytes(), []byte("\n"))
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) != 0 {
+				lines[i] = append([]byte(strings.Repeat("  ", depth)), lines[i]...)
+			}
+		}
+		return bytes.Join(lines, []byte("\n")), nil
+	}
+
+	sep := "\n"
+	field := func(name string, value []byte) {
+		fmt.Fprintf(w, "%s  %q: %s", sep, name, value)
+		sep = ",\n"
+	}
+	stringField := func(name, value string) {
+		if value != "" {
+			quoted, _ := json.Marshal(value)
+			field(name, quoted)
+		}
+	}
+
+	_, _ = w.WriteString("{")
+	stringField("versionInfo", resp.VersionInfo)
+	if len(resp.Resources) != 0 {
+		fmt.Fprintf(w, "%s  \"resources\": [", sep)
+		sep = ",\n"
+		for i, r := range resp.Resources {
+			var value []byte
+			var err error
+			if canDecode(r) {
+				value, err = indented(r, 2)
+			}
+			if !canDecode(r) || err != nil {
+				// Unknown type, or one that embeds an unknown type.
+				value, err = rawResourceJSON(r)
+			}
+			if err != nil {
+				return fmt.Errorf("resource %d: %v", i, err)
+			}
+			if i != 0 {
+				_, _ = w.WriteString(",")
+			}
+			_, _ = w.WriteString("\n    ")
+			_, _ = w.Write(value)
+		}
+		_, _ = w.WriteString("\n  ]")
+	}
+	if resp.Canary {
+		field("canary", []byte("true"))
+	}
+	stringField("typeUrl", resp.TypeUrl)
+	stringField("nonce", resp.Nonce)
+	if resp.ControlPlane != nil {
+		value, err := indented(resp.ControlPlane, 1)
+		if err != nil {
+			return err
+		}
+		field("controlPlane", value)
+	}
+	if sep == "\n" {
+		// Empty message.
+		_, _ = w.WriteString("\n")
+	}
+	_, _ = w.WriteString("\n}")
+	return nil
+}
+
+// rawResourceJSON formats a resource whose type is not known as its type URL and base64 encoded value,
+// nested in the resources of a response.
+func rawResourceJSON(res *any.Any) ([]byte, error) {
+	typeURL, err := json.Marshal(res.TypeUrl)
+	if err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(res.Value)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("{\n      \"@type\": %s,\n      \"value\": %s\n    }", typeURL, value)), nil
+}
+
+// outputWritten records whether the output file was written by this run.
+var outputWritten bool
+
+// openOutputFile opens the output file for writing. It is truncated on the first write, then
+// appended to when watching, so that the file records every response, one after another.
+func openOutputFile() (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if streaming && outputWritten {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	outputWritten = true
+	return os.OpenFile(outputFile, flags, 0644)
+}
+
+// writeOutput prints the output to stdout, or to the output file if set.
+func writeOutput(output string) {
 	if len(outputFile) == 0 {
 		fmt.Printf("%s\n", output)
-	} else if err := ioutil.WriteFile(outputFile, []byte(output), 0644); err != nil {
+		return
+	}
+	f, err := openOutputFile()
+	if err != nil {
+		log.Errorf("Cannot write output to file %q", outputFile)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	if streaming {
+		output += "\n"
+	}
+	if _, err := f.WriteString(output); err != nil {
 		log.Errorf("Cannot write output to file %q", outputFile)
 	}
 }
@@ -315,14 +698,16 @@ func makeXDSCmd(use string, handler xDSHandler) *cobra.Command {
 		Short: fmt.Sprintf("Show %s resources", use),
 		Long:  fmt.Sprintf("Show %s resources", use),
 		Run: func(cmd *cobra.Command, args []string) {
-			pilotClient := newPilotClient()
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
 			defer func() {
 				pilotClient.close()
 			}()
 
-			pod := newPodInfo(proxyTag, resolveKubeConfigPath(kubeConfig), proxyType)
+			pod := findProxy()
 			req := handler.makeRequest(pod)
-			pilotClient.send(req, handler)
+			pilotClient.send(ctx, req, handler)
 		},
 	}
 }
@@ -0,0 +1,537 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/spf13/cobra"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+	"xdscli/pkg/xdsclient"
+)
+
+func conformance() *cobra.Command {
+	suite := &conformanceSuite{}
+	var ids []string
+	localCmd := &cobra.Command{
+		Use:   "conformance",
+		Short: "Run xDS protocol conformance scenarios against an ADS server",
+		Long: "Open ADS streams to the server and check how it handles the initial request, ACKs and NACKs, stale " +
+			"nonces, subscription changes, wildcard and named subscriptions, and reconnects with a previous version. " +
+			"Uses the proxy given by --proxytag, or a fake sidecar if not set.",
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
+			defer func() {
+				pilotClient.close()
+			}()
+			client, _ := pilotClient.xdsClient()
+			suite.pilotURL = client.URL()
+			// Expected responses are waited for up to the global --timeout.
+			suite.timeout = timeout
+			suite.node = &core1.Node{Id: conformancePod().NodeID()}
+
+			results, err := suite.run(ctx, ids)
+			if err != nil {
+				fatalf("Cannot run conformance scenarios: %v", err)
+			}
+			if outputFormat == "json" {
+				output, err := json.MarshalIndent(results, "", "  ")
+				if err != nil {
+					fatalf("Cannot convert to JSON: %v", err)
+				}
+				writeOutput(string(output))
+			} else {
+				fmt.Println(outputScenarioResults(results))
+			}
+			failed := 0
+			for _, r := range results {
+				if !r.Passed {
+					failed++
+				}
+			}
+			if failed != 0 {
+				// Closed here, as the deferred close does not run on exit.
+				pilotClient.close()
+				log.Errorf("%d of %d scenarios failed", failed, len(results))
+				os.Exit(1)
+			}
+		},
+	}
+	localCmd.Flags().StringSliceVarP(&ids, "scenarios", "", nil, "Run only the scenarios with these names")
+	localCmd.Flags().DurationVarP(&suite.quiet, "quiet", "", 2*time.Second, "How long to wait to make sure no response is sent")
+	return localCmd
+}
+
+// conformancePod returns the proxy given by --proxytag, or a fake sidecar.
+func conformancePod() *proxy.Pod {
+	if proxyTag != "" {
+		return findProxy()
+	}
+	return &proxy.Pod{
+		Name:      "xdscli-conformance",
+		Namespace: "default",
+		IP:        "10.255.255.254",
+		ProxyType: proxyType,
+	}
+}
+
+// adsStream is an ADS stream whose responses can be waited for with a timeout.
+type adsStream struct {
+	stream    *xdsclient.Stream
+	cancel    context.CancelFunc
+	node      *core1.Node
+	responses chan *xdsapi.DiscoveryResponse
+	err       chan error
+}
+
+func newADSStream(ctx context.Context, pilotURL string, node *core1.Node) (*adsStream, error) {
+	// Responses are waited for by recv, each with its own timeout.
+	client := xdsclient.New(xdsclient.Options{
+		URL:            pilotURL,
+		ConnectTimeout: connectTimeout,
+		MaxRecvMsgSize: maxRecvMsgSize,
+	})
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &adsStream{
+		stream:    stream,
+		cancel:    cancel,
+		node:      node,
+		responses: make(chan *xdsapi.DiscoveryResponse, 10),
+		err:       make(chan error, 1),
+	}
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				s.err <- err
+				return
+			}
+			select {
+			case s.responses <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *adsStream) close() {
+	s.cancel()
+	s.stream.Close()
+}
+
+// request sends a discovery request. A non empty errorMessage makes it a NACK.
+func (s *adsStream) request(typeURL string, names []string, version, nonce, errorMessage string) error {
+	req := &xdsapi.DiscoveryRequest{
+		Node:          s.node,
+		TypeUrl:       typeURL,
+		ResourceNames: names,
+		VersionInfo:   version,
+		ResponseNonce: nonce,
+	}
+	if errorMessage != "" {
+		req.ErrorDetail = &status.Status{Code: int32(codes.InvalidArgument), Message: errorMessage}
+	}
+	return s.stream.Send(req)
+}
+
+// ack ACKs the response, keeping the same subscription.
+func (s *adsStream) ack(res *xdsapi.DiscoveryResponse, names []string) error {
+	return s.request(res.TypeUrl, names, res.VersionInfo, res.Nonce, "")
+}
+
+// recv waits for the next response, and returns ErrNoResponse if none comes in time. A 0 timeout
+// waits until the stream fails.
+func (s *adsStream) recv(timeout time.Duration) (*xdsapi.DiscoveryResponse, error) {
+	var expired <-chan time.Time
+	if timeout != 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case res := <-s.responses:
+		return res, nil
+	case err := <-s.err:
+		return nil, err
+	case <-expired:
+		return nil, xdsclient.ErrNoResponse
+	}
+}
+
+// scenarioResult is the outcome of a conformance scenario.
+type scenarioResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+type conformanceScenario struct {
+	name        string
+	description string
+	run         func(s *conformanceSuite) (string, error)
+}
+
+type conformanceSuite struct {
+	// Context of the current run. Streams are closed when it is done.
+	ctx      context.Context
+	pilotURL string
+	node     *core1.Node
+	timeout  time.Duration
+	quiet    time.Duration
+}
+
+var conformanceScenarios = []conformanceScenario{
+	{"initial-request", "A request with empty version and nonce gets a response with version and nonce", runInitialRequest},
+	{"ack", "An ACK of the latest response is not answered with the same version", runACK},
+	{"nack", "A NACK keeps the stream open and the rejected version is not sent again", runNACK},
+	{"stale-nonce", "A request with a stale nonce is ignored", runStaleNonce},
+	{"wildcard", "Wildcard LDS and CDS requests get all resources", runWildcard},
+	{"named", "Named RDS and EDS requests get only the requested resources", runNamed},
+	{"subscription-change", "Changing EDS resource names mid-stream gets a response for the new names", runSubscriptionChange},
+	{"reconnect", "A new stream with the previous version gets the current config", runReconnect},
+}
+
+// run runs the scenarios with the given names, or all of them.
+func (s *conformanceSuite) run(ctx context.Context, names []string) ([]*scenarioResult, error) {
+	s.ctx = ctx
+	selected := map[string]bool{}
+	for _, name := range names {
+		selected[name] = true
+	}
+	for _, scenario := range conformanceScenarios {
+		delete(selected, scenario.name)
+	}
+	for name := range selected {
+		return nil, fmt.Errorf("unknown scenario %q", name)
+	}
+	for _, name := range names {
+		selected[name] = true
+	}
+	var results []*scenarioResult
+	for _, scenario := range conformanceScenarios {
+		if len(names) != 0 && !selected[scenario.name] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Infof("Running scenario %s: %s", scenario.name, scenario.description)
+		detail, err := scenario.run(s)
+		result := &scenarioResult{Name: scenario.name, Passed: err == nil, Detail: detail}
+		if err != nil {
+			result.Detail = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// subscribe opens a stream and returns it with the first response for the type and names.
+func (s *conformanceSuite) subscribe(typeURL string, names []string) (*adsStream, *xdsapi.DiscoveryResponse, error) {
+	stream, err := newADSStream(s.ctx, s.pilotURL, s.node)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := stream.request(typeURL, names, "", "", ""); err != nil {
+		stream.close()
+		return nil, nil, err
+	}
+	res, err := stream.recv(s.timeout)
+	if err != nil {
+		stream.close()
+		return nil, nil, fmt.Errorf("initial %s request: %v", typeURL, err)
+	}
+	return stream, res, nil
+}
+
+// fetchNames returns the RDS names referenced by listeners and the EDS names of clusters.
+func (s *conformanceSuite) fetchNames() ([]string, []string, error) {
+	dump := newConfigDump()
+	for _, typeURL := range []string{v2.ListenerType, v2.ClusterType} {
+		stream, res, err := s.subscribe(typeURL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		stream.close()
+		if err := dump.add(res); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dump.routeNames(), dump.edsClusterNames(), nil
+}
+
+func runInitialRequest(s *conformanceSuite) (string, error) {
+	stream, res, err := s.subscribe(v2.ClusterType, nil)
+	if err != nil {
+		return "", err
+	}
+	defer stream.close()
+	if res.TypeUrl != v2.ClusterType {
+		return "", fmt.Errorf("response type %s, want %s", res.TypeUrl, v2.ClusterType)
+	}
+	if res.VersionInfo == "" || res.Nonce == "" {
+		return "", fmt.Errorf("response without version (%q) or nonce (%q)", res.VersionInfo, res.Nonce)
+	}
+	return fmt.Sprintf("version %s, nonce %s, %d resources", res.VersionInfo, res.Nonce, len(res.Resources)), nil
+}
+
+func runACK(s *conformanceSuite) (string, error) {
+	stream, res, err := s.subscribe(v2.ClusterType, nil)
+	if err != nil {
+		return "", err
+	}
+	defer stream.close()
+	if err := stream.ack(res, nil); err != nil {
+		return "", err
+	}
+	next, err := stream.recv(s.quiet)
+	switch {
+	case err == xdsclient.ErrNoResponse:
+		return "no response after ACK", nil
+	case err != nil:
+		return "", fmt.Errorf("stream failed after ACK: %v", err)
+	case next.VersionInfo == res.VersionInfo:
+		return "", fmt.Errorf("ACKed version %s was sent again", res.VersionInfo)
+	}
+	return fmt.Sprintf("config changed to version %s after ACK", next.VersionInfo), nil
+}
+
+// runNACK rejects a response in place of ACKing it, with the version of the previously ACKed response
+// as Envoy does. The server must keep the stream open and not send the rejected version again.
+func runNACK(s *conformanceSuite) (string, error) {
+	_, edsNames, err := s.fetchNames()
+	if err != nil {
+		return "", err
+	}
+	if len(edsNames) < 2 {
+		return "", fmt.Errorf("need at least 2 EDS clusters, found %d", len(edsNames))
+	}
+	stream, res, err := s.subscribe(v2.EndpointType, edsNames[:1])
+	if err != nil {
+		return "", err
+	}
+	defer stream.close()
+	if err := stream.ack(res, edsNames[:1]); err != nil {
+		return "", err
+	}
+	acked := res.VersionInfo
+	// Adding a name gets a new response to reject.
+	if err := stream.request(v2.EndpointType, edsNames[:2], acked, res.Nonce, ""); err != nil {
+		return "", err
+	}
+	rejected, err := stream.recv(s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("after changing resource names: %v", err)
+	}
+	if err := stream.request(v2.EndpointType, edsNames[:2], acked, rejected.Nonce, "rejected by xdscli conformance"); err != nil {
+		return "", err
+	}
+	next, err := stream.recv(s.quiet)
+	switch {
+	case err == xdsclient.ErrNoResponse:
+		return fmt.Sprintf("rejected version %s not sent again, %s still applied", rejected.VersionInfo, acked), nil
+	case err != nil:
+		return "", fmt.Errorf("stream failed after NACK: %v", err)
+	case next.VersionInfo == rejected.VersionInfo:
+		return "", fmt.Errorf("rejected version %s was sent again", rejected.VersionInfo)
+	}
+	return fmt.Sprintf("config changed to version %s after NACK of version %s", next.VersionInfo, rejected.VersionInfo), nil
+}
+
+func runStaleNonce(s *conformanceSuite) (string, error) {
+	_, edsNames, err := s.fetchNames()
+	if err != nil {
+		return "", err
+	}
+	if len(edsNames) < 2 {
+		return "", fmt.Errorf("need at least 2 EDS clusters, found %d", len(edsNames))
+	}
+	stream, res, err := s.subscribe(v2.EndpointType, edsNames[:1])
+	if err != nil {
+		return "", err
+	}
+	defer stream.close()
+	if err := stream.ack(res, edsNames[:1]); err != nil {
+		return "", err
+	}
+	// A subscription change with a nonce the server never sent must be ignored.
+	if err := stream.request(v2.EndpointType, edsNames, res.VersionInfo, "xdscli-stale-nonce", ""); err != nil {
+		return "", err
+	}
+	next, err := stream.recv(s.quiet)
+	switch {
+	case err == xdsclient.ErrNoResponse:
+		return "request with stale nonce ignored", nil
+	case err != nil:
+		return "", fmt.Errorf("stream failed after stale nonce: %v", err)
+	}
+	return "", fmt.Errorf("responded to stale nonce with version %s", next.VersionInfo)
+}
+
+func runWildcard(s *conformanceSuite) (string, error) {
+	var details []string
+	for _, typeURL := range []string{v2.ListenerType, v2.ClusterType} {
+		stream, res, err := s.subscribe(typeURL, nil)
+		if err != nil {
+			return "", err
+		}
+		stream.close()
+		if len(res.Resources) == 0 {
+			return "", fmt.Errorf("wildcard %s request returned no resources", typeURL)
+		}
+		details = append(details, fmt.Sprintf("%d %s", len(res.Resources), configTypeShortName(typeURL)))
+	}
+	return strings.Join(details, ", "), nil
+}
+
+// checkNames returns an error if the response has resources that were not requested.
+func checkNames(res *xdsapi.DiscoveryResponse, names []string) error {
+	dump := newConfigDump()
+	if err := dump.add(res); err != nil {
+		return err
+	}
+	requested := map[string]bool{}
+	for _, name := range names {
+		requested[name] = true
+	}
+	var got []string
+	for name := range dump.routes {
+		got = append(got, name)
+	}
+	for name := range dump.endpoints {
+		got = append(got, name)
+	}
+	for _, name := range got {
+		if !requested[name] {
+			return fmt.Errorf("%s response has %q which was not requested", configTypeShortName(res.TypeUrl), name)
+		}
+	}
+	return nil
+}
+
+func runNamed(s *conformanceSuite) (string, error) {
+	routeNames, edsNames, err := s.fetchNames()
+	if err != nil {
+		return "", err
+	}
+	var details []string
+	for _, sub := range []struct {
+		typeURL string
+		names   []string
+	}{{v2.RouteType, routeNames}, {v2.EndpointType, edsNames}} {
+		if len(sub.names) == 0 {
+			details = append(details, fmt.Sprintf("no %s names to request", configTypeShortName(sub.typeURL)))
+			continue
+		}
+		stream, res, err := s.subscribe(sub.typeURL, sub.names[:1])
+		if err != nil {
+			return "", err
+		}
+		stream.close()
+		if err := checkNames(res, sub.names[:1]); err != nil {
+			return "", err
+		}
+		details = append(details, fmt.Sprintf("%s %s", configTypeShortName(sub.typeURL), sub.names[0]))
+	}
+	return strings.Join(details, ", "), nil
+}
+
+func runSubscriptionChange(s *conformanceSuite) (string, error) {
+	_, edsNames, err := s.fetchNames()
+	if err != nil {
+		return "", err
+	}
+	if len(edsNames) < 2 {
+		return "", fmt.Errorf("need at least 2 EDS clusters, found %d", len(edsNames))
+	}
+	stream, res, err := s.subscribe(v2.EndpointType, edsNames[:1])
+	if err != nil {
+		return "", err
+	}
+	defer stream.close()
+	if err := stream.ack(res, edsNames[:1]); err != nil {
+		return "", err
+	}
+	if err := stream.request(v2.EndpointType, edsNames[1:2], res.VersionInfo, res.Nonce, ""); err != nil {
+		return "", err
+	}
+	next, err := stream.recv(s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("after changing resource names: %v", err)
+	}
+	if err := checkNames(next, edsNames[1:2]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("changed from %s to %s", edsNames[0], edsNames[1]), nil
+}
+
+// runReconnect opens a new stream with the version ACKed on a previous one, as Envoy does when its
+// stream breaks. The server cannot tell whether the proxy kept its config, so it must send it again.
+func runReconnect(s *conformanceSuite) (string, error) {
+	stream, res, err := s.subscribe(v2.ClusterType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := stream.ack(res, nil); err != nil {
+		stream.close()
+		return "", err
+	}
+	stream.close()
+
+	stream, err = newADSStream(s.ctx, s.pilotURL, s.node)
+	if err != nil {
+		return "", err
+	}
+	defer stream.close()
+	if err := stream.request(v2.ClusterType, nil, res.VersionInfo, "", ""); err != nil {
+		return "", err
+	}
+	next, err := stream.recv(s.timeout)
+	switch {
+	case err == xdsclient.ErrNoResponse:
+		return "", fmt.Errorf("no response on the new stream to previous version %s", res.VersionInfo)
+	case err != nil:
+		return "", fmt.Errorf("stream failed after reconnect: %v", err)
+	case next.Nonce == "":
+		return "", fmt.Errorf("response on the new stream without nonce")
+	case next.VersionInfo == res.VersionInfo && len(next.Resources) != len(res.Resources):
+		return "", fmt.Errorf("version %s has %d resources on the new stream, %d before",
+			res.VersionInfo, len(next.Resources), len(res.Resources))
+	}
+	return fmt.Sprintf("responded with version %s to previous version %s", next.VersionInfo, res.VersionInfo), nil
+}
+
+func outputScenarioResults(results []*scenarioResult) string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "SCENARIO\tRESULT\tDETAIL")
+	for _, r := range results {
+		result := "PASS"
+		if !r.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, result, r.Detail)
+	}
+	w.Flush()
+	return buf.String()
+}
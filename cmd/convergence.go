@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/spf13/cobra"
+
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+)
+
+func convergence() *cobra.Command {
+	var namespace, selector, configType string
+	var duration time.Duration
+	localCmd := &cobra.Command{
+		Use:   "convergence",
+		Short: "Measure how long pushes take to reach every proxy",
+		Long: "Watch LDS or CDS for every sidecar in the namespace (or matching the selector). When a new version " +
+			"shows up on any stream, record how long each other proxy takes to receive it. Report per pod lag and a histogram.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if configType != "lds" && configType != "cds" {
+				fatalf("Unsupported type %q, use lds or cds", configType)
+			}
+			pods, err := proxy.SidecarPods(resolveKubeConfigPath(kubeConfig), namespace, selector)
+			if err != nil {
+				fatalf("Cannot get pods: %v", err)
+			}
+			if len(pods) == 0 {
+				fatalf("No sidecar pods found")
+			}
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
+			defer func() {
+				pilotClient.close()
+			}()
+			pilotClient.streaming = true
+
+			tracker := newConvergenceTracker(pods)
+			for _, pod := range pods {
+				handler := &convergenceHandler{configType: configType, pod: pod, tracker: tracker}
+				go pilotClient.send(ctx, handler.makeRequest(pod), handler)
+			}
+			log.Infof("Watching %s for %d pods for %v", configType, len(pods), duration)
+			select {
+			case <-time.After(duration):
+			case <-ctx.Done():
+			}
+			fmt.Println(tracker.outputShort())
+		},
+	}
+	localCmd.Flags().StringVarP(&namespace, "namespace", "", "", "Namespace of the pods. Leave blank for all namespaces")
+	localCmd.Flags().StringVarP(&selector, "selector", "l", "", "Label selector of the pods")
+	localCmd.Flags().StringVarP(&configType, "type", "", "cds", "Type to watch: lds or cds")
+	localCmd.Flags().DurationVarP(&duration, "duration", "", 5*time.Minute, "How long to watch")
+	return localCmd
+}
+
+type convergenceHandler struct {
+	configType string
+	pod        *proxy.Pod
+	tracker    *convergenceTracker
+}
+
+func (c *convergenceHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	return newRequest(pod, c.configType)
+}
+
+func (c *convergenceHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
+	c.tracker.record(c.pod.Name, resp.VersionInfo, time.Now())
+	return nil
+}
+
+// rollout tracks which proxies received a version, and when.
+type rollout struct {
+	version  string
+	first    time.Time
+	received map[string]time.Time
+}
+
+// convergenceTracker records the lag of every proxy behind the first one to receive each version.
+type convergenceTracker struct {
+	mu   sync.Mutex
+	pods int
+	// Version of the first response of each stream, the config at connection time.
+	initial  map[string]string
+	rollouts map[string]*rollout
+	order    []*rollout
+	lags     map[string][]time.Duration
+}
+
+func newConvergenceTracker(pods []*proxy.Pod) *convergenceTracker {
+	return &convergenceTracker{
+		pods:     len(pods),
+		initial:  map[string]string{},
+		rollouts: map[string]*rollout{},
+		lags:     map[string][]time.Duration{},
+	}
+}
+
+func (t *convergenceTracker) record(pod, version string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	initial, connected := t.initial[pod]
+	if !connected {
+		t.initial[pod] = version
+	}
+	r, ok := t.rollouts[version]
+	if !ok {
+		// The first response on each stream is the config at connection time, not a push, unless
+		// the push was already seen on another stream.
+		if !connected || version == initial {
+			return
+		}
+		r = &rollout{version: version, first: now, received: map[string]time.Time{}}
+		t.rollouts[version] = r
+		t.order = append(t.order, r)
+		// Proxies connected with this version already have it, without a lag to measure.
+		for p, v := range t.initial {
+			if v == version {
+				r.received[p] = now
+			}
+		}
+	}
+	if _, ok := r.received[pod]; ok {
+		return
+	}
+	r.received[pod] = now
+	t.lags[pod] = append(t.lags[pod], now.Sub(r.first))
+	if len(r.received) == t.pods {
+		log.Infof("Version %s reached all %d pods in %v", version, t.pods, now.Sub(r.first))
+	}
+}
+
+// convergence returns how long the version took to reach all proxies, or false if some never got it.
+func (r *rollout) convergence(pods int) (time.Duration, bool) {
+	if len(r.received) != pods {
+		return 0, false
+	}
+	var last time.Time
+	for _, t := range r.received {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last.Sub(r.first), true
+}
+
+var histogramBuckets = []time.Duration{
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+// outputHistogram writes the number of durations per bucket with a bar scaled to the largest bucket.
+func outputHistogram(w *tabwriter.Writer, durations []time.Duration) {
+	counts := make([]int, len(histogramBuckets)+1)
+	for _, d := range durations {
+		i := sort.Search(len(histogramBuckets), func(i int) bool { return d < histogramBuckets[i] })
+		counts[i]++
+	}
+	max := 0
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+	for i, c := range counts {
+		label := fmt.Sprintf(">= %v", histogramBuckets[len(histogramBuckets)-1])
+		if i < len(histogramBuckets) {
+			label = fmt.Sprintf("< %v", histogramBuckets[i])
+		}
+		bar := ""
+		if max > 0 {
+			bar = strings.Repeat("#", c*40/max)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", label, c, bar)
+	}
+}
+
+func (t *convergenceTracker) outputShort() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tPODS\tCONVERGED IN")
+	for _, r := range t.order {
+		converged := "-"
+		if d, ok := r.convergence(t.pods); ok {
+			converged = d.String()
+		}
+		fmt.Fprintf(w, "%s\t%d/%d\t%s\n", r.version, len(r.received), t.pods, converged)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "POD\tUPDATES\tP50 LAG\tMAX LAG")
+	var all []time.Duration
+	pods := make([]string, 0, len(t.initial))
+	for pod := range t.initial {
+		pods = append(pods, pod)
+	}
+	sort.Strings(pods)
+	for _, pod := range pods {
+		lags := append([]time.Duration(nil), t.lags[pod]...)
+		sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+		all = append(all, lags...)
+		fmt.Fprintf(w, "%s\t%d\t%v\t%v\n", pod, len(lags), percentile(lags, 50), percentile(lags, 100))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "LAG\tCOUNT\t")
+	outputHistogram(w, all)
+	w.Flush()
+	return buf.String()
+}
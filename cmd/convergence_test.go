@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"xdscli/pkg/proxy"
+)
+
+func TestConvergenceTrackerRecord(t *testing.T) {
+	start := time.Date(2020, 2, 18, 12, 0, 0, 0, time.UTC)
+	type response struct {
+		pod     string
+		version string
+		after   time.Duration
+	}
+	cases := []struct {
+		name      string
+		responses []response
+		// Pods having received v2, and the lags of each pod.
+		wantReceived []string
+		wantLags     map[string][]time.Duration
+	}{
+		{
+			name: "push after connection",
+			responses: []response{
+				{"a", "v1", 0}, {"b", "v1", 0},
+				{"a", "v2", time.Second}, {"b", "v2", 3 * time.Second},
+			},
+			wantReceived: []string{"a", "b"},
+			wantLags:     map[string][]time.Duration{"a": {0}, "b": {2 * time.Second}},
+		},
+		{
+			name: "connected after the push started",
+			responses: []response{
+				{"a", "v1", 0},
+				{"a", "v2", time.Second}, {"b", "v2", 2 * time.Second},
+			},
+			wantReceived: []string{"a", "b"},
+			wantLags:     map[string][]time.Duration{"a": {0}, "b": {time.Second}},
+		},
+		{
+			name: "connected with the version before the push was seen",
+			responses: []response{
+				{"a", "v1", 0}, {"b", "v2", 0},
+				{"a", "v2", time.Second},
+			},
+			wantReceived: []string{"a", "b"},
+			wantLags:     map[string][]time.Duration{"a": {0}},
+		},
+		{
+			name: "not received",
+			responses: []response{
+				{"a", "v1", 0}, {"b", "v1", 0},
+				{"a", "v2", time.Second},
+			},
+			wantReceived: []string{"a"},
+			wantLags:     map[string][]time.Duration{"a": {0}},
+		},
+		{
+			name: "resent version is not a push",
+			responses: []response{
+				{"a", "v2", 0}, {"b", "v2", 0},
+				{"a", "v2", time.Second},
+			},
+			wantLags: map[string][]time.Duration{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tracker := newConvergenceTracker([]*proxy.Pod{{Name: "a"}, {Name: "b"}})
+			for _, r := range c.responses {
+				tracker.record(r.pod, r.version, start.Add(r.after))
+			}
+			var received []string
+			if r, ok := tracker.rollouts["v2"]; ok {
+				for _, pod := range []string{"a", "b"} {
+					if _, ok := r.received[pod]; ok {
+						received = append(received, pod)
+					}
+				}
+			}
+			if !reflect.DeepEqual(received, c.wantReceived) {
+				t.Errorf("v2 received by %v, want %v", received, c.wantReceived)
+			}
+			if !reflect.DeepEqual(tracker.lags, c.wantLags) {
+				t.Errorf("lags = %v, want %v", tracker.lags, c.wantLags)
+			}
+		})
+	}
+}
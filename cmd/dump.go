@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+
+	"xdscli/pkg/proxy"
+)
+
+// configDump holds decoded LDS/CDS/RDS/EDS resources, indexed by resource name.
+type configDump struct {
+	listeners map[string]*xdsapi.Listener
+	clusters  map[string]*xdsapi.Cluster
+	routes    map[string]*xdsapi.RouteConfiguration
+	endpoints map[string]*xdsapi.ClusterLoadAssignment
+}
+
+func newConfigDump() *configDump {
+	return &configDump{
+		listeners: map[string]*xdsapi.Listener{},
+		clusters:  map[string]*xdsapi.Cluster{},
+		routes:    map[string]*xdsapi.RouteConfiguration{},
+		endpoints: map[string]*xdsapi.ClusterLoadAssignment{},
+	}
+}
+
+// add decodes all resources in the response and merges them into the dump. Resources with the same
+// name as an existing one replace it. The type of the resources is taken from the response, or from
+// the resources themselves for output saved without it.
+func (d *configDump) add(resp *xdsapi.DiscoveryResponse) error {
+	for _, res := range resp.Resources {
+		typeURL := resp.TypeUrl
+		if typeURL == "" {
+			typeURL = res.TypeUrl
+		}
+		switch typeURL {
+		case v2.ListenerType:
+			l := &xdsapi.Listener{}
+			if err := ptypes.UnmarshalAny(res, l); err != nil {
+				return fmt.Errorf("cannot unmarshal any proto to listener: %v", err)
+			}
+			d.listeners[l.Name] = l
+		case v2.ClusterType:
+			c := &xdsapi.Cluster{}
+			if err := ptypes.UnmarshalAny(res, c); err != nil {
+				return fmt.Errorf("cannot unmarshal any proto to cluster: %v", err)
+			}
+			d.clusters[c.Name] = c
+		case v2.RouteType:
+			r := &xdsapi.RouteConfiguration{}
+			if err := ptypes.UnmarshalAny(res, r); err != nil {
+				return fmt.Errorf("cannot unmarshal any proto to route configuration: %v", err)
+			}
+			d.routes[r.Name] = r
+		case v2.EndpointType:
+			e := &xdsapi.ClusterLoadAssignment{}
+			if err := ptypes.UnmarshalAny(res, e); err != nil {
+				return fmt.Errorf("cannot unmarshal any proto to cluster load assignment: %v", err)
+			}
+			d.endpoints[e.ClusterName] = e
+		default:
+			return fmt.Errorf("unsupported type %s", typeURL)
+		}
+	}
+	return nil
+}
+
+// fetchConfigDump fetches all listeners and clusters of the proxy, then the routes and endpoints
+// they refer to.
+func fetchConfigDump(ctx context.Context, c *PilotClient, pod *proxy.Pod) (*configDump, error) {
+	d := newConfigDump()
+	for _, configType := range []string{"cds", "lds"} {
+		resp, err := c.fetch(ctx, newRequest(pod, configType))
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch %s: %v", configType, err)
+		}
+		if err := d.add(resp); err != nil {
+			return nil, err
+		}
+	}
+	if names := d.routeNames(); len(names) != 0 {
+		resp, err := c.fetch(ctx, newRequest(pod, "rds", names...))
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch rds: %v", err)
+		}
+		if err := d.add(resp); err != nil {
+			return nil, err
+		}
+	}
+	if names := d.edsClusterNames(); len(names) != 0 {
+		resp, err := c.fetch(ctx, newRequest(pod, "eds", names...))
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch eds: %v", err)
+		}
+		if err := d.add(resp); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// routeNames returns the RDS names referenced by all listeners, without duplicates.
+func (d *configDump) routeNames() []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, l := range d.listeners {
+		for _, name := range retrieveRouteNames(l) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// edsClusterNames returns the EDS service names of all EDS clusters.
+func (d *configDump) edsClusterNames() []string {
+	var names []string
+	for _, c := range d.clusters {
+		if c.GetType() == xdsapi.Cluster_EDS {
+			names = append(names, retrieveEDSServiceName(c))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadConfigDump reads JSON discovery responses, as written by the lds/cds/rds/eds commands with
+// the json output format, from the given files. A file may hold several responses back to back
+// (e.g. recorded with --watch); later responses override earlier ones.
+func loadConfigDump(paths []string) (*configDump, error) {
+	d := newConfigDump()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(f)
+		for {
+			resp := &xdsapi.DiscoveryResponse{}
+			err = jsonpb.UnmarshalNext(dec, resp)
+			if err == io.EOF {
+				err = nil
+				break
+			} else if err != nil {
+				err = fmt.Errorf("cannot parse %q: %v", path, err)
+				break
+			}
+			if err = d.add(resp); err != nil {
+				err = fmt.Errorf("cannot load %q: %v", path, err)
+				break
+			}
+		}
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/ptypes"
+	any "github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+)
+
+func newClusterResponse(t *testing.T, typeURL, version string, names ...string) *xdsapi.DiscoveryResponse {
+	t.Helper()
+	resp := &xdsapi.DiscoveryResponse{VersionInfo: version, TypeUrl: typeURL}
+	for _, name := range names {
+		res, err := ptypes.MarshalAny(&xdsapi.Cluster{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Resources = append(resp.Resources, res)
+	}
+	return resp
+}
+
+func TestLoadConfigDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdscli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, responses ...*xdsapi.DiscoveryResponse) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		for _, resp := range responses {
+			if err := writeResponseJSON(w, resp); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = w.WriteString("\n")
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	watched := write("watched.json",
+		newClusterResponse(t, v2.ClusterType, "1", "a", "b"),
+		newClusterResponse(t, v2.ClusterType, "2", "c"))
+	// Filtered output of the cds command before it set the type.
+	filtered := write("filtered.json", newClusterResponse(t, "", "", "d"))
+
+	d, err := loadConfigDump([]string{watched, filtered})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if d.clusters[name] == nil {
+			t.Errorf("cluster %s not loaded", name)
+		}
+	}
+
+	value, err := ptypes.MarshalAny(&wrappers.StringValue{Value: "e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := write("unknown.json", &xdsapi.DiscoveryResponse{Resources: []*any.Any{value}})
+	if _, err := loadConfigDump([]string{unknown}); err == nil {
+		t.Errorf("loadConfigDump() returned no error for an unsupported type")
+	}
+}
+
+func TestWatchedOutputFileIsLoaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdscli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string, watch bool) {
+		outputFile, streaming, outputWritten = file, watch, false
+	}(outputFile, streaming)
+	outputFile, streaming, outputWritten = filepath.Join(dir, "watched.json"), true, false
+
+	// A stale file from an earlier run is replaced, then each response of the watch appended.
+	if err := ioutil.WriteFile(outputFile, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputResponseJSON(newClusterResponse(t, v2.ClusterType, "1", "a"))
+	outputResponseJSON(newClusterResponse(t, v2.ClusterType, "2", "b"))
+
+	d, err := loadConfigDump([]string{outputFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.clusters["a"] == nil || d.clusters["b"] == nil {
+		t.Errorf("loaded clusters %v, want a and b", d.clusters)
+	}
+}
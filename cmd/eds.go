@@ -1,26 +1,273 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/spf13/cobra"
+
+	"istio.io/istio/pilot/pkg/model"
+
+	"xdscli/pkg/proxy"
 )
 
 func eds() *cobra.Command {
 	handler := &edsHandler{}
 	localCmd := makeXDSCmd("eds", handler)
 	localCmd.Flags().StringArrayVarP(&handler.resources, "resources", "r", nil, "Resources to show")
+	localCmd.Flags().BoolVarP(&handler.verify, "verify", "", false,
+		"Compare the endpoints of outbound clusters, all of them if --resources is not set, with the Kubernetes "+
+			"EndpointSlices or Endpoints of their service and report missing, stale and not ready endpoints")
+	show := localCmd.Run
+	localCmd.Run = func(cmd *cobra.Command, args []string) {
+		if !handler.verify {
+			show(cmd, args)
+			return
+		}
+		handler.runVerify()
+	}
 	return localCmd
 }
 
 type edsHandler struct {
 	resources []string
+	verify    bool
 }
 
-func (c *edsHandler) makeRequest(pod *PodInfo) *xdsapi.DiscoveryRequest {
-	return pod.appendResources(pod.makeRequest("eds"), c.resources)
+func (c *edsHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	return newRequest(pod, "eds", c.resources...)
 }
 
 func (c *edsHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
-	outputJSON(resp)
+	outputResponseJSON(resp)
 	return nil
 }
+
+// runVerify fetches the endpoints of the clusters, as the proxy sees them, and checks them against
+// Kubernetes.
+func (c *edsHandler) runVerify() {
+	ctx, cancel := commandContext()
+	defer cancel()
+	pilotClient := newPilotClient(ctx)
+	defer func() {
+		pilotClient.close()
+	}()
+
+	pod := findProxy()
+	names := c.resources
+	if len(names) == 0 {
+		resp, err := pilotClient.fetch(ctx, newRequest(pod, "cds"))
+		if err != nil {
+			fatalf("Cannot fetch cds: %v", err)
+		}
+		d := newConfigDump()
+		if err := d.add(resp); err != nil {
+			fatalf("Cannot decode cds: %v", err)
+		}
+		for _, name := range d.edsClusterNames() {
+			if direction, subset, _, _ := model.ParseSubsetKey(name); direction == model.TrafficDirectionOutbound && subset == "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			fatalf("No outbound EDS cluster")
+		}
+	}
+	resp, err := pilotClient.fetch(ctx, newRequest(pod, "eds", names...))
+	if err != nil {
+		fatalf("Cannot fetch eds: %v", err)
+	}
+	checks, err := verifyEndpoints(resolveKubeConfigPath(kubeConfig), resp, names)
+	if err != nil {
+		fatalf("Cannot verify endpoints: %v", err)
+	}
+	if outputFormat == "json" {
+		output, err := json.MarshalIndent(checks, "", "  ")
+		if err != nil {
+			fatalf("Cannot convert to JSON: %v", err)
+		}
+		writeOutput(string(output))
+		return
+	}
+	fmt.Println(outputEndpointChecks(checks))
+}
+
+// endpointCheck is the result of comparing the endpoints of a cluster with Kubernetes.
+type endpointCheck struct {
+	Cluster string `json:"cluster"`
+	Service string `json:"service,omitempty"`
+	// EndpointSlice or Endpoints.
+	Source        string              `json:"source,omitempty"`
+	EDSEndpoints  int                 `json:"edsEndpoints"`
+	ReadyInKube   int                 `json:"readyInKube"`
+	Mismatches    []*endpointMismatch `json:"mismatches,omitempty"`
+	SkippedReason string              `json:"skippedReason,omitempty"`
+}
+
+type endpointMismatch struct {
+	Endpoint string `json:"endpoint"`
+	Pod      string `json:"pod,omitempty"`
+	// missing, stale or readiness.
+	Problem string `json:"problem"`
+	Detail  string `json:"detail"`
+}
+
+// edsEndpoint is an endpoint of a cluster load assignment and whether Envoy sends traffic to it.
+type edsEndpoint struct {
+	address string
+	healthy bool
+	status  core1.HealthStatus
+}
+
+func retrieveEDSEndpoints(la *xdsapi.ClusterLoadAssignment) map[string]*edsEndpoint {
+	ret := map[string]*edsEndpoint{}
+	for _, locality := range la.GetEndpoints() {
+		for _, lb := range locality.LbEndpoints {
+			socket := lb.GetEndpoint().GetAddress().GetSocketAddress()
+			if socket == nil {
+				continue
+			}
+			address := fmt.Sprintf("%s:%d", socket.Address, socket.GetPortValue())
+			ret[address] = &edsEndpoint{
+				address: address,
+				healthy: lb.HealthStatus == core1.HealthStatus_UNKNOWN || lb.HealthStatus == core1.HealthStatus_HEALTHY ||
+					lb.HealthStatus == core1.HealthStatus_DEGRADED,
+				status: lb.HealthStatus,
+			}
+		}
+	}
+	return ret
+}
+
+// kubeService returns the name and namespace of the Kubernetes service of a host name, or false if
+// it is not one, e.g. for a ServiceEntry.
+func kubeService(fqdn string) (string, string, bool) {
+	parts := strings.Split(fqdn, ".")
+	if len(parts) < 3 || parts[2] != "svc" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// verifyEndpoints compares the endpoints of each cluster of the EDS response with those of its
+// Kubernetes service. Ready endpoints missing from EDS and EDS endpoints unknown to Kubernetes show
+// the registry of pilot lagging behind, e.g. during node drains.
+func verifyEndpoints(kubeconfig string, resp *xdsapi.DiscoveryResponse, names []string) ([]*endpointCheck, error) {
+	assignments := map[string]*xdsapi.ClusterLoadAssignment{}
+	for _, res := range resp.Resources {
+		la := &xdsapi.ClusterLoadAssignment{}
+		if err := ptypes.UnmarshalAny(res, la); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal any proto to cluster load assignment: %v", err)
+		}
+		assignments[la.ClusterName] = la
+	}
+
+	checks := []*endpointCheck{}
+	for _, name := range names {
+		check := &endpointCheck{Cluster: name}
+		checks = append(checks, check)
+		eds := retrieveEDSEndpoints(assignments[name])
+		check.EDSEndpoints = len(eds)
+
+		direction, subset, fqdn, port := model.ParseSubsetKey(name)
+		if direction != model.TrafficDirectionOutbound || len(strings.Split(name, "|")) < 4 {
+			check.SkippedReason = "not an outbound cluster"
+			continue
+		}
+		if subset != "" {
+			check.SkippedReason = "subset clusters select endpoints by labels"
+			continue
+		}
+		service, namespace, ok := kubeService(string(fqdn))
+		if !ok {
+			check.SkippedReason = "not a Kubernetes service"
+			continue
+		}
+		check.Service = service + "." + namespace
+		kube, source, err := proxy.ServiceEndpoints(kubeconfig, namespace, service, uint32(port))
+		if err != nil {
+			check.SkippedReason = err.Error()
+			continue
+		}
+		check.Source = source
+		check.ReadyInKube, check.Mismatches = compareEndpoints(eds, kube, source)
+	}
+	return checks, nil
+}
+
+// compareEndpoints returns the number of ready Kubernetes endpoints and the mismatches between the
+// endpoints of EDS and those read from the source, sorted by address.
+func compareEndpoints(eds map[string]*edsEndpoint, kube []*proxy.Endpoint, source string) (int, []*endpointMismatch) {
+	var ready int
+	var mismatches []*endpointMismatch
+	seen := map[string]bool{}
+	for _, k := range kube {
+		address := fmt.Sprintf("%s:%d", k.IP, k.Port)
+		seen[address] = true
+		if k.Ready {
+			ready++
+		}
+		e, inEDS := eds[address]
+		switch {
+		case !inEDS && k.Ready:
+			mismatches = append(mismatches, &endpointMismatch{Endpoint: address, Pod: k.Pod,
+				Problem: "missing", Detail: fmt.Sprintf("ready in %s but not in EDS", source)})
+		case inEDS && e.healthy && !k.Ready:
+			mismatches = append(mismatches, &endpointMismatch{Endpoint: address, Pod: k.Pod,
+				Problem: "readiness", Detail: fmt.Sprintf("%s in EDS but not ready in %s", e.status, source)})
+		case inEDS && !e.healthy && k.Ready:
+			mismatches = append(mismatches, &endpointMismatch{Endpoint: address, Pod: k.Pod,
+				Problem: "readiness", Detail: fmt.Sprintf("%s in EDS but ready in %s", e.status, source)})
+		}
+	}
+	for address := range eds {
+		if !seen[address] {
+			mismatches = append(mismatches, &endpointMismatch{Endpoint: address,
+				Problem: "stale", Detail: fmt.Sprintf("in EDS but not in %s", source)})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Endpoint < mismatches[j].Endpoint
+	})
+	return ready, mismatches
+}
+
+func outputEndpointChecks(checks []*endpointCheck) string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tSERVICE\tSOURCE\tEDS\tREADY IN KUBE\tSTATUS")
+	var mismatches int
+	for _, c := range checks {
+		status := "OK"
+		switch {
+		case c.SkippedReason != "":
+			status = "skipped: " + c.SkippedReason
+		case len(c.Mismatches) != 0:
+			status = fmt.Sprintf("%d mismatch(es)", len(c.Mismatches))
+			mismatches += len(c.Mismatches)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", c.Cluster, orDash(c.Service), orDash(c.Source), c.EDSEndpoints, c.ReadyInKube, status)
+	}
+	w.Flush()
+	if mismatches == 0 {
+		return buf.String()
+	}
+
+	buf.WriteString("\n")
+	w = new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tENDPOINT\tPOD\tPROBLEM\tDETAIL")
+	for _, c := range checks {
+		for _, m := range c.Mismatches {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Cluster, m.Endpoint, orDash(m.Pod), m.Problem, m.Detail)
+		}
+	}
+	w.Flush()
+	return buf.String()
+}
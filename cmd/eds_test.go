@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"xdscli/pkg/proxy"
+)
+
+func TestCompareEndpoints(t *testing.T) {
+	healthy := func(address string) *edsEndpoint {
+		return &edsEndpoint{address: address, healthy: true, status: core1.HealthStatus_HEALTHY}
+	}
+	unhealthy := func(address string) *edsEndpoint {
+		return &edsEndpoint{address: address, status: core1.HealthStatus_UNHEALTHY}
+	}
+	cases := []struct {
+		name      string
+		eds       []*edsEndpoint
+		kube      []*proxy.Endpoint
+		wantReady int
+		want      []*endpointMismatch
+	}{
+		{
+			name:      "in sync",
+			eds:       []*edsEndpoint{healthy("10.0.0.1:8080"), unhealthy("10.0.0.2:8080")},
+			kube:      []*proxy.Endpoint{{IP: "10.0.0.1", Port: 8080, Pod: "a", Ready: true}, {IP: "10.0.0.2", Port: 8080, Pod: "b"}},
+			wantReady: 1,
+		},
+		{
+			name:      "missing",
+			eds:       []*edsEndpoint{healthy("10.0.0.1:8080")},
+			kube:      []*proxy.Endpoint{{IP: "10.0.0.1", Port: 8080, Pod: "a", Ready: true}, {IP: "10.0.0.2", Port: 8080, Pod: "b", Ready: true}},
+			wantReady: 2,
+			want: []*endpointMismatch{
+				{Endpoint: "10.0.0.2:8080", Pod: "b", Problem: "missing", Detail: "ready in EndpointSlice but not in EDS"},
+			},
+		},
+		{
+			name: "not ready and missing is not a mismatch",
+			kube: []*proxy.Endpoint{{IP: "10.0.0.1", Port: 8080, Pod: "a"}},
+		},
+		{
+			name:      "extra",
+			eds:       []*edsEndpoint{healthy("10.0.0.1:8080"), healthy("10.0.0.3:8080")},
+			kube:      []*proxy.Endpoint{{IP: "10.0.0.1", Port: 8080, Pod: "a", Ready: true}},
+			wantReady: 1,
+			want: []*endpointMismatch{
+				{Endpoint: "10.0.0.3:8080", Problem: "stale", Detail: "in EDS but not in EndpointSlice"},
+			},
+		},
+		{
+			name: "healthy in EDS but not ready",
+			eds:  []*edsEndpoint{healthy("10.0.0.1:8080")},
+			kube: []*proxy.Endpoint{{IP: "10.0.0.1", Port: 8080, Pod: "a"}},
+			want: []*endpointMismatch{
+				{Endpoint: "10.0.0.1:8080", Pod: "a", Problem: "readiness", Detail: "HEALTHY in EDS but not ready in EndpointSlice"},
+			},
+		},
+		{
+			name:      "unhealthy in EDS but ready",
+			eds:       []*edsEndpoint{unhealthy("10.0.0.1:8080")},
+			kube:      []*proxy.Endpoint{{IP: "10.0.0.1", Port: 8080, Pod: "a", Ready: true}},
+			wantReady: 1,
+			want: []*endpointMismatch{
+				{Endpoint: "10.0.0.1:8080", Pod: "a", Problem: "readiness", Detail: "UNHEALTHY in EDS but ready in EndpointSlice"},
+			},
+		},
+		{
+			name:      "sorted by endpoint",
+			eds:       []*edsEndpoint{healthy("10.0.0.3:8080"), healthy("10.0.0.1:8080")},
+			kube:      []*proxy.Endpoint{{IP: "10.0.0.2", Port: 8080, Pod: "b", Ready: true}},
+			wantReady: 1,
+			want: []*endpointMismatch{
+				{Endpoint: "10.0.0.1:8080", Problem: "stale", Detail: "in EDS but not in EndpointSlice"},
+				{Endpoint: "10.0.0.2:8080", Pod: "b", Problem: "missing", Detail: "ready in EndpointSlice but not in EDS"},
+				{Endpoint: "10.0.0.3:8080", Problem: "stale", Detail: "in EDS but not in EndpointSlice"},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			eds := map[string]*edsEndpoint{}
+			for _, e := range c.eds {
+				eds[e.address] = e
+			}
+			ready, mismatches := compareEndpoints(eds, c.kube, "EndpointSlice")
+			if ready != c.wantReady {
+				t.Errorf("ready = %d, want %d", ready, c.wantReady)
+			}
+			if !reflect.DeepEqual(mismatches, c.want) {
+				for _, m := range mismatches {
+					t.Logf("got %+v", m)
+				}
+				t.Errorf("mismatches differ")
+			}
+		})
+	}
+}
+
+func TestRetrieveEDSEndpoints(t *testing.T) {
+	for status, want := range map[core1.HealthStatus]bool{
+		core1.HealthStatus_UNKNOWN:   true,
+		core1.HealthStatus_HEALTHY:   true,
+		core1.HealthStatus_DEGRADED:  true,
+		core1.HealthStatus_UNHEALTHY: false,
+		core1.HealthStatus_DRAINING:  false,
+	} {
+		eds := retrieveEDSEndpoints(newLoadAssignment("outbound|8080||a.default.svc.cluster.local", status))
+		e, ok := eds["10.0.0.1:8080"]
+		if !ok {
+			t.Fatalf("%v: endpoint not found in %v", status, eds)
+		}
+		if e.healthy != want {
+			t.Errorf("%v: healthy = %v, want %v", status, e.healthy, want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/spf13/cobra"
+
+	"xdscli/pkg/proxy"
+)
+
+func get() *cobra.Command {
+	handler := &getHandler{}
+	localCmd := makeXDSCmd("get", handler)
+	localCmd.Use = "get [names...]"
+	localCmd.Short = "Show resources of any type"
+	localCmd.Long = "Request the resources of any type URL, or of a registered type by its short name (" + xdsTypeNames() +
+		"), with the given names or all of them. Resources whose type is not known are shown raw, base64 encoded."
+	localCmd.PreRun = func(cmd *cobra.Command, args []string) {
+		if handler.typeURL == "" {
+			fatalf("--type-url is required")
+		}
+		handler.names = args
+	}
+	localCmd.Flags().StringVarP(&handler.typeURL, "type-url", "", "",
+		fmt.Sprintf("Type URL of the resources, or the short name of a registered type (%s)", xdsTypeNames()))
+	return localCmd
+}
+
+type getHandler struct {
+	typeURL string
+	names   []string
+}
+
+func (c *getHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	return newRequest(pod, c.typeURL, c.names...)
+}
+
+func (c *getHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
+	if outputFormat == "json" {
+		outputResponseJSON(resp)
+		return nil
+	}
+	if t := lookupXDSType(resp.TypeUrl); t != nil && t.outputShort != nil {
+		fmt.Println(t.outputShort(resp))
+		return nil
+	}
+	fmt.Println(outputResourceNames(resp))
+	return nil
+}
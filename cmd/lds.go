@@ -2,21 +2,29 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 
+	udpa "github.com/cncf/udpa/go/udpa/type/v1"
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/conversion"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	any "github.com/golang/protobuf/ptypes/any"
+	_struct "github.com/golang/protobuf/ptypes/struct"
 
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
 )
 
 func lds() *cobra.Command {
@@ -28,7 +36,10 @@ func lds() *cobra.Command {
 	localCmd.Flags().Uint32VarP(&handler.matchPort, "port", "p", 0, "Filter listeners by Port field")
 	localCmd.Flags().StringVarP(&handler.matchChainAddress, "chain-address", "", "", "Filter listeners filter-chain by address field")
 	localCmd.Flags().Uint32VarP(&handler.matchChainPort, "chain-port", "", 0, "Filter listeners by destination port field")
+	localCmd.Flags().StringVarP(&handler.matchSource, "source", "", "", "Filter listeners by substring of the Istio config that generated them")
 	localCmd.Flags().BoolVarP(&handler.showAll, "all", "", false, "Show all")
+	localCmd.Flags().BoolVarP(&handler.showFilters, "filters", "", false,
+		"Show the ordered network filters of each filter chain and the HTTP filters of HTTP connection managers")
 	return localCmd
 }
 
@@ -39,11 +50,13 @@ type ldsHandler struct {
 	matchType         string
 	matchChainAddress string
 	matchChainPort    uint32
+	matchSource       string
 	showAll           bool
+	showFilters       bool
 }
 
-func (c *ldsHandler) makeRequest(pod *PodInfo) *xdsapi.DiscoveryRequest {
-	return pod.makeRequest("lds")
+func (c *ldsHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	return newRequest(pod, "lds")
 }
 
 func retrieveListenerAddress(l *xdsapi.Listener) string {
@@ -90,6 +103,38 @@ func retrieveListenerType(l *xdsapi.Listener) string {
 	return "UNKNOWN"
 }
 
+// retrieveFilterConfig decodes the config of a network filter, either typed or struct, into out.
+func retrieveFilterConfig(filter *listener.Filter, out proto.Message) error {
+	switch c := filter.GetConfigType().(type) {
+	case *listener.Filter_TypedConfig:
+		return ptypes.UnmarshalAny(c.TypedConfig, out)
+	case *listener.Filter_Config:
+		return conversion.StructToMessage(c.Config, out)
+	}
+	return fmt.Errorf("filter %s has no config", filter.Name)
+}
+
+// retrieveRouteNames returns the names of the RDS route configurations used by the listener.
+func retrieveRouteNames(l *xdsapi.Listener) []string {
+	var names []string
+	for _, filterChain := range l.GetFilterChains() {
+		for _, filter := range filterChain.GetFilters() {
+			if filter.Name != HTTPListener {
+				continue
+			}
+			manager := &hcm.HttpConnectionManager{}
+			if err := retrieveFilterConfig(filter, manager); err != nil {
+				log.Errorf("Cannot decode %s config of listener %s: %v", filter.Name, l.Name, err)
+				continue
+			}
+			if rds := manager.GetRds(); rds != nil {
+				names = append(names, rds.RouteConfigName)
+			}
+		}
+	}
+	return names
+}
+
 func (c *ldsHandler) filter(l *xdsapi.Listener) *xdsapi.Listener {
 	if !c.matchFilter(l) {
 		return nil
@@ -120,9 +165,21 @@ func (c *ldsHandler) matchFilter(l *xdsapi.Listener) bool {
 	if c.matchPort != 0 && c.matchPort != retrieveListenerPort(l) {
 		return false
 	}
+	if !matchSource(c.matchSource, retrieveListenerSources(l)) {
+		return false
+	}
 	return true
 }
 
+// retrieveListenerSources returns the Istio config that generated the listener and its filter chains.
+func retrieveListenerSources(l *xdsapi.Listener) []string {
+	sources := []string{retrieveIstioSource(l.Metadata)}
+	for _, chain := range l.FilterChains {
+		sources = append(sources, retrieveIstioSource(chain.Metadata))
+	}
+	return sources
+}
+
 func retrieveFilterChainPort(chain *listener.FilterChain) uint32 {
 	if chain.FilterChainMatch == nil || chain.FilterChainMatch.DestinationPort == nil {
 		return 0
@@ -156,6 +213,7 @@ func (c *ldsHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
 	}
 	filterResp := &xdsapi.DiscoveryResponse{
 		Resources: []*any.Any{},
+		TypeUrl:   resp.TypeUrl,
 	}
 	for _, res := range resp.Resources {
 		listener := &xdsapi.Listener{}
@@ -178,24 +236,39 @@ func (c *ldsHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
 	return fmt.Errorf("Cannot find listener matching conditions. Seen listeners:\n%s", c.outputShort(resp))
 }
 
+// retrieveTransportProtocol returns TCP for plaintext filter chains, TLS or MTLS for TLS ones, and UNKNOWN
+// when the transport socket cannot be decoded.
 func retrieveTransportProtocol(ch *listener.FilterChain) string {
-	if ch.TransportSocket == nil {
+	tlsContext := retrieveDownstreamTLSContext(ch)
+	switch {
+	case tlsContext == nil && isPlaintextSocket(ch.GetTransportSocket()):
 		return "TCP"
-	}
-	tlsContext := &auth.DownstreamTlsContext{}
-	if err := ptypes.UnmarshalAny(ch.TransportSocket.GetTypedConfig(), tlsContext); err != nil {
-		log.Errorf("Cannot unmarshal any proto to TLSContext: %v", err)
+	case tlsContext == nil:
 		return "UNKNOWN"
-	}
-	if tlsContext.RequireClientCertificate.Value {
+	case tlsContext.GetRequireClientCertificate().GetValue():
 		return "MTLS"
 	}
 	return "TLS"
 }
 
+// isPlaintextSocket returns true if the transport socket is not set or is a raw buffer.
+func isPlaintextSocket(socket *core1.TransportSocket) bool {
+	if socket == nil {
+		return true
+	}
+	if typed := socket.GetTypedConfig(); typed != nil {
+		return typed.TypeUrl == "type.googleapis.com/envoy.config.transport_socket.raw_buffer.v2.RawBuffer"
+	}
+	return socket.Name == "raw_buffer" || socket.Name == "envoy.transport_sockets.raw_buffer"
+}
+
 func (c *ldsHandler) output(resp *xdsapi.DiscoveryResponse) {
+	if c.showFilters {
+		c.outputFilters(resp)
+		return
+	}
 	if outputFormat == "json" {
-		outputJSON(resp)
+		outputResponseJSON(resp)
 		return
 	}
 
@@ -213,7 +286,7 @@ func retrieveAllTransportProtocol(vs []*listener.FilterChain) []string {
 func (c *ldsHandler) outputShort(resp *xdsapi.DiscoveryResponse) string {
 	var buf bytes.Buffer
 	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
-	fmt.Fprintln(w, "NAME\tADDRESS\tPORT\tTYPE\tPROTOCOL")
+	fmt.Fprintln(w, "NAME\tADDRESS\tPORT\tTYPE\tPROTOCOL\tSOURCE")
 	for _, res := range resp.Resources {
 		listener := &xdsapi.Listener{}
 		if err := ptypes.UnmarshalAny(res, listener); err != nil {
@@ -223,8 +296,115 @@ func (c *ldsHandler) outputShort(resp *xdsapi.DiscoveryResponse) string {
 		address := retrieveListenerAddress(listener)
 		port := retrieveListenerPort(listener)
 		listenerType := retrieveListenerType(listener)
-		fmt.Fprintf(w, "%s\t%s\t%v\t%v\t%s\n", listener.Name, address, port, listenerType, retrieveAllTransportProtocol(listener.FilterChains))
+		fmt.Fprintf(w, "%s\t%s\t%v\t%v\t%s\t%s\n", listener.Name, address, port, listenerType,
+			retrieveAllTransportProtocol(listener.FilterChains), formatSources(retrieveListenerSources(listener)))
 	}
 	w.Flush()
 	return buf.String()
 }
+
+// filterInfo is a network or HTTP filter, with the HTTP filters of an HTTP connection manager.
+type filterInfo struct {
+	Name        string        `json:"name"`
+	TypeURL     string        `json:"typeUrl,omitempty"`
+	HTTPFilters []*filterInfo `json:"httpFilters,omitempty"`
+}
+
+type filterChainFilters struct {
+	FilterChain string        `json:"filterChain"`
+	Port        uint32        `json:"port,omitempty"`
+	Filters     []*filterInfo `json:"filters"`
+}
+
+type listenerFilters struct {
+	Listener     string                `json:"listener"`
+	FilterChains []*filterChainFilters `json:"filterChains"`
+}
+
+// retrieveConfigTypeURL returns the type URL of a typed filter config, the type URL it holds for a
+// TypedStruct, e.g. of a Wasm filter, or "struct" for a deprecated untyped config.
+func retrieveConfigTypeURL(typed *any.Any, config *_struct.Struct) string {
+	if typed == nil {
+		if config != nil {
+			return "struct"
+		}
+		return ""
+	}
+	ts := &udpa.TypedStruct{}
+	if ptypes.Is(typed, ts) {
+		if err := ptypes.UnmarshalAny(typed, ts); err == nil {
+			return ts.TypeUrl
+		}
+	}
+	return typed.TypeUrl
+}
+
+func retrieveListenerFilters(l *xdsapi.Listener) *listenerFilters {
+	ret := &listenerFilters{Listener: l.Name, FilterChains: []*filterChainFilters{}}
+	for i, chain := range l.FilterChains {
+		chainFilters := &filterChainFilters{
+			FilterChain: describeFilterChainProtocols(i, chain),
+			Port:        retrieveFilterChainPort(chain),
+			Filters:     []*filterInfo{},
+		}
+		for _, filter := range chain.Filters {
+			info := &filterInfo{Name: filter.Name, TypeURL: retrieveConfigTypeURL(filter.GetTypedConfig(), filter.GetConfig())}
+			if filter.Name == HTTPListener {
+				manager := &hcm.HttpConnectionManager{}
+				if err := retrieveFilterConfig(filter, manager); err != nil {
+					log.Errorf("Cannot decode %s config of listener %s: %v", filter.Name, l.Name, err)
+				}
+				for _, httpFilter := range manager.HttpFilters {
+					info.HTTPFilters = append(info.HTTPFilters, &filterInfo{
+						Name:    httpFilter.Name,
+						TypeURL: retrieveConfigTypeURL(httpFilter.GetTypedConfig(), httpFilter.GetConfig()),
+					})
+				}
+			}
+			chainFilters.Filters = append(chainFilters.Filters, info)
+		}
+		ret.FilterChains = append(ret.FilterChains, chainFilters)
+	}
+	return ret
+}
+
+func (c *ldsHandler) outputFilters(resp *xdsapi.DiscoveryResponse) {
+	listeners := []*listenerFilters{}
+	for _, res := range resp.Resources {
+		listener := &xdsapi.Listener{}
+		if err := ptypes.UnmarshalAny(res, listener); err != nil {
+			log.Errorf("Cannot unmarshal any proto to listener: %v", err)
+			continue
+		}
+		listeners = append(listeners, retrieveListenerFilters(listener))
+	}
+	if outputFormat == "json" {
+		output, err := json.MarshalIndent(listeners, "", "  ")
+		if err != nil {
+			log.Errorf("Cannot convert to JSON: %v", err)
+			return
+		}
+		writeOutput(string(output))
+		return
+	}
+
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "LISTENER\tCHAIN\tPORT\tLEVEL\t#\tFILTER\tTYPE URL")
+	for _, l := range listeners {
+		for _, chain := range l.FilterChains {
+			port := "-"
+			if chain.Port != 0 {
+				port = fmt.Sprint(chain.Port)
+			}
+			for i, filter := range chain.Filters {
+				fmt.Fprintf(w, "%s\t%s\t%s\tnetwork\t%d\t%s\t%s\n", l.Listener, chain.FilterChain, port, i, filter.Name, orDash(filter.TypeURL))
+				for j, httpFilter := range filter.HTTPFilters {
+					fmt.Fprintf(w, "%s\t%s\t%s\thttp\t%d.%d\t%s\t%s\n", l.Listener, chain.FilterChain, port, i, j, httpFilter.Name, orDash(httpFilter.TypeURL))
+				}
+			}
+		}
+	}
+	w.Flush()
+	fmt.Println(buf.String())
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"testing"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/golang/protobuf/ptypes"
+	any "github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func TestRetrieveTransportProtocol(t *testing.T) {
+	typedSocket := func(name string, msg *auth.DownstreamTlsContext) *core1.TransportSocket {
+		config, err := ptypes.MarshalAny(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &core1.TransportSocket{Name: name, ConfigType: &core1.TransportSocket_TypedConfig{TypedConfig: config}}
+	}
+	cases := []struct {
+		name   string
+		socket *core1.TransportSocket
+		want   string
+	}{
+		{"no transport socket", nil, "TCP"},
+		{"raw buffer", &core1.TransportSocket{Name: "envoy.transport_sockets.raw_buffer"}, "TCP"},
+		{"tls", typedSocket("envoy.transport_sockets.tls", &auth.DownstreamTlsContext{}), "TLS"},
+		{
+			"mtls",
+			typedSocket("envoy.transport_sockets.tls", &auth.DownstreamTlsContext{
+				RequireClientCertificate: &wrappers.BoolValue{Value: true},
+			}),
+			"MTLS",
+		},
+		{
+			"undecodable tls",
+			&core1.TransportSocket{
+				Name: "envoy.transport_sockets.tls",
+				ConfigType: &core1.TransportSocket_TypedConfig{TypedConfig: &any.Any{
+					TypeUrl: "type.googleapis.com/envoy.api.v2.auth.DownstreamTlsContext",
+					Value:   []byte{0xff},
+				}},
+			},
+			"UNKNOWN",
+		},
+		{
+			"unknown socket type",
+			&core1.TransportSocket{
+				Name:       "envoy.transport_sockets.alts",
+				ConfigType: &core1.TransportSocket_TypedConfig{TypedConfig: &any.Any{TypeUrl: "type.googleapis.com/envoy.config.transport_socket.alts.v2alpha.Alts"}},
+			},
+			"UNKNOWN",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := retrieveTransportProtocol(&listener.FilterChain{TransportSocket: c.socket}); got != c.want {
+				t.Errorf("retrieveTransportProtocol() = %s, want %s", got, c.want)
+			}
+		})
+	}
+}
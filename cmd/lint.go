@@ -0,0 +1,431 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/golang/protobuf/ptypes"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// lintRule is a check run over the config of a proxy.
+type lintRule struct {
+	id          string
+	severity    string
+	description string
+	check       func(d *configDump) []finding
+}
+
+// lintRules are all rules run by the analyze command. New rules only need to be added here.
+var lintRules = []lintRule{
+	{"resource-invalid", severityError, "Resource fails validation and would be rejected by Envoy", checkInvalidResources},
+	{"route-unknown-cluster", severityError, "Route or TCP proxy refers to a cluster that is not in CDS", checkUnknownClusters},
+	{"listener-unknown-route", severityError, "Listener refers to a route configuration that is not in RDS", checkUnknownRoutes},
+	{"cluster-no-endpoints", severityError, "EDS cluster has no endpoints", checkNoEndpoints},
+	{"cluster-no-healthy-endpoints", severityError, "EDS cluster has no healthy endpoints", checkNoHealthyEndpoints},
+	{"cluster-unused", severityInfo, "Cluster is not referenced by any listener or route", checkUnusedClusters},
+	{"filter-chain-overlap", severityError, "Filter chains of a listener have the same match", checkOverlappingFilterChains},
+	{"vhost-duplicate-domain", severityError, "Domain is used by more than one virtual host of a route configuration", checkDuplicateDomains},
+	{"route-shadowed", severityWarning, "Route can never match because an earlier route matches everything", checkShadowedRoutes},
+	{"tls-mode-mismatch", severityError,
+		"Outbound cluster TLS is incompatible with the proxy's own inbound TLS for the same service and port", checkTLSModeMismatch},
+	{"route-no-timeout", severityInfo, "Route timeout is disabled", checkRouteTimeouts},
+	{"cluster-no-connect-timeout", severityInfo, "Cluster has no connect timeout", checkConnectTimeouts},
+}
+
+// runLintRules runs the rules with the given IDs, or all rules if none is given.
+func runLintRules(d *configDump, ids []string) ([]finding, error) {
+	selected := map[string]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+	findings := []finding{}
+	for _, rule := range lintRules {
+		if len(ids) != 0 && !selected[rule.id] {
+			continue
+		}
+		delete(selected, rule.id)
+		for _, f := range rule.check(d) {
+			f.Rule = rule.id
+			f.Severity = rule.severity
+			findings = append(findings, f)
+		}
+	}
+	for id := range selected {
+		return nil, fmt.Errorf("unknown rule %q", id)
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Rule != findings[j].Rule {
+			return findings[i].Rule < findings[j].Rule
+		}
+		return findings[i].Resource < findings[j].Resource
+	})
+	return findings, nil
+}
+
+// routeConfigs returns the RDS route configurations and the ones inlined in listeners.
+func (d *configDump) routeConfigs() []*xdsapi.RouteConfiguration {
+	var ret []*xdsapi.RouteConfiguration
+	for _, rc := range d.routes {
+		ret = append(ret, rc)
+	}
+	for _, l := range d.listeners {
+		for _, chain := range l.FilterChains {
+			for _, filter := range chain.Filters {
+				if filter.Name != HTTPListener {
+					continue
+				}
+				manager := &hcm.HttpConnectionManager{}
+				if err := retrieveFilterConfig(filter, manager); err == nil && manager.GetRouteConfig() != nil {
+					ret = append(ret, manager.GetRouteConfig())
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// clusterReferences maps each cluster name used by a listener or route to its referrers.
+func (d *configDump) clusterReferences() map[string][]string {
+	refs := map[string][]string{}
+	for _, rc := range d.routeConfigs() {
+		for _, vh := range rc.GetVirtualHosts() {
+			for _, r := range vh.Routes {
+				action := r.GetRoute()
+				if action == nil {
+					continue
+				}
+				referrer := fmt.Sprintf("route %s/%s", rc.Name, vh.Name)
+				for _, c := range retrieveRouteClusters(action, nil) {
+					refs[c.name] = appendUnique(refs[c.name], referrer)
+				}
+				for _, m := range action.RequestMirrorPolicies {
+					refs[m.Cluster] = appendUnique(refs[m.Cluster], referrer)
+				}
+			}
+		}
+	}
+	for _, l := range d.listeners {
+		for _, chain := range l.FilterChains {
+			for _, filter := range chain.Filters {
+				if filter.Name != TCPListener {
+					continue
+				}
+				proxy := &tcp.TcpProxy{}
+				if err := retrieveFilterConfig(filter, proxy); err == nil {
+					for _, c := range retrieveTCPProxyClusters(proxy) {
+						refs[c.name] = appendUnique(refs[c.name], "listener "+l.Name)
+					}
+				}
+			}
+		}
+	}
+	return refs
+}
+
+func checkInvalidResources(d *configDump) []finding {
+	var findings []finding
+	add := func(name string, err error) {
+		if err != nil {
+			findings = append(findings, finding{Resource: name, Message: err.Error()})
+		}
+	}
+	for name, l := range d.listeners {
+		add(name, l.Validate())
+	}
+	for name, c := range d.clusters {
+		add(name, c.Validate())
+	}
+	for name, r := range d.routes {
+		add(name, r.Validate())
+	}
+	for name, e := range d.endpoints {
+		add(name, e.Validate())
+	}
+	return findings
+}
+
+func checkUnknownClusters(d *configDump) []finding {
+	var findings []finding
+	refs := d.clusterReferences()
+	for _, name := range sortedStrings(refs) {
+		if _, ok := d.clusters[name]; !ok {
+			findings = append(findings, finding{Resource: name,
+				Message: fmt.Sprintf("referenced by %v but not in CDS", refs[name])})
+		}
+	}
+	return findings
+}
+
+func checkUnknownRoutes(d *configDump) []finding {
+	var findings []finding
+	for _, l := range d.listeners {
+		for _, name := range retrieveRouteNames(l) {
+			if _, ok := d.routes[name]; !ok {
+				findings = append(findings, finding{Resource: l.Name,
+					Message: fmt.Sprintf("route configuration %q is not in RDS", name)})
+			}
+		}
+	}
+	return findings
+}
+
+func checkNoEndpoints(d *configDump) []finding {
+	var findings []finding
+	for _, c := range d.clusters {
+		if c.GetType() != xdsapi.Cluster_EDS {
+			continue
+		}
+		if total, _ := countEndpoints(d.endpoints[retrieveEDSServiceName(c)]); total == 0 {
+			findings = append(findings, finding{Resource: c.Name, Message: "EDS cluster has no endpoints"})
+		}
+	}
+	return findings
+}
+
+func checkNoHealthyEndpoints(d *configDump) []finding {
+	var findings []finding
+	for _, c := range d.clusters {
+		if c.GetType() != xdsapi.Cluster_EDS {
+			continue
+		}
+		if total, healthy := countEndpoints(d.endpoints[retrieveEDSServiceName(c)]); total != 0 && healthy == 0 {
+			findings = append(findings, finding{Resource: c.Name,
+				Message: fmt.Sprintf("none of the %d endpoints is healthy", total)})
+		}
+	}
+	return findings
+}
+
+func checkUnusedClusters(d *configDump) []finding {
+	var findings []finding
+	refs := d.clusterReferences()
+	for _, c := range d.clusters {
+		if _, ok := refs[c.Name]; !ok {
+			findings = append(findings, finding{Resource: c.Name, Message: "not referenced by any listener or route"})
+		}
+	}
+	return findings
+}
+
+// filterChainMatchKey returns a canonical form of the match, equal for matches Envoy considers the same.
+func filterChainMatchKey(m *listener.FilterChainMatch) string {
+	sorted := func(values []string) []string {
+		ret := append([]string(nil), values...)
+		sort.Strings(ret)
+		return ret
+	}
+	cidrs := func(ranges []*core1.CidrRange) []string {
+		var ret []string
+		for _, r := range ranges {
+			ret = append(ret, fmt.Sprintf("%s/%d", r.AddressPrefix, r.GetPrefixLen().GetValue()))
+		}
+		return sorted(ret)
+	}
+	ports := make([]string, 0, len(m.GetSourcePorts()))
+	for _, p := range m.GetSourcePorts() {
+		ports = append(ports, fmt.Sprint(p))
+	}
+	return fmt.Sprintf("port=%d ip=%v sni=%v transport=%s alpn=%v source_type=%v source_ip=%v source_port=%v",
+		m.GetDestinationPort().GetValue(), cidrs(m.GetPrefixRanges()), sorted(m.GetServerNames()), m.GetTransportProtocol(),
+		sorted(m.GetApplicationProtocols()), m.GetSourceType(), cidrs(m.GetSourcePrefixRanges()), sorted(ports))
+}
+
+func checkOverlappingFilterChains(d *configDump) []finding {
+	var findings []finding
+	for _, l := range d.listeners {
+		seen := map[string]int{}
+		for i, chain := range l.FilterChains {
+			key := filterChainMatchKey(chain.GetFilterChainMatch())
+			if j, ok := seen[key]; ok {
+				findings = append(findings, finding{Resource: l.Name,
+					Message: fmt.Sprintf("filter chains #%d and #%d have the same match {%s}", j, i, key)})
+				continue
+			}
+			seen[key] = i
+		}
+	}
+	return findings
+}
+
+func checkDuplicateDomains(d *configDump) []finding {
+	var findings []finding
+	for _, rc := range d.routeConfigs() {
+		seen := map[string]string{}
+		for _, vh := range rc.VirtualHosts {
+			for _, domain := range vh.Domains {
+				domain = strings.ToLower(domain)
+				if other, ok := seen[domain]; ok && other != vh.Name {
+					findings = append(findings, finding{Resource: rc.Name,
+						Message: fmt.Sprintf("domain %q is in virtual hosts %s and %s", domain, other, vh.Name)})
+					continue
+				}
+				seen[domain] = vh.Name
+			}
+		}
+	}
+	return findings
+}
+
+// isCatchAllRoute reports whether the route matches every request.
+func isCatchAllRoute(m *route.RouteMatch) bool {
+	if len(m.GetHeaders()) != 0 || len(m.GetQueryParameters()) != 0 || m.GetGrpc() != nil ||
+		m.GetRuntimeFraction() != nil || m.GetTlsContext() != nil {
+		return false
+	}
+	switch p := m.GetPathSpecifier().(type) {
+	case *route.RouteMatch_Prefix:
+		return p.Prefix == "" || p.Prefix == "/"
+	case *route.RouteMatch_Regex:
+		return p.Regex == ".*"
+	case *route.RouteMatch_SafeRegex:
+		return p.SafeRegex.GetRegex() == ".*"
+	}
+	return false
+}
+
+func checkShadowedRoutes(d *configDump) []finding {
+	var findings []finding
+	for _, rc := range d.routeConfigs() {
+		for _, vh := range rc.VirtualHosts {
+			for i, r := range vh.Routes {
+				if isCatchAllRoute(r.GetMatch()) && i != len(vh.Routes)-1 {
+					findings = append(findings, finding{Resource: fmt.Sprintf("%s/%s", rc.Name, vh.Name),
+						Message: fmt.Sprintf("%d route(s) after catch-all route %s are never used", len(vh.Routes)-i-1, describeRoute(i, r))})
+					break
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// inboundTLSModes returns the transport protocols of the inbound filter chains for the port.
+func (d *configDump) inboundTLSModes(port uint32) map[string]bool {
+	modes := map[string]bool{}
+	for _, l := range d.listeners {
+		if l.TrafficDirection != core1.TrafficDirection_INBOUND && !strings.EqualFold(l.Name, "virtualInbound") {
+			continue
+		}
+		for _, chain := range l.FilterChains {
+			chainPort := retrieveFilterChainPort(chain)
+			if chainPort == 0 {
+				chainPort = retrieveListenerPort(l)
+			}
+			if chainPort == port {
+				modes[retrieveTransportProtocol(chain)] = true
+			}
+		}
+	}
+	return modes
+}
+
+func checkTLSModeMismatch(d *configDump) []finding {
+	var findings []finding
+	for _, inbound := range d.clusters {
+		direction, _, fqdn, port := model.ParseSubsetKey(inbound.Name)
+		if direction != model.TrafficDirectionInbound || len(strings.Split(inbound.Name, "|")) < 4 {
+			continue
+		}
+		modes := d.inboundTLSModes(uint32(port))
+		strict := len(modes) != 0 && !modes["TCP"] && !modes["TLS"]
+		disabled := len(modes) != 0 && !modes["MTLS"] && !modes["TLS"]
+		for _, c := range d.clusters {
+			direction, _, outboundFqdn, outboundPort := model.ParseSubsetKey(c.Name)
+			if direction != model.TrafficDirectionOutbound || outboundFqdn != fqdn || outboundPort != port {
+				continue
+			}
+			client := retrieveClusterTransportProtocol(c)
+			if strict && client == "TCP" {
+				findings = append(findings, finding{Resource: c.Name,
+					Message: fmt.Sprintf("sends plaintext but inbound port %d only accepts mTLS (STRICT)", port)})
+			}
+			if disabled && client == "MTLS" {
+				findings = append(findings, finding{Resource: c.Name,
+					Message: fmt.Sprintf("sends mTLS but inbound port %d only accepts plaintext", port)})
+			}
+		}
+	}
+	return findings
+}
+
+// checkRouteTimeouts flags routes with a timeout of 0, which disables it. Routes without a timeout get
+// Envoy's 15s default.
+func checkRouteTimeouts(d *configDump) []finding {
+	var findings []finding
+	for _, rc := range d.routeConfigs() {
+		for _, vh := range rc.VirtualHosts {
+			for i, r := range vh.Routes {
+				action := r.GetRoute()
+				if action == nil {
+					continue
+				}
+				if action.Timeout == nil {
+					continue
+				}
+				if timeout, err := ptypes.Duration(action.Timeout); err == nil && timeout == 0 {
+					findings = append(findings, finding{Resource: fmt.Sprintf("%s/%s", rc.Name, vh.Name),
+						Message: fmt.Sprintf("route %s has its timeout disabled (0s)", describeRoute(i, r))})
+				}
+			}
+		}
+	}
+	return findings
+}
+
+func checkConnectTimeouts(d *configDump) []finding {
+	var findings []finding
+	for _, c := range d.clusters {
+		if c.ConnectTimeout == nil {
+			findings = append(findings, finding{Resource: c.Name, Message: "no connect timeout, Envoy uses 5s"})
+		}
+	}
+	return findings
+}
+
+// countEndpoints returns the number of endpoints and of those Envoy would send traffic to.
+func countEndpoints(la *xdsapi.ClusterLoadAssignment) (int, int) {
+	total, healthy := 0, 0
+	for _, locality := range la.GetEndpoints() {
+		for _, lb := range locality.LbEndpoints {
+			total++
+			switch lb.HealthStatus {
+			case core1.HealthStatus_UNKNOWN, core1.HealthStatus_HEALTHY, core1.HealthStatus_DEGRADED:
+				healthy++
+			}
+		}
+	}
+	return total, healthy
+}
+
+func appendUnique(values []string, v string) []string {
+	for _, existing := range values {
+		if existing == v {
+			return values
+		}
+	}
+	return append(values, v)
+}
+
+func sortedStrings(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
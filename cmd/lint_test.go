@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func mustMarshalAny(t *testing.T, m proto.Message) *listener.Filter_TypedConfig {
+	t.Helper()
+	config, err := ptypes.MarshalAny(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &listener.Filter_TypedConfig{TypedConfig: config}
+}
+
+// newRDSListener returns a listener with an HTTP connection manager using the RDS route configuration.
+func newRDSListener(t *testing.T, name, routeName string) *xdsapi.Listener {
+	manager := &hcm.HttpConnectionManager{RouteSpecifier: &hcm.HttpConnectionManager_Rds{Rds: &hcm.Rds{RouteConfigName: routeName}}}
+	return &xdsapi.Listener{
+		Name: name,
+		FilterChains: []*listener.FilterChain{{
+			Filters: []*listener.Filter{{Name: HTTPListener, ConfigType: mustMarshalAny(t, manager)}},
+		}},
+	}
+}
+
+// newTCPListener returns a listener with a TCP proxy to the cluster.
+func newTCPListener(t *testing.T, name, cluster string) *xdsapi.Listener {
+	proxy := &tcp.TcpProxy{StatPrefix: name, ClusterSpecifier: &tcp.TcpProxy_Cluster{Cluster: cluster}}
+	return &xdsapi.Listener{
+		Name: name,
+		FilterChains: []*listener.FilterChain{{
+			Filters: []*listener.Filter{{Name: TCPListener, ConfigType: mustMarshalAny(t, proxy)}},
+		}},
+	}
+}
+
+func newRouteConfig(name string, routes ...*route.Route) *xdsapi.RouteConfiguration {
+	return &xdsapi.RouteConfiguration{
+		Name:         name,
+		VirtualHosts: []*route.VirtualHost{{Name: "vh", Domains: []string{"*"}, Routes: routes}},
+	}
+}
+
+func newClusterRoute(prefix, cluster string) *route.Route {
+	return &route.Route{
+		Match: &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: prefix}},
+		Action: &route.Route_Route{Route: &route.RouteAction{
+			ClusterSpecifier: &route.RouteAction_Cluster{Cluster: cluster},
+			Timeout:          ptypes.DurationProto(time.Second),
+		}},
+	}
+}
+
+func newEDSCluster(name string) *xdsapi.Cluster {
+	return &xdsapi.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &xdsapi.Cluster_Type{Type: xdsapi.Cluster_EDS},
+		EdsClusterConfig: &xdsapi.Cluster_EdsClusterConfig{EdsConfig: &core1.ConfigSource{
+			ConfigSourceSpecifier: &core1.ConfigSource_Ads{Ads: &core1.AggregatedConfigSource{}},
+		}},
+		ConnectTimeout: ptypes.DurationProto(time.Second),
+	}
+}
+
+func newLoadAssignment(name string, statuses ...core1.HealthStatus) *xdsapi.ClusterLoadAssignment {
+	la := &xdsapi.ClusterLoadAssignment{ClusterName: name, Endpoints: []*endpoint.LocalityLbEndpoints{{}}}
+	for _, s := range statuses {
+		la.Endpoints[0].LbEndpoints = append(la.Endpoints[0].LbEndpoints, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{Address: &core1.Address{
+				Address: &core1.Address_SocketAddress{SocketAddress: &core1.SocketAddress{
+					Address: "10.0.0.1", PortSpecifier: &core1.SocketAddress_PortValue{PortValue: 8080},
+				}},
+			}}},
+			HealthStatus: s,
+		})
+	}
+	return la
+}
+
+// newInboundChain returns an inbound filter chain for the port, requiring client certificates if mtls.
+func newInboundChain(t *testing.T, port uint32, tls, mtls bool) *listener.FilterChain {
+	chain := &listener.FilterChain{FilterChainMatch: &listener.FilterChainMatch{DestinationPort: &wrappers.UInt32Value{Value: port}}}
+	if tls {
+		context, err := ptypes.MarshalAny(&auth.DownstreamTlsContext{RequireClientCertificate: &wrappers.BoolValue{Value: mtls}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.TransportSocket = &core1.TransportSocket{Name: "tls", ConfigType: &core1.TransportSocket_TypedConfig{TypedConfig: context}}
+	}
+	return chain
+}
+
+func newMTLSCluster(t *testing.T, name string) *xdsapi.Cluster {
+	c := newEDSCluster(name)
+	context, err := ptypes.MarshalAny(&auth.UpstreamTlsContext{CommonTlsContext: &auth.CommonTlsContext{
+		TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{Name: "default"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.TransportSocket = &core1.TransportSocket{Name: "tls", ConfigType: &core1.TransportSocket_TypedConfig{TypedConfig: context}}
+	return c
+}
+
+func TestLintRules(t *testing.T) {
+	const (
+		reviews = "outbound|9080||reviews.default.svc.cluster.local"
+		ratings = "outbound|9080||ratings.default.svc.cluster.local"
+	)
+	cases := []struct {
+		rule string
+		dump func(t *testing.T, d *configDump)
+		want []string
+	}{
+		{
+			rule: "resource-invalid",
+			dump: func(t *testing.T, d *configDump) {
+				d.clusters[reviews] = newEDSCluster(reviews)
+				d.clusters[""] = &xdsapi.Cluster{}
+			},
+			want: []string{""},
+		},
+		{
+			rule: "route-unknown-cluster",
+			dump: func(t *testing.T, d *configDump) {
+				d.routes["9080"] = newRouteConfig("9080", newClusterRoute("/", reviews))
+				d.listeners["tcp"] = newTCPListener(t, "tcp", ratings)
+				d.clusters[reviews] = newEDSCluster(reviews)
+			},
+			want: []string{ratings},
+		},
+		{
+			rule: "listener-unknown-route",
+			dump: func(t *testing.T, d *configDump) {
+				d.listeners["0.0.0.0_9080"] = newRDSListener(t, "0.0.0.0_9080", "9080")
+				d.listeners["0.0.0.0_8080"] = newRDSListener(t, "0.0.0.0_8080", "8080")
+				d.routes["9080"] = newRouteConfig("9080")
+			},
+			want: []string{"0.0.0.0_8080"},
+		},
+		{
+			rule: "cluster-no-endpoints",
+			dump: func(t *testing.T, d *configDump) {
+				d.clusters[reviews] = newEDSCluster(reviews)
+				d.clusters[ratings] = newEDSCluster(ratings)
+				d.endpoints[reviews] = newLoadAssignment(reviews, core1.HealthStatus_HEALTHY)
+				d.endpoints[ratings] = newLoadAssignment(ratings)
+			},
+			want: []string{ratings},
+		},
+		{
+			rule: "cluster-no-healthy-endpoints",
+			dump: func(t *testing.T, d *configDump) {
+				d.clusters[reviews] = newEDSCluster(reviews)
+				d.clusters[ratings] = newEDSCluster(ratings)
+				// Envoy sends traffic to endpoints of unknown health.
+				d.endpoints[reviews] = newLoadAssignment(reviews, core1.HealthStatus_UNKNOWN, core1.HealthStatus_UNHEALTHY)
+				d.endpoints[ratings] = newLoadAssignment(ratings, core1.HealthStatus_UNHEALTHY, core1.HealthStatus_DRAINING)
+			},
+			want: []string{ratings},
+		},
+		{
+			rule: "cluster-unused",
+			dump: func(t *testing.T, d *configDump) {
+				d.routes["9080"] = newRouteConfig("9080", newClusterRoute("/", reviews))
+				d.clusters[reviews] = newEDSCluster(reviews)
+				d.clusters[ratings] = newEDSCluster(ratings)
+			},
+			want: []string{ratings},
+		},
+		{
+			rule: "filter-chain-overlap",
+			dump: func(t *testing.T, d *configDump) {
+				d.listeners["virtualInbound"] = &xdsapi.Listener{Name: "virtualInbound", FilterChains: []*listener.FilterChain{
+					{FilterChainMatch: &listener.FilterChainMatch{ApplicationProtocols: []string{"h2c", "http/1.1"}}},
+					{FilterChainMatch: &listener.FilterChainMatch{ApplicationProtocols: []string{"http/1.1", "h2c"}}},
+				}}
+				d.listeners["virtualOutbound"] = &xdsapi.Listener{Name: "virtualOutbound", FilterChains: []*listener.FilterChain{
+					{FilterChainMatch: &listener.FilterChainMatch{TransportProtocol: "tls"}},
+					{FilterChainMatch: &listener.FilterChainMatch{TransportProtocol: "raw_buffer"}},
+				}}
+			},
+			want: []string{"virtualInbound"},
+		},
+		{
+			rule: "vhost-duplicate-domain",
+			dump: func(t *testing.T, d *configDump) {
+				d.routes["9080"] = &xdsapi.RouteConfiguration{Name: "9080", VirtualHosts: []*route.VirtualHost{
+					{Name: "reviews", Domains: []string{"reviews", "Reviews.default"}},
+					{Name: "reviews-copy", Domains: []string{"reviews.default"}},
+				}}
+			},
+			want: []string{"9080"},
+		},
+		{
+			rule: "route-shadowed",
+			dump: func(t *testing.T, d *configDump) {
+				d.routes["9080"] = newRouteConfig("9080", newClusterRoute("/", reviews), newClusterRoute("/v2", ratings))
+				d.routes["8080"] = newRouteConfig("8080", newClusterRoute("/v2", ratings), newClusterRoute("/", reviews))
+			},
+			want: []string{"9080/vh"},
+		},
+		{
+			rule: "tls-mode-mismatch",
+			dump: func(t *testing.T, d *configDump) {
+				d.listeners["virtualInbound"] = &xdsapi.Listener{Name: "virtualInbound", FilterChains: []*listener.FilterChain{
+					newInboundChain(t, 9080, true, true),
+				}}
+				d.clusters["inbound|9080|http|reviews.default.svc.cluster.local"] =
+					newEDSCluster("inbound|9080|http|reviews.default.svc.cluster.local")
+				d.clusters[reviews] = newEDSCluster(reviews)
+				d.clusters["outbound|9080|v1|reviews.default.svc.cluster.local"] =
+					newMTLSCluster(t, "outbound|9080|v1|reviews.default.svc.cluster.local")
+			},
+			want: []string{reviews},
+		},
+		{
+			rule: "tls-mode-mismatch",
+			dump: func(t *testing.T, d *configDump) {
+				// PERMISSIVE accepts both.
+				d.listeners["virtualInbound"] = &xdsapi.Listener{Name: "virtualInbound", FilterChains: []*listener.FilterChain{
+					newInboundChain(t, 9080, true, true),
+					newInboundChain(t, 9080, false, false),
+				}}
+				d.clusters["inbound|9080|http|reviews.default.svc.cluster.local"] =
+					newEDSCluster("inbound|9080|http|reviews.default.svc.cluster.local")
+				d.clusters[reviews] = newEDSCluster(reviews)
+				d.clusters["outbound|9080|v1|reviews.default.svc.cluster.local"] =
+					newMTLSCluster(t, "outbound|9080|v1|reviews.default.svc.cluster.local")
+			},
+			want: nil,
+		},
+		{
+			rule: "route-no-timeout",
+			dump: func(t *testing.T, d *configDump) {
+				noTimeout := newClusterRoute("/v1", reviews)
+				noTimeout.GetRoute().Timeout = nil
+				zero := newClusterRoute("/v2", reviews)
+				zero.GetRoute().Timeout = ptypes.DurationProto(0)
+				// Without a timeout, Envoy uses 15s.
+				d.routes["9080"] = newRouteConfig("9080", newClusterRoute("/v3", reviews), noTimeout)
+				d.routes["8080"] = newRouteConfig("8080", zero)
+			},
+			want: []string{"8080/vh"},
+		},
+		{
+			rule: "cluster-no-connect-timeout",
+			dump: func(t *testing.T, d *configDump) {
+				d.clusters[reviews] = newEDSCluster(reviews)
+				d.clusters[ratings] = newEDSCluster(ratings)
+				d.clusters[ratings].ConnectTimeout = nil
+			},
+			want: []string{ratings},
+		},
+	}
+	tested := map[string]bool{}
+	for _, c := range cases {
+		tested[c.rule] = true
+		t.Run(c.rule, func(t *testing.T) {
+			d := newConfigDump()
+			c.dump(t, d)
+			findings, err := runLintRules(d, []string{c.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resources []string
+			for _, f := range findings {
+				if f.Rule != c.rule {
+					t.Errorf("finding of rule %s, want %s", f.Rule, c.rule)
+				}
+				resources = append(resources, f.Resource)
+			}
+			if !reflect.DeepEqual(resources, c.want) {
+				t.Errorf("findings on %q, want %q: %v", resources, c.want, findings)
+			}
+		})
+	}
+	for _, rule := range lintRules {
+		if !tested[rule.id] {
+			t.Errorf("no test case for rule %s", rule.id)
+		}
+	}
+}
+
+func TestRunLintRulesUnknownRule(t *testing.T) {
+	if _, err := runLintRules(newConfigDump(), []string{"no-such-rule"}); err == nil {
+		t.Errorf("runLintRules() returned no error for an unknown rule")
+	}
+}
@@ -0,0 +1,456 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+)
+
+// connectionInfo holds the properties of a downstream connection used for filter chain matching.
+type connectionInfo struct {
+	destinationIP        net.IP
+	destinationPort      uint32
+	sourceIP             net.IP
+	sourcePort           uint32
+	serverName           string
+	transportProtocol    string
+	applicationProtocols []string
+}
+
+// isLocal reports whether the connection originates from the same host, as Envoy's LOCAL source type.
+func (c *connectionInfo) isLocal() bool {
+	return c.sourceIP != nil && (c.sourceIP.IsLoopback() || c.sourceIP.Equal(c.destinationIP))
+}
+
+// filterChainCriterion scores a filter chain match for a connection: negative when it does not
+// match, 0 when the criterion is not set, and higher values for more specific matches.
+type filterChainCriterion struct {
+	name  string
+	score func(m *listener.FilterChainMatch, c *connectionInfo) int
+}
+
+// filterChainCriteria are evaluated in the same order as Envoy does. At each step only the most
+// specific matching chains are kept, without falling back to less specific ones later.
+var filterChainCriteria = []filterChainCriterion{
+	{"destination port", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		if m.GetDestinationPort() == nil {
+			return 0
+		}
+		if m.DestinationPort.Value == c.destinationPort {
+			return 1
+		}
+		return -1
+	}},
+	{"destination IP", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		return scoreCidrRanges(m.GetPrefixRanges(), c.destinationIP)
+	}},
+	{"server name", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		return scoreServerNames(m.GetServerNames(), c.serverName)
+	}},
+	{"transport protocol", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		if m.GetTransportProtocol() == "" {
+			return 0
+		}
+		if m.TransportProtocol == c.transportProtocol {
+			return 1
+		}
+		return -1
+	}},
+	{"application protocols", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		if len(m.GetApplicationProtocols()) == 0 {
+			return 0
+		}
+		for _, p := range m.ApplicationProtocols {
+			for _, q := range c.applicationProtocols {
+				if p == q {
+					return 1
+				}
+			}
+		}
+		return -1
+	}},
+	{"source type", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		switch m.GetSourceType() {
+		case listener.FilterChainMatch_LOCAL:
+			if c.isLocal() {
+				return 1
+			}
+			return -1
+		case listener.FilterChainMatch_EXTERNAL:
+			if !c.isLocal() {
+				return 1
+			}
+			return -1
+		}
+		return 0
+	}},
+	{"source IP", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		return scoreCidrRanges(m.GetSourcePrefixRanges(), c.sourceIP)
+	}},
+	{"source port", func(m *listener.FilterChainMatch, c *connectionInfo) int {
+		if len(m.GetSourcePorts()) == 0 {
+			return 0
+		}
+		for _, p := range m.SourcePorts {
+			if p == c.sourcePort {
+				return 1
+			}
+		}
+		return -1
+	}},
+}
+
+// scoreCidrRanges returns the longest prefix length of the ranges containing ip, 0 if there are no
+// ranges, or -1 if none contains ip.
+func scoreCidrRanges(ranges []*core1.CidrRange, ip net.IP) int {
+	if len(ranges) == 0 {
+		return 0
+	}
+	best := -1
+	for _, r := range ranges {
+		prefixLen := int(r.GetPrefixLen().GetValue())
+		_, network, err := net.ParseCIDR(fmt.Sprintf("%s/%d", r.AddressPrefix, prefixLen))
+		if err != nil || ip == nil || !network.Contains(ip) {
+			continue
+		}
+		if prefixLen > best {
+			best = prefixLen
+		}
+	}
+	return best
+}
+
+// scoreServerNames prefers an exact server name over wildcard names, and longer wildcard suffixes
+// over shorter ones.
+func scoreServerNames(names []string, serverName string) int {
+	if len(names) == 0 {
+		return 0
+	}
+	best := -1
+	for _, name := range names {
+		if name == serverName {
+			return math.MaxInt32
+		}
+		if strings.HasPrefix(name, "*.") && strings.HasSuffix(serverName, name[1:]) && len(name)-1 > best {
+			best = len(name) - 1
+		}
+	}
+	return best
+}
+
+// filterChainStep records the chains left after applying one filter chain criterion.
+type filterChainStep struct {
+	criterion string
+	chains    []int
+}
+
+// selectFilterChain returns the index of the filter chain Envoy would pick for the connection, or
+// -1 if there is none. Steps record how the candidates narrowed down.
+func selectFilterChain(chains []*listener.FilterChain, conn *connectionInfo) (int, []filterChainStep) {
+	candidates := make([]int, len(chains))
+	for i := range chains {
+		candidates[i] = i
+	}
+	var steps []filterChainStep
+	for _, criterion := range filterChainCriteria {
+		best := -1
+		var kept []int
+		for _, i := range candidates {
+			score := criterion.score(chains[i].GetFilterChainMatch(), conn)
+			if score < 0 || score < best {
+				continue
+			}
+			if score > best {
+				best = score
+				kept = nil
+			}
+			kept = append(kept, i)
+		}
+		if len(kept) != len(candidates) {
+			steps = append(steps, filterChainStep{criterion: criterion.name, chains: kept})
+		}
+		candidates = kept
+		if len(candidates) == 0 {
+			return -1, steps
+		}
+	}
+	// More than one candidate means overlapping matches, which Envoy rejects. Report the first.
+	return candidates[0], steps
+}
+
+// selectListener returns the listener that would handle a connection to ip:port. When the virtual
+// listener of the given direction uses the original destination, the connection is handed off to
+// the listener bound to ip:port, or to the wildcard address on that port.
+func selectListener(listeners map[string]*xdsapi.Listener, direction string, ip net.IP, port uint32) (*xdsapi.Listener, string) {
+	var virtual *xdsapi.Listener
+	for _, l := range listeners {
+		if strings.EqualFold(l.Name, "virtual"+direction) {
+			virtual = l
+		}
+	}
+	if virtual != nil && !virtual.GetUseOriginalDst().GetValue() {
+		return virtual, "virtual " + direction + " listener"
+	}
+	var wildcard *xdsapi.Listener
+	for _, l := range listeners {
+		if retrieveListenerPort(l) != port || l == virtual {
+			continue
+		}
+		address := net.ParseIP(retrieveListenerAddress(l))
+		if address.Equal(ip) {
+			return l, "original destination " + ip.String()
+		}
+		if address != nil && address.IsUnspecified() {
+			wildcard = l
+		}
+	}
+	if wildcard != nil {
+		return wildcard, "original destination port"
+	}
+	if virtual != nil {
+		return virtual, "no listener for original destination"
+	}
+	return nil, ""
+}
+
+// selectVirtualHost picks the virtual host for the host header the way Envoy does: exact domains
+// first, then the longest suffix wildcard, then the longest prefix wildcard, then "*".
+func selectVirtualHost(rc *xdsapi.RouteConfiguration, host string) (*route.VirtualHost, string) {
+	host = strings.ToLower(host)
+	var suffixHost, prefixHost, defaultHost *route.VirtualHost
+	var suffixDomain, prefixDomain string
+	for _, vh := range rc.GetVirtualHosts() {
+		for _, domain := range vh.Domains {
+			domain = strings.ToLower(domain)
+			switch {
+			case domain == "*":
+				if defaultHost == nil {
+					defaultHost = vh
+				}
+			case domain == host:
+				return vh, domain
+			case strings.HasPrefix(domain, "*"):
+				if len(domain)-1 < len(host) && strings.HasSuffix(host, domain[1:]) && len(domain) > len(suffixDomain) {
+					suffixHost, suffixDomain = vh, domain
+				}
+			case strings.HasSuffix(domain, "*"):
+				if len(domain)-1 < len(host) && strings.HasPrefix(host, domain[:len(domain)-1]) && len(domain) > len(prefixDomain) {
+					prefixHost, prefixDomain = vh, domain
+				}
+			}
+		}
+	}
+	if suffixHost != nil {
+		return suffixHost, suffixDomain
+	}
+	if prefixHost != nil {
+		return prefixHost, prefixDomain
+	}
+	return defaultHost, "*"
+}
+
+// httpRequest is a synthetic HTTP request used for route matching. Header names are lower case.
+type httpRequest struct {
+	host    string
+	path    string
+	method  string
+	headers map[string]string
+}
+
+func (r *httpRequest) header(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case ":authority", "host":
+		return r.host, true
+	case ":path":
+		return r.path, true
+	case ":method":
+		return r.method, true
+	}
+	v, ok := r.headers[strings.ToLower(name)]
+	return v, ok
+}
+
+// selectRoute returns the index of the first route of the virtual host matching the request, or -1.
+func selectRoute(vh *route.VirtualHost, req *httpRequest) int {
+	for i, r := range vh.GetRoutes() {
+		if matchRoute(r.GetMatch(), req) {
+			return i
+		}
+	}
+	return -1
+}
+
+func describeRoute(i int, r *route.Route) string {
+	return strings.TrimSpace(fmt.Sprintf("#%d %s", i, r.Name))
+}
+
+func matchRoute(m *route.RouteMatch, req *httpRequest) bool {
+	path := req.path
+	query := ""
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path, query = req.path[:i], strings.TrimPrefix(req.path[i:], "?")
+	}
+	caseSensitive := m.GetCaseSensitive() == nil || m.CaseSensitive.Value
+	switch p := m.GetPathSpecifier().(type) {
+	case *route.RouteMatch_Prefix:
+		if caseSensitive && !strings.HasPrefix(req.path, p.Prefix) ||
+			!caseSensitive && !strings.HasPrefix(strings.ToLower(req.path), strings.ToLower(p.Prefix)) {
+			return false
+		}
+	case *route.RouteMatch_Path:
+		if caseSensitive && path != p.Path || !caseSensitive && !strings.EqualFold(path, p.Path) {
+			return false
+		}
+	case *route.RouteMatch_Regex:
+		if !matchRegex(p.Regex, path) {
+			return false
+		}
+	case *route.RouteMatch_SafeRegex:
+		if !matchRegex(p.SafeRegex.GetRegex(), path) {
+			return false
+		}
+	}
+	for _, h := range m.GetHeaders() {
+		if !matchHeader(h, req) {
+			return false
+		}
+	}
+	if len(m.GetQueryParameters()) != 0 {
+		values, _ := url.ParseQuery(query)
+		for _, q := range m.QueryParameters {
+			if !matchQueryParameter(q, values) {
+				return false
+			}
+		}
+	}
+	if m.GetGrpc() != nil {
+		if contentType, _ := req.header("content-type"); !strings.HasPrefix(contentType, "application/grpc") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRegex reports whether the whole value matches the regex, as Envoy requires.
+func matchRegex(regex, value string) bool {
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+func matchHeader(h *route.HeaderMatcher, req *httpRequest) bool {
+	value, present := req.header(h.Name)
+	matched := present
+	if present {
+		switch s := h.GetHeaderMatchSpecifier().(type) {
+		case *route.HeaderMatcher_ExactMatch:
+			matched = value == s.ExactMatch
+		case *route.HeaderMatcher_RegexMatch:
+			matched = matchRegex(s.RegexMatch, value)
+		case *route.HeaderMatcher_SafeRegexMatch:
+			matched = matchRegex(s.SafeRegexMatch.GetRegex(), value)
+		case *route.HeaderMatcher_RangeMatch:
+			n, err := strconv.ParseInt(value, 10, 64)
+			matched = err == nil && n >= s.RangeMatch.Start && n < s.RangeMatch.End
+		case *route.HeaderMatcher_PresentMatch:
+			matched = s.PresentMatch
+		case *route.HeaderMatcher_PrefixMatch:
+			matched = strings.HasPrefix(value, s.PrefixMatch)
+		case *route.HeaderMatcher_SuffixMatch:
+			matched = strings.HasSuffix(value, s.SuffixMatch)
+		}
+	}
+	return matched != h.InvertMatch
+}
+
+func matchQueryParameter(q *route.QueryParameterMatcher, values url.Values) bool {
+	if _, ok := values[q.Name]; !ok {
+		return false
+	}
+	value := values.Get(q.Name)
+	switch s := q.GetQueryParameterMatchSpecifier().(type) {
+	case *route.QueryParameterMatcher_StringMatch:
+		return matchString(s.StringMatch, value)
+	case *route.QueryParameterMatcher_PresentMatch:
+		return s.PresentMatch
+	}
+	if q.Value == "" {
+		return true
+	}
+	if q.GetRegex().GetValue() {
+		return matchRegex(q.Value, value)
+	}
+	return q.Value == value
+}
+
+func matchString(m *matcher.StringMatcher, value string) bool {
+	if m.GetIgnoreCase() {
+		value = strings.ToLower(value)
+	}
+	lower := func(s string) string {
+		if m.GetIgnoreCase() {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	switch p := m.GetMatchPattern().(type) {
+	case *matcher.StringMatcher_Exact:
+		return value == lower(p.Exact)
+	case *matcher.StringMatcher_Prefix:
+		return strings.HasPrefix(value, lower(p.Prefix))
+	case *matcher.StringMatcher_Suffix:
+		return strings.HasSuffix(value, lower(p.Suffix))
+	case *matcher.StringMatcher_Regex:
+		return matchRegex(p.Regex, value)
+	case *matcher.StringMatcher_SafeRegex:
+		return matchRegex(p.SafeRegex.GetRegex(), value)
+	}
+	return false
+}
+
+// weightedCluster is a cluster a request or connection may be routed to, with its share of traffic.
+type weightedCluster struct {
+	name   string
+	weight uint32
+	total  uint32
+}
+
+// retrieveRouteClusters returns the clusters of a route action, with their weights. Without a
+// request, the cluster from a cluster header is unknown.
+func retrieveRouteClusters(action *route.RouteAction, req *httpRequest) []weightedCluster {
+	switch c := action.GetClusterSpecifier().(type) {
+	case *route.RouteAction_Cluster:
+		return []weightedCluster{{name: c.Cluster, weight: 1, total: 1}}
+	case *route.RouteAction_ClusterHeader:
+		if req == nil {
+			return nil
+		}
+		name, _ := req.header(c.ClusterHeader)
+		return []weightedCluster{{name: name, weight: 1, total: 1}}
+	case *route.RouteAction_WeightedClusters:
+		total := c.WeightedClusters.GetTotalWeight().GetValue()
+		if total == 0 {
+			total = 100
+		}
+		var ret []weightedCluster
+		for _, w := range c.WeightedClusters.Clusters {
+			ret = append(ret, weightedCluster{name: w.Name, weight: w.GetWeight().GetValue(), total: total})
+		}
+		sort.SliceStable(ret, func(i, j int) bool { return ret[i].weight > ret[j].weight })
+		return ret
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func cidr(prefix string, length uint32) *core1.CidrRange {
+	return &core1.CidrRange{AddressPrefix: prefix, PrefixLen: &wrappers.UInt32Value{Value: length}}
+}
+
+func TestSelectFilterChain(t *testing.T) {
+	port := func(p uint32) *wrappers.UInt32Value { return &wrappers.UInt32Value{Value: p} }
+	cases := []struct {
+		name   string
+		chains []*listener.FilterChainMatch
+		conn   *connectionInfo
+		want   int
+	}{
+		{
+			name:   "no match criteria",
+			chains: []*listener.FilterChainMatch{nil},
+			conn:   &connectionInfo{destinationPort: 80},
+			want:   0,
+		},
+		{
+			name:   "destination port over catch-all",
+			chains: []*listener.FilterChainMatch{{}, {DestinationPort: port(80)}},
+			conn:   &connectionInfo{destinationPort: 80},
+			want:   1,
+		},
+		{
+			name:   "catch-all for another port",
+			chains: []*listener.FilterChainMatch{{}, {DestinationPort: port(80)}},
+			conn:   &connectionInfo{destinationPort: 8080},
+			want:   0,
+		},
+		{
+			name: "longest destination prefix",
+			chains: []*listener.FilterChainMatch{
+				{PrefixRanges: []*core1.CidrRange{cidr("10.0.0.0", 8)}},
+				{PrefixRanges: []*core1.CidrRange{cidr("10.1.0.0", 16)}},
+			},
+			conn: &connectionInfo{destinationIP: net.ParseIP("10.1.2.3")},
+			want: 1,
+		},
+		{
+			name: "destination port before destination IP",
+			chains: []*listener.FilterChainMatch{
+				{PrefixRanges: []*core1.CidrRange{cidr("10.1.2.3", 32)}},
+				{DestinationPort: port(80)},
+			},
+			conn: &connectionInfo{destinationIP: net.ParseIP("10.1.2.3"), destinationPort: 80},
+			want: 1,
+		},
+		{
+			name: "exact server name over wildcard",
+			chains: []*listener.FilterChainMatch{
+				{ServerNames: []string{"*.example.com"}},
+				{ServerNames: []string{"www.example.com"}},
+			},
+			conn: &connectionInfo{serverName: "www.example.com"},
+			want: 1,
+		},
+		{
+			name: "longer wildcard server name",
+			chains: []*listener.FilterChainMatch{
+				{ServerNames: []string{"*.com"}},
+				{ServerNames: []string{"*.example.com"}},
+			},
+			conn: &connectionInfo{serverName: "www.example.com"},
+			want: 1,
+		},
+		{
+			name: "no fallback once a more specific criterion matched",
+			chains: []*listener.FilterChainMatch{
+				{ServerNames: []string{"www.example.com"}, TransportProtocol: "tls"},
+				{TransportProtocol: "raw_buffer"},
+			},
+			conn: &connectionInfo{serverName: "www.example.com", transportProtocol: "raw_buffer"},
+			want: -1,
+		},
+		{
+			name: "transport protocol",
+			chains: []*listener.FilterChainMatch{
+				{TransportProtocol: "tls"},
+				{TransportProtocol: "raw_buffer"},
+			},
+			conn: &connectionInfo{transportProtocol: "raw_buffer"},
+			want: 1,
+		},
+		{
+			name: "application protocols",
+			chains: []*listener.FilterChainMatch{
+				{},
+				{ApplicationProtocols: []string{"http/1.0", "http/1.1", "h2c"}},
+			},
+			conn: &connectionInfo{applicationProtocols: []string{"http/1.1"}},
+			want: 1,
+		},
+		{
+			name: "local source type",
+			chains: []*listener.FilterChainMatch{
+				{SourceType: listener.FilterChainMatch_EXTERNAL},
+				{SourceType: listener.FilterChainMatch_LOCAL},
+			},
+			conn: &connectionInfo{sourceIP: net.ParseIP("127.0.0.1")},
+			want: 1,
+		},
+		{
+			name: "source prefix",
+			chains: []*listener.FilterChainMatch{
+				{SourcePrefixRanges: []*core1.CidrRange{cidr("10.0.0.0", 8)}},
+				{SourcePrefixRanges: []*core1.CidrRange{cidr("0.0.0.0", 0)}},
+			},
+			conn: &connectionInfo{sourceIP: net.ParseIP("192.168.0.1")},
+			want: 1,
+		},
+		{
+			name: "source port",
+			chains: []*listener.FilterChainMatch{
+				{SourcePorts: []uint32{1234}},
+				{},
+			},
+			conn: &connectionInfo{sourcePort: 1234},
+			want: 0,
+		},
+		{
+			name:   "nothing matches",
+			chains: []*listener.FilterChainMatch{{DestinationPort: port(80)}},
+			conn:   &connectionInfo{destinationPort: 8080},
+			want:   -1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var chains []*listener.FilterChain
+			for _, m := range c.chains {
+				chains = append(chains, &listener.FilterChain{FilterChainMatch: m})
+			}
+			if got, steps := selectFilterChain(chains, c.conn); got != c.want {
+				t.Errorf("selectFilterChain() = %d, want %d, steps %v", got, c.want, steps)
+			}
+		})
+	}
+}
+
+func TestSelectVirtualHost(t *testing.T) {
+	rc := &xdsapi.RouteConfiguration{
+		VirtualHosts: []*route.VirtualHost{
+			{Name: "default", Domains: []string{"*"}},
+			{Name: "exact", Domains: []string{"www.example.com", "www.example.com:80"}},
+			{Name: "suffix", Domains: []string{"*.example.com"}},
+			{Name: "longer-suffix", Domains: []string{"*.api.example.com"}},
+			{Name: "prefix", Domains: []string{"www.*"}},
+		},
+	}
+	cases := []struct {
+		host string
+		want string
+	}{
+		{"www.example.com", "exact"},
+		{"WWW.Example.com", "exact"},
+		{"www.example.com:80", "exact"},
+		{"foo.example.com", "suffix"},
+		{"v1.api.example.com", "longer-suffix"},
+		{"www.example.org", "prefix"},
+		// Suffix wildcards win over prefix wildcards.
+		{"www.foo.example.com", "suffix"},
+		// A wildcard must match at least one character.
+		{".example.com", "default"},
+		{"other", "default"},
+	}
+	for _, c := range cases {
+		t.Run(c.host, func(t *testing.T) {
+			vh, _ := selectVirtualHost(rc, c.host)
+			if vh == nil || vh.Name != c.want {
+				t.Errorf("selectVirtualHost(%q) = %v, want %s", c.host, vh, c.want)
+			}
+		})
+	}
+
+	noDefault := &xdsapi.RouteConfiguration{VirtualHosts: []*route.VirtualHost{{Name: "exact", Domains: []string{"a"}}}}
+	if vh, _ := selectVirtualHost(noDefault, "b"); vh != nil {
+		t.Errorf("selectVirtualHost() = %v, want none", vh)
+	}
+}
+
+func TestSelectRoute(t *testing.T) {
+	vh := &route.VirtualHost{
+		Routes: []*route.Route{
+			{Name: "exact", Match: &route.RouteMatch{PathSpecifier: &route.RouteMatch_Path{Path: "/status"}}},
+			{Name: "header", Match: &route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/api"},
+				Headers: []*route.HeaderMatcher{{
+					Name: "end-user", HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "jason"},
+				}},
+			}},
+			{Name: "query", Match: &route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/api"},
+				QueryParameters: []*route.QueryParameterMatcher{{
+					Name: "v", QueryParameterMatchSpecifier: &route.QueryParameterMatcher_StringMatch{
+						StringMatch: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: "2"}},
+					},
+				}},
+			}},
+			{Name: "regex", Match: &route.RouteMatch{PathSpecifier: &route.RouteMatch_SafeRegex{
+				SafeRegex: &matcher.RegexMatcher{Regex: "/api/v[0-9]+"},
+			}}},
+			{Name: "case-insensitive", Match: &route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/Docs"},
+				CaseSensitive: &wrappers.BoolValue{Value: false},
+			}},
+			{Name: "catch-all", Match: &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}}},
+		},
+	}
+	cases := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		want    string
+	}{
+		{"exact path", "/status", nil, "exact"},
+		{"exact path ignores the query", "/status?verbose=1", nil, "exact"},
+		{"exact path is not a prefix", "/status/1", nil, "catch-all"},
+		{"first matching route wins", "/api/v1", map[string]string{"end-user": "jason"}, "header"},
+		{"header mismatch", "/api/v1", map[string]string{"end-user": "other"}, "regex"},
+		{"query parameter", "/api/items?v=2", nil, "query"},
+		{"regex matches the whole path", "/api/v1/items", nil, "catch-all"},
+		{"case insensitive prefix", "/docs/index.html", nil, "case-insensitive"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := &httpRequest{host: "example.com", path: c.path, method: "GET", headers: map[string]string{}}
+			for k, v := range c.headers {
+				req.headers[k] = v
+			}
+			i := selectRoute(vh, req)
+			if i < 0 || vh.Routes[i].Name != c.want {
+				t.Errorf("selectRoute(%s) = %d, want %s", c.path, i, c.want)
+			}
+		})
+	}
+}
+
+func TestMatchHeader(t *testing.T) {
+	req := &httpRequest{
+		host:    "example.com",
+		path:    "/items",
+		method:  "POST",
+		headers: map[string]string{"x-version": "v2", "x-count": "5"},
+	}
+	cases := []struct {
+		name    string
+		matcher *route.HeaderMatcher
+		want    bool
+	}{
+		{"exact", &route.HeaderMatcher{Name: "x-version", HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "v2"}}, true},
+		{"name is case insensitive", &route.HeaderMatcher{Name: "X-Version",
+			HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "v2"}}, true},
+		{"exact mismatch", &route.HeaderMatcher{Name: "x-version", HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "v1"}}, false},
+		{"inverted", &route.HeaderMatcher{Name: "x-version", InvertMatch: true,
+			HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "v1"}}, true},
+		{"missing header", &route.HeaderMatcher{Name: "x-missing", HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true}}, false},
+		{"inverted missing header", &route.HeaderMatcher{Name: "x-missing", InvertMatch: true,
+			HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "v1"}}, true},
+		{"pseudo header", &route.HeaderMatcher{Name: ":method", HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "POST"}}, true},
+		{"authority", &route.HeaderMatcher{Name: ":authority", HeaderMatchSpecifier: &route.HeaderMatcher_SuffixMatch{SuffixMatch: ".com"}}, true},
+		{"range", &route.HeaderMatcher{Name: "x-count", HeaderMatchSpecifier: &route.HeaderMatcher_RangeMatch{
+			RangeMatch: &envoytype.Int64Range{Start: 1, End: 5}}}, false},
+		{"regex matches the whole value", &route.HeaderMatcher{Name: "x-version", HeaderMatchSpecifier: &route.HeaderMatcher_SafeRegexMatch{
+			SafeRegexMatch: &matcher.RegexMatcher{Regex: "v"}}}, false},
+		{"prefix", &route.HeaderMatcher{Name: "x-version", HeaderMatchSpecifier: &route.HeaderMatcher_PrefixMatch{PrefixMatch: "v"}}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := matchHeader(c.matcher, req); got != c.want {
+				t.Errorf("matchHeader() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveRouteClusters(t *testing.T) {
+	action := &route.RouteAction{ClusterSpecifier: &route.RouteAction_WeightedClusters{WeightedClusters: &route.WeightedCluster{
+		Clusters: []*route.WeightedCluster_ClusterWeight{
+			{Name: "v1", Weight: &wrappers.UInt32Value{Value: 10}},
+			{Name: "v2", Weight: &wrappers.UInt32Value{Value: 90}},
+		},
+	}}}
+	want := []weightedCluster{{name: "v2", weight: 90, total: 100}, {name: "v1", weight: 10, total: 100}}
+	if got := retrieveRouteClusters(action, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("retrieveRouteClusters() = %v, want %v", got, want)
+	}
+}
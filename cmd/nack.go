@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/pkg/log"
+)
+
+// nackOptions configures the NACKs injected by send, to test how pilot handles rejected config.
+type nackOptions struct {
+	// NACK the Nth response (1-based). 0 to disable.
+	response int
+	// NACK every response of this type URL. Empty to disable. Set by the --nack-type flag.
+	typeURL string
+	// Message of the ErrorDetail sent with the NACK.
+	message string
+	// How long to wait for pilot to respond after a NACK before reporting it did not.
+	wait time.Duration
+	// Pilot debug address. If set, the sync status of the proxy is queried after each NACK.
+	debugURL string
+}
+
+// inject returns true if the nth response (1-based) must be NACKed.
+func (n *nackOptions) inject(nth int, res *xdsapi.DiscoveryResponse) bool {
+	if n.response != 0 && n.response == nth {
+		return true
+	}
+	return n.typeURL != "" && n.typeURL == res.TypeUrl
+}
+
+// nackTypeFlag is the --nack-type flag. The type is resolved when the flag is parsed, so that an unknown
+// type fails before connecting to pilot rather than on the first response.
+type nackTypeFlag struct {
+	options    *nackOptions
+	configType string
+}
+
+func (f *nackTypeFlag) String() string {
+	return f.configType
+}
+
+func (f *nackTypeFlag) Set(configType string) error {
+	typeURL, err := parseTypeURL(configType)
+	if err != nil {
+		return err
+	}
+	f.configType = configType
+	f.options.typeURL = typeURL
+	return nil
+}
+
+func (f *nackTypeFlag) Type() string {
+	return "string"
+}
+
+// nackReport follows what pilot does after a NACK.
+type nackReport struct {
+	options *nackOptions
+	nodeID  string
+	version string
+	nonce   string
+	sentAt  time.Time
+	timer   *time.Timer
+	ctx     context.Context
+}
+
+// newNACKReport starts waiting for the reaction of pilot to the NACK of the response. onTimeout is
+// called if pilot does not respond in time.
+func newNACKReport(ctx context.Context, options *nackOptions, nodeID string, res *xdsapi.DiscoveryResponse, onTimeout func()) *nackReport {
+	r := &nackReport{
+		ctx:     ctx,
+		options: options,
+		nodeID:  nodeID,
+		version: res.VersionInfo,
+		nonce:   res.Nonce,
+		sentAt:  time.Now(),
+	}
+	r.timer = time.AfterFunc(options.wait, func() {
+		log.Infof("Pilot did not respond within %v of the NACK of %s (nonce %s): it kept the last version and did not resend",
+			options.wait, r.version, r.nonce)
+		r.reportSyncStatus()
+		onTimeout()
+	})
+	return r
+}
+
+// onResponse reports the response pilot sent after the NACK.
+func (r *nackReport) onResponse(res *xdsapi.DiscoveryResponse) {
+	if !r.timer.Stop() {
+		// Already reported as timed out.
+		return
+	}
+	reaction := "pushed a new version"
+	if res.VersionInfo == r.version {
+		reaction = "resent the NACKed version"
+	}
+	log.Infof("Pilot %s %s (nonce %s) %v after the NACK of %s",
+		reaction, res.VersionInfo, res.Nonce, time.Since(r.sentAt), r.version)
+	r.reportSyncStatus()
+}
+
+// reportSyncStatus logs what pilot's debug endpoints show for the proxy.
+func (r *nackReport) reportSyncStatus() {
+	if r.options.debugURL == "" {
+		return
+	}
+	statuses, err := fetchProxyStatuses(r.ctx, r.options.debugURL)
+	if err != nil {
+		log.Warnf("Cannot query pilot debug endpoints: %v", err)
+		return
+	}
+	for _, s := range statuses {
+		if s.Proxy != r.nodeID {
+			continue
+		}
+		for _, t := range proxyStatusTypes {
+			log.Infof("Pilot sync status of %s: %s sent %q acked %q", t, s.Types[t], s.Types[t].Sent, s.Types[t].Acked)
+		}
+		log.Infof("Pilot recorded NACK codes: %s", s.NACKCodes)
+		return
+	}
+	log.Infof("Proxy %s not found in pilot sync status", r.nodeID)
+}
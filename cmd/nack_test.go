@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+)
+
+func TestNACKTypeFlag(t *testing.T) {
+	cases := []struct {
+		value   string
+		typeURL string
+		wantErr bool
+	}{
+		{"cds", v2.ClusterType, false},
+		{v2.ListenerType, v2.ListenerType, false},
+		{"type.googleapis.com/envoy.api.v2.auth.Secret", "type.googleapis.com/envoy.api.v2.auth.Secret", false},
+		{"clusters", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			options := &nackOptions{}
+			err := (&nackTypeFlag{options: options}).Set(c.value)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("Set(%q) error = %v, want error %v", c.value, err, c.wantErr)
+			}
+			if options.typeURL != c.typeURL {
+				t.Errorf("Set(%q) type URL = %q, want %q", c.value, options.typeURL, c.typeURL)
+			}
+			if c.wantErr {
+				return
+			}
+			if !options.inject(1, &xdsapi.DiscoveryResponse{TypeUrl: c.typeURL}) {
+				t.Errorf("response of type %s not NACKed", c.typeURL)
+			}
+			if options.inject(1, &xdsapi.DiscoveryResponse{TypeUrl: v2.EndpointType}) {
+				t.Errorf("response of type %s NACKed", v2.EndpointType)
+			}
+		})
+	}
+}
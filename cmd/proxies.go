@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+)
+
+const pilotDebugPort = 15014
+
+var proxyStatusTypes = []string{"cds", "lds", "rds", "eds"}
+
+func proxies() *cobra.Command {
+	var debugURL string
+	localCmd := &cobra.Command{
+		Use:   "proxies",
+		Short: "List the proxies connected to pilot and their sync status",
+		Long: "Query the debug endpoints (/debug/syncz, /debug/adsz and /metrics) of every pilot instance and " +
+			"print each connected proxy with its address, the config version sent and acked per type, and the " +
+			"gRPC codes of the NACKs pilot recorded. Pilot does not keep the NACK messages, only logs them.",
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := commandContext()
+			defer cancel()
+			var statuses []*proxyStatus
+			if debugURL != "" {
+				s, err := fetchProxyStatuses(ctx, debugURL)
+				if err != nil {
+					fatalf("Cannot query %s: %v", debugURL, err)
+				}
+				statuses = s
+			} else {
+				pods, err := proxy.PilotPods(resolveKubeConfigPath(kubeConfig))
+				if err != nil {
+					fatalf("Cannot get pilot pods: %v", err)
+				}
+				for _, pod := range pods {
+					process, url, err := portForward(ctx, pod, "istio-system", pilotDebugPort)
+					if err != nil {
+						fatalf("Cannot port-forward %s: %v", pod, err)
+					}
+					s, err := fetchProxyStatuses(ctx, url)
+					_ = process.Kill()
+					if err != nil {
+						fatalf("Cannot query %s: %v", pod, err)
+					}
+					for _, status := range s {
+						status.Pilot = pod
+					}
+					statuses = append(statuses, s...)
+				}
+			}
+			sort.Slice(statuses, func(i, j int) bool {
+				return statuses[i].Proxy < statuses[j].Proxy
+			})
+
+			if outputFormat == "json" {
+				output, err := json.MarshalIndent(statuses, "", "  ")
+				if err != nil {
+					fatalf("Cannot convert to JSON: %v", err)
+				}
+				writeOutput(string(output))
+				return
+			}
+			fmt.Println(outputProxyStatuses(statuses))
+		},
+	}
+	localCmd.Flags().StringVarP(&debugURL, "debug-url", "", "",
+		fmt.Sprintf("Pilot debug address. Will port-forward port %d of every pilot pod if not provided.", pilotDebugPort))
+	return localCmd
+}
+
+// typeStatus holds the nonces of the last response pilot sent for a type and the last one the proxy acked,
+// and the config versions they were sent at.
+type typeStatus struct {
+	Sent         string `json:"sent"`
+	Acked        string `json:"acked"`
+	SentVersion  string `json:"sentVersion,omitempty"`
+	AckedVersion string `json:"ackedVersion,omitempty"`
+}
+
+func newTypeStatus(sent, acked string) *typeStatus {
+	return &typeStatus{
+		Sent:         sent,
+		Acked:        acked,
+		SentVersion:  nonceVersion(sent),
+		AckedVersion: nonceVersion(acked),
+	}
+}
+
+// String returns the sent and acked versions, with the nonces only when a newer response at the same
+// version is not acked yet.
+func (t *typeStatus) String() string {
+	if t == nil || t.Sent == "" {
+		return "-"
+	}
+	acked := t.AckedVersion
+	if acked == "" {
+		acked = "-"
+	}
+	if t.Sent != t.Acked && t.SentVersion == t.AckedVersion {
+		return fmt.Sprintf("%s (nonce %s) / %s (nonce %s)", t.SentVersion, t.Sent, acked, t.Acked)
+	}
+	return fmt.Sprintf("%s / %s", t.SentVersion, acked)
+}
+
+var nonceUUID = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// nonceVersion returns the config version of a pilot nonce, which is the push version followed by a UUID.
+func nonceVersion(nonce string) string {
+	if loc := nonceUUID.FindStringIndex(nonce); loc != nil && loc[0] > 0 {
+		return nonce[:loc[0]]
+	}
+	return nonce
+}
+
+type proxyStatus struct {
+	Proxy       string                 `json:"proxy"`
+	Pilot       string                 `json:"pilot"`
+	Address     string                 `json:"address,omitempty"`
+	ConnectedAt string                 `json:"connectedAt,omitempty"`
+	Types       map[string]*typeStatus `json:"types"`
+	// NACKCodes holds the rejected types with the gRPC code of the NACK.
+	NACKCodes string `json:"nackCodes,omitempty"`
+}
+
+// syncStatus is an entry of /debug/syncz.
+type syncStatus struct {
+	ProxyID       string `json:"proxy"`
+	ClusterSent   string `json:"cluster_sent"`
+	ClusterAcked  string `json:"cluster_acked"`
+	ListenerSent  string `json:"listener_sent"`
+	ListenerAcked string `json:"listener_acked"`
+	RouteSent     string `json:"route_sent"`
+	RouteAcked    string `json:"route_acked"`
+	EndpointSent  string `json:"endpoint_sent"`
+	EndpointAcked string `json:"endpoint_acked"`
+}
+
+// adsConnection is an entry of /debug/adsz. Node is the connection ID, the node ID followed by a counter.
+type adsConnection struct {
+	Node    string `json:"node"`
+	Addr    string `json:"addr"`
+	Connect string `json:"connect"`
+}
+
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchProxyStatuses returns the proxies connected to the pilot instance serving debug endpoints at url.
+// The pilot of the statuses is the url.
+func fetchProxyStatuses(ctx context.Context, url string) ([]*proxyStatus, error) {
+	body, err := httpGet(ctx, fmt.Sprintf("http://%s/debug/syncz", url))
+	if err != nil {
+		return nil, err
+	}
+	var syncz []syncStatus
+	if err := json.Unmarshal(body, &syncz); err != nil {
+		return nil, fmt.Errorf("cannot parse syncz: %v", err)
+	}
+
+	var connections []adsConnection
+	if body, err := httpGet(ctx, fmt.Sprintf("http://%s/debug/adsz", url)); err != nil {
+		log.Warnf("Cannot get adsz from %s: %v", url, err)
+	} else if err := json.Unmarshal(body, &connections); err != nil {
+		log.Warnf("Cannot parse adsz from %s: %v", url, err)
+	}
+
+	nacks := map[string]string{}
+	if body, err := httpGet(ctx, fmt.Sprintf("http://%s/metrics", url)); err != nil {
+		log.Warnf("Cannot get metrics from %s: %v", url, err)
+	} else {
+		nacks = parseRejects(body)
+	}
+
+	var statuses []*proxyStatus
+	for _, s := range syncz {
+		status := &proxyStatus{
+			Proxy: s.ProxyID,
+			Pilot: url,
+			Types: map[string]*typeStatus{
+				"cds": newTypeStatus(s.ClusterSent, s.ClusterAcked),
+				"lds": newTypeStatus(s.ListenerSent, s.ListenerAcked),
+				"rds": newTypeStatus(s.RouteSent, s.RouteAcked),
+				"eds": newTypeStatus(s.EndpointSent, s.EndpointAcked),
+			},
+			NACKCodes: nacks[s.ProxyID],
+		}
+		for _, c := range connections {
+			if strings.HasPrefix(c.Node, s.ProxyID+"-") {
+				status.Address = c.Addr
+				status.ConnectedAt = c.Connect
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+var rejectMetric = regexp.MustCompile(`^pilot_xds_(cds|lds|rds|eds)_reject\{(.*)\} `)
+var metricLabel = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// parseRejects reads the pilot_xds_<type>_reject gauges of the Prometheus metrics and returns the
+// rejected types and error codes per node ID. Pilot keeps the gRPC code, not the message, of the NACK.
+func parseRejects(metrics []byte) map[string]string {
+	nacks := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(metrics))
+	for scanner.Scan() {
+		m := rejectMetric.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range metricLabel.FindAllStringSubmatch(m[2], -1) {
+			labels[l[1]] = l[2]
+		}
+		node := labels["node"]
+		reject := fmt.Sprintf("%s: %s", m[1], labels["err"])
+		if nacks[node] == "" {
+			nacks[node] = reject
+		} else {
+			nacks[node] += ", " + reject
+		}
+	}
+	return nacks
+}
+
+func outputProxyStatuses(statuses []*proxyStatus) string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "PROXY\tPILOT\tADDRESS\tCDS SENT/ACKED\tLDS SENT/ACKED\tRDS SENT/ACKED\tEDS SENT/ACKED\tNACK CODES")
+	for _, s := range statuses {
+		address := s.Address
+		if address == "" {
+			address = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s", s.Proxy, s.Pilot, address)
+		for _, t := range proxyStatusTypes {
+			fmt.Fprintf(w, "\t%s", s.Types[t])
+		}
+		nack := s.NACKCodes
+		if nack == "" {
+			nack = "-"
+		}
+		fmt.Fprintf(w, "\t%s\n", nack)
+	}
+	w.Flush()
+	return buf.String()
+}
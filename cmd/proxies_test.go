@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestTypeStatus(t *testing.T) {
+	cases := []struct {
+		name  string
+		sent  string
+		acked string
+		want  string
+	}{
+		{"not sent", "", "", "-"},
+		{"not acked", "2020-02-18T10:00:00Z/123f5e1c9a-8a5b-4a43-9d4b-6c9f0f0b7f11", "", "2020-02-18T10:00:00Z/12 / -"},
+		{
+			"acked",
+			"2020-02-18T10:00:00Z/123f5e1c9a-8a5b-4a43-9d4b-6c9f0f0b7f11",
+			"2020-02-18T10:00:00Z/123f5e1c9a-8a5b-4a43-9d4b-6c9f0f0b7f11",
+			"2020-02-18T10:00:00Z/12 / 2020-02-18T10:00:00Z/12",
+		},
+		{
+			"older version acked",
+			"2020-02-18T10:05:00Z/120b7c6a4e-1f2d-4e3c-8b9a-7d6e5f4c3b2a",
+			"2020-02-18T10:00:00Z/123f5e1c9a-8a5b-4a43-9d4b-6c9f0f0b7f11",
+			"2020-02-18T10:05:00Z/12 / 2020-02-18T10:00:00Z/12",
+		},
+		{
+			"same version not acked",
+			"2020-02-18T10:00:00Z/120b7c6a4e-1f2d-4e3c-8b9a-7d6e5f4c3b2a",
+			"2020-02-18T10:00:00Z/123f5e1c9a-8a5b-4a43-9d4b-6c9f0f0b7f11",
+			"2020-02-18T10:00:00Z/12 (nonce 2020-02-18T10:00:00Z/120b7c6a4e-1f2d-4e3c-8b9a-7d6e5f4c3b2a) / " +
+				"2020-02-18T10:00:00Z/12 (nonce 2020-02-18T10:00:00Z/123f5e1c9a-8a5b-4a43-9d4b-6c9f0f0b7f11)",
+		},
+		{"nonce without uuid", "42", "41", "42 / 41"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := newTypeStatus(c.sent, c.acked).String(); got != c.want {
+				t.Errorf("String() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	metrics := `# TYPE pilot_xds_cds_reject gauge
+pilot_xds_cds_reject{err="InvalidArgument",node="sidecar~10.0.0.1~a.default~default.svc.cluster.local"} 1
+pilot_xds_eds_reject{err="Internal",node="sidecar~10.0.0.1~a.default~default.svc.cluster.local"} 1
+pilot_xds_lds_reject{err="InvalidArgument",node="sidecar~10.0.0.2~b.default~default.svc.cluster.local"} 1
+pilot_total_xds_rejects 3
+`
+	want := map[string]string{
+		"sidecar~10.0.0.1~a.default~default.svc.cluster.local": "cds: InvalidArgument, eds: Internal",
+		"sidecar~10.0.0.2~b.default~default.svc.cluster.local": "lds: InvalidArgument",
+	}
+	got := parseRejects([]byte(metrics))
+	if len(got) != len(want) {
+		t.Fatalf("parseRejects() = %v, want %v", got, want)
+	}
+	for node, codes := range want {
+		if got[node] != codes {
+			t.Errorf("parseRejects()[%s] = %q, want %q", node, got[node], codes)
+		}
+	}
+}
@@ -1,27 +1,141 @@
 package cmd
 
 import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	any "github.com/golang/protobuf/ptypes/any"
 	"github.com/spf13/cobra"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
 )
 
 func rds() *cobra.Command {
 	handler := &rdsHandler{}
 	localCmd := makeXDSCmd("rds", handler)
 	localCmd.Flags().StringArrayVarP(&handler.resources, "resources", "r", nil, "Resources to show")
+	localCmd.Flags().StringVarP(&handler.source, "source", "", "", "Show only routes with substring of the Istio config that generated them")
 	return localCmd
 }
 
 type rdsHandler struct {
 	resources []string
+	source    string
 }
 
-func (c *rdsHandler) makeRequest(pod *PodInfo) *xdsapi.DiscoveryRequest {
-	return pod.appendResources(pod.makeRequest("rds"), c.resources)
+func (c *rdsHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	return newRequest(pod, "rds", c.resources...)
+}
+
+// filter returns the route configuration with only the routes generated by the source, or nil if
+// there are none. Other fields of the configuration and of its virtual hosts are kept.
+func (c *rdsHandler) filter(rc *xdsapi.RouteConfiguration) *xdsapi.RouteConfiguration {
+	newRC := proto.Clone(rc).(*xdsapi.RouteConfiguration)
+	newRC.VirtualHosts = nil
+	for _, vh := range rc.VirtualHosts {
+		newVH := proto.Clone(vh).(*route.VirtualHost)
+		newVH.Routes = nil
+		for _, r := range vh.Routes {
+			if matchSource(c.source, []string{retrieveIstioSource(r.Metadata)}) {
+				newVH.Routes = append(newVH.Routes, r)
+			}
+		}
+		if len(newVH.Routes) != 0 {
+			newRC.VirtualHosts = append(newRC.VirtualHosts, newVH)
+		}
+	}
+	if len(newRC.VirtualHosts) == 0 {
+		return nil
+	}
+	return newRC
 }
 
 func (c *rdsHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
-	outputJSON(resp)
+	if c.source == "" {
+		c.output(resp)
+		return nil
+	}
+	filterResp := &xdsapi.DiscoveryResponse{
+		VersionInfo: resp.VersionInfo,
+		TypeUrl:     resp.TypeUrl,
+		Resources:   []*any.Any{},
+	}
+	for _, res := range resp.Resources {
+		rc := &xdsapi.RouteConfiguration{}
+		if err := ptypes.UnmarshalAny(res, rc); err != nil {
+			log.Errorf("Cannot unmarshal any proto to route configuration: %v", err)
+			continue
+		}
+		if filterRC := c.filter(rc); filterRC != nil {
+			if r, err := ptypes.MarshalAny(filterRC); err != nil {
+				log.Errorf("Cannot marshal route configuration to any proto: %v", err)
+			} else {
+				filterResp.Resources = append(filterResp.Resources, r)
+			}
+		}
+	}
+	if len(filterResp.Resources) == 0 {
+		return fmt.Errorf("Cannot find route matching conditions. Seen routes:\n%s", c.outputShort(resp))
+	}
+	c.output(filterResp)
 	return nil
 }
+
+func (c *rdsHandler) output(resp *xdsapi.DiscoveryResponse) {
+	if outputFormat == "json" {
+		outputResponseJSON(resp)
+		return
+	}
+
+	fmt.Println(c.outputShort(resp))
+}
+
+// retrieveRouteDestination returns the clusters, redirect or direct response of the route.
+func retrieveRouteDestination(r *route.Route) string {
+	switch action := r.GetAction().(type) {
+	case *route.Route_Route:
+		var clusters []string
+		for _, wc := range retrieveRouteClusters(action.Route, nil) {
+			clusters = append(clusters, wc.name)
+		}
+		if len(clusters) == 0 {
+			return "-"
+		}
+		return strings.Join(clusters, ",")
+	case *route.Route_Redirect:
+		return "redirect"
+	case *route.Route_DirectResponse:
+		return fmt.Sprintf("direct response %d", action.DirectResponse.GetStatus())
+	}
+	return "-"
+}
+
+func (c *rdsHandler) outputShort(resp *xdsapi.DiscoveryResponse) string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVIRTUAL HOST\tROUTE\tDESTINATION\tSOURCE")
+	for _, res := range resp.Resources {
+		rc := &xdsapi.RouteConfiguration{}
+		if err := ptypes.UnmarshalAny(res, rc); err != nil {
+			log.Errorf("Cannot unmarshal any proto to route configuration: %v", err)
+			continue
+		}
+		for _, vh := range rc.VirtualHosts {
+			for i, r := range vh.Routes {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", rc.Name, vh.Name, describeRoute(i, r), retrieveRouteDestination(r),
+					formatSources([]string{retrieveIstioSource(r.Metadata)}))
+			}
+		}
+	}
+	w.Flush()
+	return buf.String()
+}
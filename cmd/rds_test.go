@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"testing"
+
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/golang/protobuf/proto"
+	_struct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func TestRDSFilter(t *testing.T) {
+	withSource := func(r *route.Route, source string) *route.Route {
+		r.Metadata = &core1.Metadata{FilterMetadata: map[string]*_struct.Struct{
+			"istio": {Fields: map[string]*_struct.Value{"config": {Kind: &_struct.Value_StringValue{StringValue: source}}}},
+		}}
+		return r
+	}
+	reviews := withSource(newClusterRoute("/reviews", "outbound|9080||reviews.default.svc.cluster.local"),
+		"/apis/networking/v1alpha3/namespaces/default/virtual-service/reviews")
+	ratings := withSource(newClusterRoute("/ratings", "outbound|9080||ratings.default.svc.cluster.local"),
+		"/apis/networking/v1alpha3/namespaces/default/virtual-service/ratings")
+	rc := newRouteConfig("9080", reviews, ratings)
+	rc.ValidateClusters = &wrappers.BoolValue{Value: true}
+	rc.VirtualHosts[0].RequireTls = route.VirtualHost_ALL
+	rc.VirtualHosts[0].RetryPolicy = &route.RetryPolicy{RetryOn: "5xx"}
+	original := proto.Clone(rc)
+
+	got := (&rdsHandler{source: "virtual-service/default/reviews"}).filter(rc)
+	want := newRouteConfig("9080", reviews)
+	want.ValidateClusters = &wrappers.BoolValue{Value: true}
+	want.VirtualHosts[0].RequireTls = route.VirtualHost_ALL
+	want.VirtualHosts[0].RetryPolicy = &route.RetryPolicy{RetryOn: "5xx"}
+	if !proto.Equal(got, want) {
+		t.Errorf("filter() = %v, want %v", got, want)
+	}
+	if !proto.Equal(rc, original) {
+		t.Errorf("filter() changed the route configuration to %v", rc)
+	}
+
+	if got := (&rdsHandler{source: "productpage"}).filter(rc); got != nil {
+		t.Errorf("filter() = %v, want nil", got)
+	}
+}
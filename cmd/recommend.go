@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/spf13/cobra"
+
+	"istio.io/istio/pilot/pkg/model"
+
+	"xdscli/pkg/proxy"
+)
+
+func recommendSidecar() *cobra.Command {
+	var dependencies []string
+	var fromStats bool
+	localCmd := &cobra.Command{
+		Use:   "recommend-sidecar",
+		Short: "Generate a Sidecar resource limiting the proxy to the services it uses",
+		Long: "Find the outbound clusters the workload needs, either from --dependencies or from the upstream " +
+			"connection stats of its Envoy admin port, and print a Sidecar resource restricting egress hosts to " +
+			"them. The Sidecar is not applied, and pilot only scopes config with applied ones, so the reduction " +
+			"printed with it is an estimate: clusters are those of the current CDS response the egress hosts keep, " +
+			"and endpoints are requested from pilot for those clusters only.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(dependencies) == 0 && !fromStats {
+				fatalf("Either --dependencies or --from-stats is required")
+			}
+			pod := findProxy()
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
+			defer func() {
+				pilotClient.close()
+			}()
+			dump, err := fetchConfigDump(ctx, pilotClient, pod)
+			if err != nil {
+				fatalf("Cannot get config: %v", err)
+			}
+
+			used := map[string]bool{}
+			if fromStats {
+				clusters, err := fetchUsedClusters(ctx, pod)
+				if err != nil {
+					fatalf("Cannot get stats: %v", err)
+				}
+				for _, name := range clusters {
+					if direction, _, fqdn, _ := model.ParseSubsetKey(name); direction == model.TrafficDirectionOutbound {
+						used[string(fqdn)] = true
+					}
+				}
+			}
+			for _, dep := range dependencies {
+				for _, c := range dump.clusters {
+					if direction, _, fqdn, _ := model.ParseSubsetKey(c.Name); direction == model.TrafficDirectionOutbound &&
+						(string(fqdn) == dep || strings.HasPrefix(string(fqdn), dep+".")) {
+						used[string(fqdn)] = true
+					}
+				}
+			}
+
+			hosts := egressHosts(used)
+			estimate, err := estimateScopedConfig(ctx, pilotClient, pod, dump, hosts)
+			if err != nil {
+				fatalf("Cannot estimate scoped config: %v", err)
+			}
+			labels, err := proxy.Labels(resolveKubeConfigPath(kubeConfig), pod)
+			if err != nil {
+				fatalf("Cannot get labels of %s.%s: %v", pod.Name, pod.Namespace, err)
+			}
+			writeOutput(estimate + makeSidecarYAML(pod, labels, hosts))
+		},
+	}
+	localCmd.Flags().StringSliceVarP(&dependencies, "dependencies", "", nil,
+		"Hostnames of the services the workload calls, e.g. reviews.default or reviews.default.svc.cluster.local")
+	localCmd.Flags().BoolVarP(&fromStats, "from-stats", "", false,
+		"Find the services the workload calls from the upstream connection stats of its Envoy admin port")
+	return localCmd
+}
+
+// fetchUsedClusters returns the clusters the proxy opened at least one upstream connection to,
+// according to the stats of its admin port.
+func fetchUsedClusters(ctx context.Context, pod *proxy.Pod) ([]string, error) {
+	process, url, err := portForward(ctx, pod.Name, pod.Namespace, 15000)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = process.Kill() }()
+
+	body, err := httpGet(ctx, fmt.Sprintf("http://%s/stats?filter=upstream_cx_total", url))
+	if err != nil {
+		return nil, err
+	}
+	return parseUsedClusters(bytes.NewReader(body))
+}
+
+// parseUsedClusters reads lines such as "cluster.outbound|9080||reviews.default.svc.cluster.local.upstream_cx_total: 3"
+// and returns the clusters with a non zero count.
+func parseUsedClusters(r io.Reader) ([]string, error) {
+	var clusters []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndex(line, ": ")
+		if i < 0 {
+			continue
+		}
+		stat, value := line[:i], line[i+2:]
+		if !strings.HasPrefix(stat, "cluster.") || !strings.HasSuffix(stat, ".upstream_cx_total") {
+			continue
+		}
+		if count, err := strconv.Atoi(value); err != nil || count == 0 {
+			continue
+		}
+		clusters = append(clusters, strings.TrimSuffix(strings.TrimPrefix(stat, "cluster."), ".upstream_cx_total"))
+	}
+	return clusters, scanner.Err()
+}
+
+// egressHosts converts service hostnames to Sidecar egress hosts (namespace/host). The istio-system
+// namespace is always kept for the control plane and telemetry.
+func egressHosts(used map[string]bool) []string {
+	hosts := []string{"istio-system/*"}
+	for fqdn := range used {
+		namespace := "*"
+		if parts := strings.Split(fqdn, "."); len(parts) > 2 && strings.HasSuffix(fqdn, ".svc.cluster.local") {
+			namespace = parts[1]
+		}
+		if namespace == "istio-system" {
+			continue
+		}
+		hosts = append(hosts, namespace+"/"+fqdn)
+	}
+	sort.Strings(hosts[1:])
+	return hosts
+}
+
+// egressHostMatch returns true if the cluster would still be pushed to the proxy with the egress hosts.
+func egressHostMatch(hosts []string, cluster string) bool {
+	direction, _, fqdn, _ := model.ParseSubsetKey(cluster)
+	if direction != model.TrafficDirectionOutbound {
+		// Inbound, BlackHoleCluster, PassthroughCluster etc. are not scoped by Sidecar egress.
+		return true
+	}
+	for _, host := range hosts {
+		parts := strings.SplitN(host, "/", 2)
+		if parts[1] == string(fqdn) || (parts[1] == "*" && strings.HasSuffix(string(fqdn), "."+parts[0]+".svc.cluster.local")) {
+			return true
+		}
+	}
+	return false
+}
+
+// estimateScopedConfig compares the clusters and endpoints currently sent to the proxy with the ones
+// left by the egress hosts. Pilot cannot be asked for CDS with a Sidecar that is not applied, so the
+// scoped clusters are estimated locally with egressHostMatch. Endpoints are re-requested for the
+// remaining clusters only. The result is formatted as YAML comments.
+func estimateScopedConfig(ctx context.Context, c *PilotClient, pod *proxy.Pod, dump *configDump, hosts []string) (string, error) {
+	var clusterBytes, scopedClusterBytes, scopedClusters int
+	var scopedEDSNames []string
+	for _, cluster := range dump.clusters {
+		size := proto.Size(cluster)
+		clusterBytes += size
+		if !egressHostMatch(hosts, cluster.Name) {
+			continue
+		}
+		scopedClusters++
+		scopedClusterBytes += size
+		if cluster.GetType() == xdsapi.Cluster_EDS {
+			scopedEDSNames = append(scopedEDSNames, retrieveEDSServiceName(cluster))
+		}
+	}
+	var endpointBytes, scopedEndpointBytes int
+	for _, cla := range dump.endpoints {
+		endpointBytes += proto.Size(cla)
+	}
+	if len(scopedEDSNames) != 0 {
+		sort.Strings(scopedEDSNames)
+		resp, err := c.fetch(ctx, newRequest(pod, "eds", scopedEDSNames...))
+		if err != nil {
+			return "", err
+		}
+		// Measured decoded, as the current endpoints are.
+		for _, r := range resp.Resources {
+			cla := &xdsapi.ClusterLoadAssignment{}
+			if err := ptypes.UnmarshalAny(r, cla); err != nil {
+				return "", fmt.Errorf("cannot unmarshal any proto to cluster load assignment: %v", err)
+			}
+			scopedEndpointBytes += proto.Size(cla)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Estimated effect on %s.%s once applied:\n", pod.Name, pod.Namespace)
+	fmt.Fprintf(&buf, "#   clusters:        %d -> %d (local estimate)\n", len(dump.clusters), scopedClusters)
+	fmt.Fprintf(&buf, "#   CDS bytes:       %d -> %d (local estimate)\n", clusterBytes, scopedClusterBytes)
+	fmt.Fprintf(&buf, "#   EDS bytes:       %d -> %d (requested from pilot)\n", endpointBytes, scopedEndpointBytes)
+	return buf.String(), nil
+}
+
+// makeSidecarYAML returns a Sidecar resource selecting the workload by its app label, or applying
+// to the whole namespace if it has none.
+func makeSidecarYAML(pod *proxy.Pod, labels map[string]string, hosts []string) string {
+	var buf bytes.Buffer
+	name := pod.Name
+	app, hasApp := labels["app"]
+	if hasApp {
+		name = app
+	}
+	if !hasApp {
+		fmt.Fprintf(&buf, "# %s has no app label: this Sidecar applies to every workload of the namespace.\n", pod.Name)
+	}
+	fmt.Fprintf(&buf, "apiVersion: networking.istio.io/v1alpha3\n")
+	fmt.Fprintf(&buf, "kind: Sidecar\n")
+	fmt.Fprintf(&buf, "metadata:\n")
+	fmt.Fprintf(&buf, "  name: %s\n", name)
+	fmt.Fprintf(&buf, "  namespace: %s\n", pod.Namespace)
+	fmt.Fprintf(&buf, "spec:\n")
+	if hasApp {
+		fmt.Fprintf(&buf, "  workloadSelector:\n")
+		fmt.Fprintf(&buf, "    labels:\n")
+		fmt.Fprintf(&buf, "      app: %s\n", app)
+	}
+	fmt.Fprintf(&buf, "  egress:\n")
+	fmt.Fprintf(&buf, "  - hosts:\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&buf, "    - %q\n", host)
+	}
+	return buf.String()
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	any "github.com/golang/protobuf/ptypes/any"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+)
+
+// xdsType is a type of resource that can be requested by its short name, and how to show it.
+type xdsType struct {
+	// Short name, e.g. lds.
+	name    string
+	typeURL string
+	// Formats the response as a table. If nil, the resources are listed by name and size.
+	outputShort func(resp *xdsapi.DiscoveryResponse) string
+}
+
+// xdsTypes is the registry of types known by name: adding an entry makes the type available to get
+// and --nack-type. Other types can still be requested by type URL. Resources whose message is not
+// linked in are shown raw.
+var xdsTypes = []*xdsType{
+	{name: "lds", typeURL: v2.ListenerType, outputShort: (&ldsHandler{}).outputShort},
+	{name: "cds", typeURL: v2.ClusterType, outputShort: (&cdsHandler{}).outputShort},
+	{name: "rds", typeURL: v2.RouteType, outputShort: (&rdsHandler{}).outputShort},
+	{name: "eds", typeURL: v2.EndpointType},
+	{name: "sds", typeURL: cache.SecretType, outputShort: (&sdsHandler{expiryWarning: time.Hour}).outputShort},
+	{name: "rtds", typeURL: cache.RuntimeType},
+	{name: "srds", typeURL: "type.googleapis.com/envoy.api.v2.ScopedRouteConfiguration"},
+	// Not served by the pilot versions this tool is built against, so shown raw.
+	{name: "ecds", typeURL: "type.googleapis.com/envoy.config.core.v3.TypedExtensionConfig"},
+	{name: "nds", typeURL: "type.googleapis.com/istio.networking.nds.v1.NameTable"},
+}
+
+// lookupXDSType returns the registered type with the short name or type URL, or nil.
+func lookupXDSType(nameOrURL string) *xdsType {
+	for _, t := range xdsTypes {
+		if t.name == nameOrURL || t.typeURL == nameOrURL {
+			return t
+		}
+	}
+	return nil
+}
+
+func xdsTypeNames() string {
+	var names []string
+	for _, t := range xdsTypes {
+		names = append(names, t.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// parseTypeURL returns the type URL of a registered short name. Type URLs are returned as is.
+func parseTypeURL(configType string) (string, error) {
+	if t := lookupXDSType(configType); t != nil {
+		return t.typeURL, nil
+	}
+	if strings.Contains(configType, "/") {
+		return configType, nil
+	}
+	return "", fmt.Errorf("unknown type %q, use one of %s or a type URL", configType, xdsTypeNames())
+}
+
+// configTypeToTypeURL is like parseTypeURL, but exits on unknown types.
+func configTypeToTypeURL(configType string) string {
+	typeURL, err := parseTypeURL(configType)
+	if err != nil {
+		fatalf("Cannot resolve type: %v", err)
+	}
+	return typeURL
+}
+
+// configTypeShortName returns the short name of the type URL, or the type URL if not registered.
+func configTypeShortName(typeURL string) string {
+	if t := lookupXDSType(typeURL); t != nil {
+		return t.name
+	}
+	return typeURL
+}
+
+// canDecode returns true if the message type of the resource is linked in, so that it can be
+// unmarshalled and converted to JSON.
+func canDecode(res *any.Any) bool {
+	name, err := ptypes.AnyMessageName(res)
+	return err == nil && proto.MessageType(name) != nil
+}
+
+// retrieveResourceName returns the name of a resource of any type, or "-" if it cannot be decoded or
+// has no name.
+func retrieveResourceName(res *any.Any) string {
+	if !canDecode(res) {
+		return "-"
+	}
+	var msg ptypes.DynamicAny
+	if err := ptypes.UnmarshalAny(res, &msg); err != nil {
+		return "-"
+	}
+	if name := cache.GetResourceName(msg.Message); name != "" {
+		return name
+	}
+	if named, ok := msg.Message.(interface{ GetName() string }); ok && named.GetName() != "" {
+		return named.GetName()
+	}
+	return "-"
+}
+
+// outputResourceNames lists the resources of a type without its own table by name and size.
+func outputResourceNames(resp *xdsapi.DiscoveryResponse) string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tSIZE")
+	resources := append([]*any.Any{}, resp.Resources...)
+	sort.SliceStable(resources, func(i, j int) bool {
+		return retrieveResourceName(resources[i]) < retrieveResourceName(resources[j])
+	})
+	for _, res := range resources {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", retrieveResourceName(res), configTypeShortName(res.TypeUrl), formatSize(proto.Size(res)))
+	}
+	w.Flush()
+	return buf.String()
+}
@@ -1,7 +1,11 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
+
+	"xdscli/pkg/xdsclient"
 )
 
 var (
@@ -24,6 +28,25 @@ var (
 
 	// short (default) or json
 	outputFormat string
+
+	// If set, NACK responses with resources that fail validation.
+	nackOnInvalid bool
+
+	// NACKs to inject to test pilot.
+	nack nackOptions
+
+	// File to read subscription changes from while watching, "-" for stdin.
+	subscriptionChanges string
+
+	// How long to wait for the first response of a request, and for the connection to pilot.
+	timeout        time.Duration
+	connectTimeout time.Duration
+
+	// Largest response accepted, in bytes.
+	maxRecvMsgSize int
+
+	// Interval of keepalive pings to pilot, and the shortest one accepted by serve.
+	keepaliveTime time.Duration
 )
 
 func init() {
@@ -32,13 +55,40 @@ func init() {
 	RootCmd.PersistentFlags().BoolVarP(&streaming, "watch", "w", false, "After listing/getting the requested object, watch for changes.")
 	RootCmd.PersistentFlags().StringVarP(&proxyTag, "proxytag", "t", "", "Pod name or app label or istio label to identify the proxy.")
 	RootCmd.PersistentFlags().StringVarP(&proxyType, "proxytype", "", "sidecar", "router or sidecar. Default sidecar")
-	RootCmd.PersistentFlags().StringVarP(&outputFile, "file", "f", "", "output file. Leave blank to go to stdout")
+	RootCmd.PersistentFlags().StringVarP(&outputFile, "file", "f", "", "output file. Leave blank to go to stdout. With --watch, every response is appended to it")
 	RootCmd.PersistentFlags().StringVarP(&outputFormat, "out", "o", "json", "output format. Accepted values: short, json (default)")
+	RootCmd.PersistentFlags().IntVarP(&nack.response, "nack", "", 0, "NACK the Nth response (1-based, use --watch for N > 1) to test how pilot reacts. 0 to disable.")
+	RootCmd.PersistentFlags().VarP(&nackTypeFlag{options: &nack}, "nack-type", "", "NACK every response of this type (lds, cds, rds, eds, or any type of get).")
+	RootCmd.PersistentFlags().StringVarP(&nack.message, "nack-message", "", "NACK injected by xdscli", "Error message sent with injected NACKs.")
+	RootCmd.PersistentFlags().DurationVarP(&nack.wait, "nack-wait", "", 10*time.Second, "How long to wait for pilot to respond to a NACK.")
+	RootCmd.PersistentFlags().StringVarP(&nack.debugURL, "nack-syncz", "", "", "Pilot debug address (port 15014). If set, query /debug/syncz after each NACK.")
+	RootCmd.PersistentFlags().StringVarP(&subscriptionChanges, "subscribe-from", "", "",
+		"With --watch on eds or rds, read subscription changes (+name or -name per line) from this file, or - for stdin.")
+	RootCmd.PersistentFlags().DurationVarP(&timeout, "timeout", "", 30*time.Second, "How long to wait for pilot to respond to a request. 0 to wait forever.")
+	RootCmd.PersistentFlags().DurationVarP(&connectTimeout, "connect-timeout", "", 10*time.Second, "How long to wait for the connection to pilot. 0 to wait forever.")
+	RootCmd.PersistentFlags().IntVarP(&maxRecvMsgSize, "max-recv-msg-size", "", 512*1024*1024, "Largest xDS response accepted, in bytes. gRPC defaults to 4MB, which large meshes exceed.")
+	RootCmd.PersistentFlags().DurationVarP(&keepaliveTime, "keepalive", "", xdsclient.DefaultKeepaliveTime,
+		"Interval of keepalive pings on xDS streams. Pilot closes connections pinged more often than every 5m.")
+	RootCmd.PersistentFlags().BoolVarP(&nackOnInvalid, "nack-on-invalid", "", false, "NACK responses with resources that fail validation, instead of ACKing them.")
 	
 	RootCmd.AddCommand(lds())
 	RootCmd.AddCommand(cds())
 	RootCmd.AddCommand(eds())
 	RootCmd.AddCommand(rds())
+	RootCmd.AddCommand(sds())
+	RootCmd.AddCommand(tlsReport())
+	RootCmd.AddCommand(authz())
+	RootCmd.AddCommand(get())
+	RootCmd.AddCommand(serve())
+	RootCmd.AddCommand(trace())
+	RootCmd.AddCommand(analyze())
+	RootCmd.AddCommand(bench())
+	RootCmd.AddCommand(convergence())
+	RootCmd.AddCommand(sizes())
+	RootCmd.AddCommand(recommendSidecar())
+	RootCmd.AddCommand(proxies())
+	RootCmd.AddCommand(clientStatus())
+	RootCmd.AddCommand(conformance())
 }
 
 // RootCmd is the root command line.
@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/spf13/cobra"
+
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+)
+
+func sds() *cobra.Command {
+	handler := &sdsHandler{}
+	localCmd := makeXDSCmd("sds", handler)
+	localCmd.Short = "Show the certificates of SDS secrets"
+	localCmd.Long = "Request secrets and decode their X.509 certificates: subject, SPIFFE ID, issuer, validity and key. " +
+		"Expired or soon expiring certificates, chains not signed by the root of the response and SPIFFE IDs of " +
+		"another trust domain are flagged."
+	localCmd.Flags().StringArrayVarP(&handler.resources, "resources", "r", []string{"default", "ROOTCA"}, "Secrets to show")
+	localCmd.Flags().StringVarP(&handler.trustDomain, "trust-domain", "", "",
+		"Expected trust domain of SPIFFE IDs. Leave blank to expect the one of the first certificate")
+	localCmd.Flags().DurationVarP(&handler.expiryWarning, "expiry-warning", "", time.Hour,
+		"Flag certificates expiring within this duration")
+	return localCmd
+}
+
+type sdsHandler struct {
+	resources     []string
+	trustDomain   string
+	expiryWarning time.Duration
+}
+
+func (c *sdsHandler) makeRequest(pod *proxy.Pod) *xdsapi.DiscoveryRequest {
+	return newRequest(pod, "sds", c.resources...)
+}
+
+func (c *sdsHandler) onXDSResponse(resp *xdsapi.DiscoveryResponse) error {
+	secrets := c.secretReports(resp)
+	for _, s := range secrets {
+		for _, cert := range s.Certificates {
+			for _, p := range cert.Problems {
+				log.Warnf("Secret %s, certificate %s: %s", s.Name, cert.displayName(), p)
+			}
+		}
+		for _, p := range s.Problems {
+			log.Warnf("Secret %s: %s", s.Name, p)
+		}
+	}
+
+	if outputFormat == "json" {
+		output, err := json.MarshalIndent(secrets, "", "  ")
+		if err != nil {
+			return err
+		}
+		writeOutput(string(output))
+		return nil
+	}
+	fmt.Println(outputSecrets(secrets))
+	return nil
+}
+
+func (c *sdsHandler) outputShort(resp *xdsapi.DiscoveryResponse) string {
+	return outputSecrets(c.secretReports(resp))
+}
+
+// secretReports decodes and checks the secrets of the response.
+func (c *sdsHandler) secretReports(resp *xdsapi.DiscoveryResponse) []*secretReport {
+	var secrets []*secretReport
+	for _, res := range resp.Resources {
+		secret := &auth.Secret{}
+		if err := ptypes.UnmarshalAny(res, secret); err != nil {
+			log.Errorf("Cannot unmarshal any proto to secret: %v", err)
+			continue
+		}
+		secrets = append(secrets, newSecretReport(secret))
+	}
+	checkSecrets(secrets, c.trustDomain, c.expiryWarning, time.Now())
+	return secrets
+}
+
+// secretReport is a secret with its certificates decoded.
+type secretReport struct {
+	Name string `json:"name"`
+	// tlsCertificate, validationContext, sessionTicketKeys or genericSecret.
+	Type         string             `json:"type"`
+	Certificates []*certificateInfo `json:"certificates,omitempty"`
+	Problems     []string           `json:"problems,omitempty"`
+
+	chain []*x509.Certificate
+}
+
+type certificateInfo struct {
+	// leaf, intermediate or root.
+	Role      string    `json:"role"`
+	Subject   string    `json:"subject"`
+	SpiffeIDs []string  `json:"spiffeIds,omitempty"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	ExpiresIn string    `json:"expiresIn"`
+	KeyType   string    `json:"keyType"`
+	// SHA-256 of the certificate, as shown by openssl x509 -fingerprint -sha256.
+	Fingerprint string   `json:"fingerprint"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+func newSecretReport(secret *auth.Secret) *secretReport {
+	s := &secretReport{Name: secret.Name}
+	var source *core1.DataSource
+	switch t := secret.Type.(type) {
+	case *auth.Secret_TlsCertificate:
+		s.Type = "tlsCertificate"
+		source = t.TlsCertificate.GetCertificateChain()
+	case *auth.Secret_ValidationContext:
+		s.Type = "validationContext"
+		source = t.ValidationContext.GetTrustedCa()
+	case *auth.Secret_SessionTicketKeys:
+		s.Type = "sessionTicketKeys"
+		return s
+	case *auth.Secret_GenericSecret:
+		s.Type = "genericSecret"
+		return s
+	default:
+		s.Problems = append(s.Problems, "no secret")
+		return s
+	}
+
+	var data []byte
+	switch {
+	case source.GetFilename() != "":
+		s.Problems = append(s.Problems, fmt.Sprintf("certificates are read by the proxy from %s", source.GetFilename()))
+		return s
+	case len(source.GetInlineBytes()) != 0:
+		data = source.GetInlineBytes()
+	default:
+		data = []byte(source.GetInlineString())
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			s.Problems = append(s.Problems, fmt.Sprintf("cannot parse certificate: %v", err))
+			continue
+		}
+		s.chain = append(s.chain, cert)
+		s.Certificates = append(s.Certificates, newCertificateInfo(cert))
+	}
+	if len(s.Certificates) == 0 {
+		s.Problems = append(s.Problems, "no PEM certificate")
+	}
+	return s
+}
+
+func newCertificateInfo(cert *x509.Certificate) *certificateInfo {
+	info := &certificateInfo{
+		Role:        "leaf",
+		Subject:     cert.Subject.String(),
+		DNSNames:    cert.DNSNames,
+		Issuer:      cert.Issuer.String(),
+		Serial:      cert.SerialNumber.Text(16),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		KeyType:     retrieveKeyType(cert),
+		Fingerprint: retrieveFingerprint(cert),
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			info.SpiffeIDs = append(info.SpiffeIDs, uri.String())
+		}
+	}
+	if cert.IsCA {
+		info.Role = "intermediate"
+		if bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil {
+			info.Role = "root"
+		}
+	}
+	return info
+}
+
+// displayName identifies the certificate by its subject, or its SPIFFE ID as workload certificates
+// usually have an empty subject.
+func (info *certificateInfo) displayName() string {
+	if info.Subject != "" {
+		return info.Subject
+	}
+	if len(info.SpiffeIDs) != 0 {
+		return info.SpiffeIDs[0]
+	}
+	return "serial " + info.Serial
+}
+
+func retrieveKeyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+func retrieveFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// spiffeTrustDomain returns the trust domain of a spiffe://<trust domain>/<path> ID.
+func spiffeTrustDomain(id string) string {
+	u, err := url.Parse(id)
+	if err != nil || u.Scheme != "spiffe" {
+		return ""
+	}
+	return u.Host
+}
+
+// checkSecrets records the problems of the certificates: validity at now, SPIFFE IDs of another
+// trust domain, and certificate chains that are not signed by a root of the validation contexts.
+func checkSecrets(secrets []*secretReport, trustDomain string, expiryWarning time.Duration, now time.Time) {
+	roots := x509.NewCertPool()
+	hasRoots := false
+	for _, s := range secrets {
+		if s.Type != "validationContext" {
+			continue
+		}
+		for _, cert := range s.chain {
+			roots.AddCert(cert)
+			hasRoots = true
+		}
+	}
+
+	for _, s := range secrets {
+		for _, info := range s.Certificates {
+			info.ExpiresIn = formatExpiresIn(info.NotAfter.Sub(now))
+			switch {
+			case now.After(info.NotAfter):
+				info.Problems = append(info.Problems, fmt.Sprintf("expired on %s", info.NotAfter.Format(time.RFC3339)))
+			case now.Before(info.NotBefore):
+				info.Problems = append(info.Problems, fmt.Sprintf("not valid before %s", info.NotBefore.Format(time.RFC3339)))
+			case info.NotAfter.Sub(now) < expiryWarning:
+				info.Problems = append(info.Problems, fmt.Sprintf("expires in %s", info.ExpiresIn))
+			}
+			for _, id := range info.SpiffeIDs {
+				domain := spiffeTrustDomain(id)
+				if trustDomain == "" {
+					trustDomain = domain
+				}
+				if domain != trustDomain {
+					info.Problems = append(info.Problems, fmt.Sprintf("trust domain %q of %s, expected %q", domain, id, trustDomain))
+				}
+			}
+		}
+
+		if s.Type != "tlsCertificate" || len(s.chain) == 0 || !hasRoots {
+			continue
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range s.chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := s.chain[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			s.Problems = append(s.Problems, fmt.Sprintf("chain not verified by the roots of the response: %v", err))
+		}
+	}
+}
+
+// formatExpiresIn formats the time left, in days if more than 2, e.g. 364d, 23h59m or -1h5m.
+func formatExpiresIn(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	if s := strings.TrimSuffix(d.Truncate(time.Minute).String(), "0s"); s != "" {
+		return s
+	}
+	// Less than a minute.
+	return "0m"
+}
+
+func outputSecrets(secrets []*secretReport) string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "SECRET\tROLE\tSUBJECT\tSPIFFE ID\tISSUER\tEXPIRES IN\tKEY\tSTATUS")
+	var roots []*certificateInfo
+	seenRoots := map[string]bool{}
+	for _, s := range secrets {
+		if len(s.Certificates) == 0 {
+			status := strings.Join(s.Problems, ", ")
+			if status == "" {
+				status = "OK"
+			}
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t%s\n", s.Name, s.Type, status)
+			continue
+		}
+		for i, cert := range s.Certificates {
+			problems := cert.Problems
+			if i == 0 {
+				problems = append(append([]string{}, problems...), s.Problems...)
+			}
+			status := "OK"
+			if len(problems) != 0 {
+				status = strings.Join(problems, ", ")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, cert.Role, orDash(cert.Subject),
+				orDash(strings.Join(cert.SpiffeIDs, ",")), orDash(cert.Issuer), cert.ExpiresIn, cert.KeyType, status)
+			if cert.Role == "root" && !seenRoots[cert.Fingerprint] {
+				seenRoots[cert.Fingerprint] = true
+				roots = append(roots, cert)
+			}
+		}
+	}
+	w.Flush()
+	if len(roots) != 0 {
+		buf.WriteString("\n")
+		w = new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+		fmt.Fprintln(w, "ROOT\tSHA-256 FINGERPRINT")
+		for _, root := range roots {
+			fmt.Fprintf(w, "%s\t%s\n", orDash(root.Subject), root.Fingerprint)
+		}
+		w.Flush()
+	}
+	return buf.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+var sdsTestNow = time.Date(2020, 2, 18, 12, 0, 0, 0, time.UTC)
+
+// testCert is a certificate with its key, to sign other certificates.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate valid from notBefore to notAfter, signed by the parent, or self
+// signed if nil. The leaf has the SPIFFE ID if set.
+func newTestCert(t *testing.T, parent *testCert, cn string, isCA bool, spiffeID string, notBefore, notAfter time.Time) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"cluster.local"}},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.ExtKeyUsage = nil
+	}
+	if spiffeID != "" {
+		u, err := url.Parse(spiffeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = []*url.URL{u}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func encodePEM(certs ...*testCert) []byte {
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	return data
+}
+
+func newTLSCertificateSecret(name string, data []byte) *auth.Secret {
+	return &auth.Secret{Name: name, Type: &auth.Secret_TlsCertificate{TlsCertificate: &auth.TlsCertificate{
+		CertificateChain: &core1.DataSource{Specifier: &core1.DataSource_InlineBytes{InlineBytes: data}},
+	}}}
+}
+
+func newValidationContextSecret(name string, data []byte) *auth.Secret {
+	return &auth.Secret{Name: name, Type: &auth.Secret_ValidationContext{ValidationContext: &auth.CertificateValidationContext{
+		TrustedCa: &core1.DataSource{Specifier: &core1.DataSource_InlineBytes{InlineBytes: data}},
+	}}}
+}
+
+// testPKI is a root, an intermediate CA and a workload certificate valid at sdsTestNow.
+type testPKI struct {
+	root, intermediate, leaf *testCert
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	year := 365 * 24 * time.Hour
+	root := newTestCert(t, nil, "root", true, "", sdsTestNow.Add(-year), sdsTestNow.Add(10*year))
+	intermediate := newTestCert(t, root, "intermediate", true, "", sdsTestNow.Add(-year), sdsTestNow.Add(5*year))
+	leaf := newTestCert(t, intermediate, "", false, "spiffe://cluster.local/ns/default/sa/sleep",
+		sdsTestNow.Add(-time.Hour), sdsTestNow.Add(23*time.Hour))
+	return &testPKI{root: root, intermediate: intermediate, leaf: leaf}
+}
+
+func TestNewSecretReport(t *testing.T) {
+	pki := newTestPKI(t)
+	keyBlock := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("key")})
+	cases := []struct {
+		name         string
+		secret       *auth.Secret
+		wantType     string
+		wantRoles    []string
+		wantProblems []string
+	}{
+		{
+			name:      "workload certificate chain",
+			secret:    newTLSCertificateSecret("default", encodePEM(pki.leaf, pki.intermediate)),
+			wantType:  "tlsCertificate",
+			wantRoles: []string{"leaf", "intermediate"},
+		},
+		{
+			name:      "root",
+			secret:    newValidationContextSecret("ROOTCA", encodePEM(pki.root)),
+			wantType:  "validationContext",
+			wantRoles: []string{"root"},
+		},
+		{
+			name:      "other PEM blocks are skipped",
+			secret:    newTLSCertificateSecret("default", append(keyBlock, encodePEM(pki.leaf)...)),
+			wantType:  "tlsCertificate",
+			wantRoles: []string{"leaf"},
+		},
+		{
+			name:         "no PEM",
+			secret:       newTLSCertificateSecret("default", []byte("not PEM")),
+			wantType:     "tlsCertificate",
+			wantProblems: []string{"no PEM certificate"},
+		},
+		{
+			name:         "invalid certificate",
+			secret:       newTLSCertificateSecret("default", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")})),
+			wantType:     "tlsCertificate",
+			wantProblems: []string{"cannot parse certificate", "no PEM certificate"},
+		},
+		{
+			name: "file",
+			secret: &auth.Secret{Name: "default", Type: &auth.Secret_TlsCertificate{TlsCertificate: &auth.TlsCertificate{
+				CertificateChain: &core1.DataSource{Specifier: &core1.DataSource_Filename{Filename: "/etc/certs/cert-chain.pem"}},
+			}}},
+			wantType:     "tlsCertificate",
+			wantProblems: []string{"read by the proxy from /etc/certs/cert-chain.pem"},
+		},
+		{
+			name:     "session ticket keys",
+			secret:   &auth.Secret{Name: "tickets", Type: &auth.Secret_SessionTicketKeys{SessionTicketKeys: &auth.TlsSessionTicketKeys{}}},
+			wantType: "sessionTicketKeys",
+		},
+		{
+			name:         "empty",
+			secret:       &auth.Secret{Name: "empty"},
+			wantProblems: []string{"no secret"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newSecretReport(c.secret)
+			if s.Type != c.wantType {
+				t.Errorf("type = %q, want %q", s.Type, c.wantType)
+			}
+			var roles []string
+			for _, cert := range s.Certificates {
+				roles = append(roles, cert.Role)
+			}
+			if !reflect.DeepEqual(roles, c.wantRoles) {
+				t.Errorf("roles = %v, want %v", roles, c.wantRoles)
+			}
+			if len(s.Problems) != len(c.wantProblems) {
+				t.Fatalf("problems = %q, want %q", s.Problems, c.wantProblems)
+			}
+			for i, want := range c.wantProblems {
+				if !strings.Contains(s.Problems[i], want) {
+					t.Errorf("problem %q does not contain %q", s.Problems[i], want)
+				}
+			}
+		})
+	}
+
+	t.Run("certificate details", func(t *testing.T) {
+		s := newSecretReport(newTLSCertificateSecret("default", encodePEM(pki.leaf)))
+		info := s.Certificates[0]
+		if !reflect.DeepEqual(info.SpiffeIDs, []string{"spiffe://cluster.local/ns/default/sa/sleep"}) {
+			t.Errorf("SPIFFE IDs = %v", info.SpiffeIDs)
+		}
+		if info.KeyType != "ECDSA P-256" {
+			t.Errorf("key type = %q, want ECDSA P-256", info.KeyType)
+		}
+		if info.Issuer != pki.intermediate.cert.Subject.String() {
+			t.Errorf("issuer = %q, want %q", info.Issuer, pki.intermediate.cert.Subject)
+		}
+		if len(info.Fingerprint) != 32*3-1 {
+			t.Errorf("fingerprint %q is not 32 hex bytes", info.Fingerprint)
+		}
+	})
+}
+
+func TestCheckSecrets(t *testing.T) {
+	pki := newTestPKI(t)
+	year := 365 * 24 * time.Hour
+	otherRoot := newTestCert(t, nil, "other root", true, "", sdsTestNow.Add(-year), sdsTestNow.Add(year))
+	leaf := func(spiffeID string, notBefore, notAfter time.Time) *testCert {
+		return newTestCert(t, pki.intermediate, "", false, spiffeID, notBefore, notAfter)
+	}
+	const sleep = "spiffe://cluster.local/ns/default/sa/sleep"
+	cases := []struct {
+		name        string
+		chain       []*testCert
+		root        *testCert
+		trustDomain string
+		// Substrings of the problems of the leaf, and of the secret.
+		wantCertProblems   []string
+		wantSecretProblems []string
+	}{
+		{
+			name:  "valid",
+			chain: []*testCert{pki.leaf, pki.intermediate},
+			root:  pki.root,
+		},
+		{
+			name:             "expired",
+			chain:            []*testCert{leaf(sleep, sdsTestNow.Add(-48*time.Hour), sdsTestNow.Add(-time.Hour)), pki.intermediate},
+			root:             pki.root,
+			wantCertProblems: []string{"expired on 2020-02-18T11:00:00Z"},
+			// Verified at now too.
+			wantSecretProblems: []string{"chain not verified"},
+		},
+		{
+			name:               "not yet valid",
+			chain:              []*testCert{leaf(sleep, sdsTestNow.Add(time.Hour), sdsTestNow.Add(48*time.Hour)), pki.intermediate},
+			root:               pki.root,
+			wantCertProblems:   []string{"not valid before 2020-02-18T13:00:00Z"},
+			wantSecretProblems: []string{"chain not verified"},
+		},
+		{
+			name:             "expiring",
+			chain:            []*testCert{leaf(sleep, sdsTestNow.Add(-time.Hour), sdsTestNow.Add(30*time.Minute)), pki.intermediate},
+			root:             pki.root,
+			wantCertProblems: []string{"expires in 30m"},
+		},
+		{
+			name:        "expected trust domain",
+			chain:       []*testCert{pki.leaf, pki.intermediate},
+			root:        pki.root,
+			trustDomain: "cluster.local",
+		},
+		{
+			name:             "other trust domain",
+			chain:            []*testCert{pki.leaf, pki.intermediate},
+			root:             pki.root,
+			trustDomain:      "example.org",
+			wantCertProblems: []string{`trust domain "cluster.local" of spiffe://cluster.local/ns/default/sa/sleep, expected "example.org"`},
+		},
+		{
+			name:               "signed by another root",
+			chain:              []*testCert{pki.leaf, pki.intermediate},
+			root:               otherRoot,
+			wantSecretProblems: []string{"chain not verified by the roots of the response"},
+		},
+		{
+			name:               "missing intermediate",
+			chain:              []*testCert{pki.leaf},
+			root:               pki.root,
+			wantSecretProblems: []string{"chain not verified"},
+		},
+		{
+			name:  "no root to verify with",
+			chain: []*testCert{pki.leaf},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			secrets := []*secretReport{newSecretReport(newTLSCertificateSecret("default", encodePEM(c.chain...)))}
+			if c.root != nil {
+				secrets = append(secrets, newSecretReport(newValidationContextSecret("ROOTCA", encodePEM(c.root))))
+			}
+			checkSecrets(secrets, c.trustDomain, time.Hour, sdsTestNow)
+			checkProblems(t, "leaf", secrets[0].Certificates[0].Problems, c.wantCertProblems)
+			checkProblems(t, "secret", secrets[0].Problems, c.wantSecretProblems)
+		})
+	}
+
+	t.Run("trust domain of the first certificate", func(t *testing.T) {
+		other := leaf("spiffe://example.org/ns/default/sa/sleep", sdsTestNow.Add(-time.Hour), sdsTestNow.Add(23*time.Hour))
+		secrets := []*secretReport{
+			newSecretReport(newTLSCertificateSecret("default", encodePEM(pki.leaf))),
+			newSecretReport(newTLSCertificateSecret("other", encodePEM(other))),
+		}
+		checkSecrets(secrets, "", time.Hour, sdsTestNow)
+		checkProblems(t, "first", secrets[0].Certificates[0].Problems, nil)
+		checkProblems(t, "second", secrets[1].Certificates[0].Problems, []string{`expected "cluster.local"`})
+	})
+}
+
+func checkProblems(t *testing.T, what string, problems, want []string) {
+	t.Helper()
+	if len(problems) != len(want) {
+		t.Fatalf("%s problems = %q, want %q", what, problems, want)
+	}
+	for i, w := range want {
+		if !strings.Contains(problems[i], w) {
+			t.Errorf("%s problem %q does not contain %q", what, problems[i], w)
+		}
+	}
+}
+
+func TestFormatExpiresIn(t *testing.T) {
+	cases := []struct {
+		d    time.Duration
+		want string
+	}{
+		{364*24*time.Hour + time.Hour, "364d"},
+		{48 * time.Hour, "2d"},
+		{47*time.Hour + 59*time.Minute + 30*time.Second, "47h59m"},
+		{2 * time.Hour, "2h0m"},
+		{30 * time.Minute, "30m"},
+		{30 * time.Second, "0m"},
+		{-time.Hour - 5*time.Minute, "-1h5m"},
+	}
+	for _, c := range cases {
+		if got := formatExpiresIn(c.d); got != c.want {
+			t.Errorf("formatExpiresIn(%v) = %q, want %q", c.d, got, c.want)
+		}
+	}
+}
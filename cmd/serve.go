@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"net"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	ads "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/server"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+
+	"istio.io/pkg/log"
+)
+
+func serve() *cobra.Command {
+	var address string
+	var version string
+	localCmd := &cobra.Command{
+		Use:   "serve FILE...",
+		Short: "Serve saved xDS resources over ADS",
+		Long: "Start a local ADS server that serves the resources from saved lds/cds/rds/eds JSON output " +
+			"to every connecting node. Point a local Envoy or an xDS client under test at it to reproduce a config.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := commandContext()
+			defer cancel()
+			dump, err := loadConfigDump(args)
+			if err != nil {
+				fatalf("Cannot load config: %v", err)
+			}
+			log.Infof("Loaded %d listeners, %d clusters, %d routes and %d endpoints",
+				len(dump.listeners), len(dump.clusters), len(dump.routes), len(dump.endpoints))
+
+			// Not in ADS mode so that clients asking for a subset of (or more than) the recorded
+			// resources get a response right away, the same as from pilot.
+			snapshotCache := cache.NewSnapshotCache(false, anyNodeHash{}, log.FindScope(log.DefaultScopeName))
+			if err := snapshotCache.SetSnapshot("", dump.snapshot(version)); err != nil {
+				fatalf("Cannot set snapshot: %v", err)
+			}
+			xdsServer := server.NewServer(ctx, snapshotCache, nil)
+
+			// Accept the keepalive pings of xdscli clients, which pilot would also accept.
+			grpcServer := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+				MinTime: keepaliveTime,
+			}))
+			ads.RegisterAggregatedDiscoveryServiceServer(grpcServer, xdsServer)
+			xdsapi.RegisterListenerDiscoveryServiceServer(grpcServer, xdsServer)
+			xdsapi.RegisterClusterDiscoveryServiceServer(grpcServer, xdsServer)
+			xdsapi.RegisterRouteDiscoveryServiceServer(grpcServer, xdsServer)
+			xdsapi.RegisterEndpointDiscoveryServiceServer(grpcServer, xdsServer)
+
+			lis, err := net.Listen("tcp", address)
+			if err != nil {
+				fatalf("Cannot listen on %s: %v", address, err)
+			}
+			go func() {
+				<-ctx.Done()
+				grpcServer.Stop()
+			}()
+			log.Infof("Serving xDS on %s", lis.Addr())
+			if err := grpcServer.Serve(lis); err != nil {
+				fatalf("xDS server stopped: %v", err)
+			}
+		},
+	}
+	localCmd.Flags().StringVarP(&address, "address", "a", ":15010", "Address to listen on")
+	localCmd.Flags().StringVarP(&version, "version", "", "1", "Version info to report for the served resources")
+	return localCmd
+}
+
+// anyNodeHash maps every node to the same snapshot.
+type anyNodeHash struct{}
+
+func (anyNodeHash) ID(*core1.Node) string {
+	return ""
+}
+
+func (d *configDump) snapshot(version string) cache.Snapshot {
+	var endpoints, clusters, routes, listeners []cache.Resource
+	for _, e := range d.endpoints {
+		endpoints = append(endpoints, e)
+	}
+	for _, c := range d.clusters {
+		clusters = append(clusters, c)
+	}
+	for _, r := range d.routes {
+		routes = append(routes, r)
+	}
+	for _, l := range d.listeners {
+		listeners = append(listeners, l)
+	}
+	return cache.NewSnapshot(version, endpoints, clusters, routes, listeners, nil)
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/cobra"
+
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/proxy"
+)
+
+var sizeTypes = []string{"lds", "rds", "cds", "eds"}
+
+func sizes() *cobra.Command {
+	var namespace, selector string
+	var top int
+	localCmd := &cobra.Command{
+		Use:   "sizes",
+		Short: "Report xDS config size of every sidecar",
+		Long: "Fetch LDS, RDS, CDS and EDS for every sidecar pod and report resource counts and serialized bytes " +
+			"per pod and per type, largest pods first, along with the largest individual resources.",
+		Run: func(cmd *cobra.Command, args []string) {
+			pods, err := proxy.SidecarPods(resolveKubeConfigPath(kubeConfig), namespace, selector)
+			if err != nil {
+				fatalf("Cannot get pods: %v", err)
+			}
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
+			defer func() {
+				pilotClient.close()
+			}()
+
+			report := &sizeReport{Pods: []*podSizes{}, Largest: []*resourceSize{}}
+			for _, pod := range pods {
+				if ctx.Err() != nil {
+					fatalf("Interrupted")
+				}
+				pod.ProxyType = proxyType
+				dump, err := fetchConfigDump(ctx, pilotClient, pod)
+				if err != nil {
+					log.Warnf("Cannot get config of %s.%s: %v", pod.Name, pod.Namespace, err)
+					continue
+				}
+				report.add(pod.Name+"."+pod.Namespace, dump)
+			}
+			report.sort(top)
+			if outputFormat == "json" {
+				output, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					fatalf("Cannot convert to JSON: %v", err)
+				}
+				writeOutput(string(output))
+				return
+			}
+			fmt.Println(report.outputShort())
+		},
+	}
+	localCmd.Flags().StringVarP(&namespace, "namespace", "", "", "Namespace of the pods. Leave blank for all namespaces")
+	localCmd.Flags().StringVarP(&selector, "selector", "l", "", "Label selector of the pods")
+	localCmd.Flags().IntVarP(&top, "top", "", 10, "Number of largest resources to report")
+	return localCmd
+}
+
+type typeSize struct {
+	Resources int `json:"resources"`
+	Bytes     int `json:"bytes"`
+}
+
+type podSizes struct {
+	Pod   string               `json:"pod"`
+	Types map[string]*typeSize `json:"types"`
+	Bytes int                  `json:"bytes"`
+}
+
+type resourceSize struct {
+	Pod   string `json:"pod"`
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Bytes int    `json:"bytes"`
+}
+
+type sizeReport struct {
+	Pods    []*podSizes     `json:"pods"`
+	Largest []*resourceSize `json:"largest"`
+}
+
+// add records the size of every resource in the config dump of the pod.
+func (r *sizeReport) add(pod string, dump *configDump) {
+	p := &podSizes{Pod: pod, Types: map[string]*typeSize{}}
+	record := func(configType, name string, msg proto.Message) {
+		size := proto.Size(msg)
+		t, ok := p.Types[configType]
+		if !ok {
+			t = &typeSize{}
+			p.Types[configType] = t
+		}
+		t.Resources++
+		t.Bytes += size
+		p.Bytes += size
+		r.Largest = append(r.Largest, &resourceSize{Pod: pod, Type: configType, Name: name, Bytes: size})
+	}
+	for name, l := range dump.listeners {
+		record("lds", name, l)
+	}
+	for name, rc := range dump.routes {
+		record("rds", name, rc)
+	}
+	for name, c := range dump.clusters {
+		record("cds", name, c)
+	}
+	for name, e := range dump.endpoints {
+		record("eds", name, e)
+	}
+	r.Pods = append(r.Pods, p)
+}
+
+// sort orders pods by total size, largest first, and keeps only the top largest resources.
+func (r *sizeReport) sort(top int) {
+	sort.Slice(r.Pods, func(i, j int) bool {
+		if r.Pods[i].Bytes != r.Pods[j].Bytes {
+			return r.Pods[i].Bytes > r.Pods[j].Bytes
+		}
+		return r.Pods[i].Pod < r.Pods[j].Pod
+	})
+	sort.Slice(r.Largest, func(i, j int) bool {
+		return r.Largest[i].Bytes > r.Largest[j].Bytes
+	})
+	if len(r.Largest) > top {
+		r.Largest = r.Largest[:top]
+	}
+}
+
+// medianBytes returns the median total size of the pods.
+func (r *sizeReport) medianBytes() int {
+	if len(r.Pods) == 0 {
+		return 0
+	}
+	// Pods are sorted largest first.
+	return r.Pods[len(r.Pods)/2].Bytes
+}
+
+func (r *sizeReport) outputShort() string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "POD\tLDS\tRDS\tCDS\tEDS\tBYTES\tVS MEDIAN")
+	median := r.medianBytes()
+	for _, p := range r.Pods {
+		fmt.Fprintf(w, "%s", p.Pod)
+		for _, configType := range sizeTypes {
+			t := p.Types[configType]
+			if t == nil {
+				t = &typeSize{}
+			}
+			fmt.Fprintf(w, "\t%d (%d B)", t.Resources, t.Bytes)
+		}
+		ratio := "-"
+		if median > 0 {
+			ratio = fmt.Sprintf("%.1fx", float64(p.Bytes)/float64(median))
+		}
+		fmt.Fprintf(w, "\t%d\t%s\n", p.Bytes, ratio)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "TYPE\tRESOURCES\tBYTES")
+	for _, configType := range sizeTypes {
+		total := typeSize{}
+		for _, p := range r.Pods {
+			if t := p.Types[configType]; t != nil {
+				total.Resources += t.Resources
+				total.Bytes += t.Bytes
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", configType, total.Resources, total.Bytes)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "POD\tTYPE\tNAME\tBYTES")
+	for _, res := range r.Largest {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", res.Pod, res.Type, res.Name, res.Bytes)
+	}
+	w.Flush()
+	return buf.String()
+}
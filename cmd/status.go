@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"text/tabwriter"
+
+	csds "github.com/envoyproxy/go-control-plane/envoy/service/status/v2"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	"github.com/spf13/cobra"
+)
+
+var csdsTypes = []string{"LDS", "CDS", "RDS", "SRDS"}
+
+func clientStatus() *cobra.Command {
+	localCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the config status of proxies with the Client Status Discovery Service",
+		Long: "Call CSDS FetchClientStatus on pilot and print the status (SYNCED, NOT_SENT, STALE or ERROR) " +
+			"of each xDS type for every proxy, or only for the proxy given by --proxytag.",
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
+			defer func() {
+				pilotClient.close()
+			}()
+
+			req := &csds.ClientStatusRequest{}
+			if proxyTag != "" {
+				pod := findProxy()
+				req.NodeMatchers = []*matcher.NodeMatcher{{
+					NodeId: &matcher.StringMatcher{
+						MatchPattern: &matcher.StringMatcher_Exact{Exact: pod.NodeID()},
+					},
+				}}
+			}
+			resp, err := pilotClient.fetchClientStatus(ctx, req)
+			if err != nil {
+				fatalf("Cannot fetch client status: %v", err)
+			}
+			if outputFormat == "json" {
+				outputJSON(resp)
+				return
+			}
+			fmt.Println(outputClientStatus(resp))
+		},
+	}
+	return localCmd
+}
+
+// retrieveCSDSType returns the xDS type the config status is about.
+func retrieveCSDSType(config *csds.PerXdsConfig) string {
+	switch config.GetPerXdsConfig().(type) {
+	case *csds.PerXdsConfig_ListenerConfig:
+		return "LDS"
+	case *csds.PerXdsConfig_ClusterConfig:
+		return "CDS"
+	case *csds.PerXdsConfig_RouteConfig:
+		return "RDS"
+	case *csds.PerXdsConfig_ScopedRouteConfig:
+		return "SRDS"
+	}
+	return ""
+}
+
+func outputClientStatus(resp *csds.ClientStatusResponse) string {
+	if len(resp.Config) == 0 {
+		return "No proxies found."
+	}
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "NODE\tLDS\tCDS\tRDS\tSRDS")
+	for _, config := range resp.Config {
+		statuses := map[string]string{}
+		for _, xdsConfig := range config.XdsConfig {
+			statuses[retrieveCSDSType(xdsConfig)] = xdsConfig.GetStatus().String()
+		}
+		fmt.Fprintf(w, "%s", config.GetNode().GetId())
+		for _, t := range csdsTypes {
+			s, ok := statuses[t]
+			if !ok {
+				s = "-"
+			}
+			fmt.Fprintf(w, "\t%s", s)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return buf.String()
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+	"istio.io/pkg/log"
+
+	"xdscli/pkg/xdsclient"
+)
+
+// subscription holds the resource names subscribed on a stream, and serializes the requests sent on
+// it, as they can come from both the response loop and subscription changes. It outlives the stream
+// when reconnecting, so the names are kept.
+type subscription struct {
+	mu     sync.Mutex
+	stream *xdsclient.Stream
+	last   *xdsapi.DiscoveryRequest
+}
+
+func newSubscription() *subscription {
+	return &subscription{}
+}
+
+// setStream switches to a new stream after a reconnect.
+func (s *subscription) setStream(stream *xdsclient.Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stream = stream
+}
+
+// send sends the request with the currently subscribed names, unless it is the first request.
+func (s *subscription) send(req *xdsapi.DiscoveryRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil {
+		req.ResourceNames = s.last.ResourceNames
+	}
+	s.last = req
+	return s.stream.Send(req)
+}
+
+// parseSubscriptionChange parses "+name" to subscribe to name, or "-name" to unsubscribe.
+func parseSubscriptionChange(change string) (bool, string, error) {
+	if len(change) < 2 || (change[0] != '+' && change[0] != '-') {
+		return false, "", fmt.Errorf("invalid change %q, want +name or -name", change)
+	}
+	return change[0] == '+', change[1:], nil
+}
+
+// update subscribes to or unsubscribes from the name and sends the new names with the version and
+// nonce of the last request.
+func (s *subscription) update(add bool, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	found := false
+	for _, n := range s.last.ResourceNames {
+		if n == name {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		names = append(names, n)
+	}
+	if add && !found {
+		names = append(names, name)
+	}
+	if len(names) == len(s.last.ResourceNames) {
+		log.Infof("Subscription unchanged, already %v", names)
+		return nil
+	}
+	req := &xdsapi.DiscoveryRequest{
+		VersionInfo:   s.last.VersionInfo,
+		ResponseNonce: s.last.ResponseNonce,
+		TypeUrl:       s.last.TypeUrl,
+		Node:          s.last.Node,
+		ResourceNames: names,
+	}
+	log.Infof("Subscription changed, now %v", names)
+	s.last = req
+	return s.stream.Send(req)
+}
+
+// followChanges reads changes, one per line, from the file and applies them. If sending fails, the
+// change is still applied to the names resumed on reconnect.
+// The file is followed for new lines, like tail -f. "-" reads from stdin until EOF.
+func (s *subscription) followChanges(path string) {
+	var r io.Reader = os.Stdin
+	follow := false
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Errorf("Cannot open subscription changes: %v", err)
+			return
+		}
+		defer func() { _ = f.Close() }()
+		r = f
+		follow = true
+	}
+	reader := bufio.NewReader(r)
+	partial := ""
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == io.EOF && follow {
+			time.Sleep(500 * time.Millisecond)
+			continue
+		} else if err != nil {
+			if err != io.EOF {
+				log.Errorf("Cannot read subscription changes: %v", err)
+			}
+			return
+		}
+		change := strings.TrimSpace(partial)
+		partial = ""
+		if change == "" || strings.HasPrefix(change, "#") {
+			continue
+		}
+		add, name, err := parseSubscriptionChange(change)
+		if err != nil {
+			log.Errorf("Cannot change subscription: %v", err)
+			continue
+		}
+		if err := s.update(add, name); err != nil {
+			log.Warnf("Cannot send subscription change: %v", err)
+		}
+	}
+}
+
+// supportsSubscriptionChanges returns true for types whose resources are requested by name.
+func supportsSubscriptionChanges(typeURL string) bool {
+	return typeURL == v2.EndpointType || typeURL == v2.RouteType
+}
@@ -0,0 +1,456 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	"github.com/envoyproxy/go-control-plane/pkg/conversion"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/spf13/cobra"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/pkg/log"
+)
+
+func tlsReport() *cobra.Command {
+	localCmd := &cobra.Command{
+		Use:   "tls [FILE...]",
+		Short: "Show the TLS settings of inbound filter chains and outbound clusters",
+		Long: "Fetch LDS and CDS for the proxy, or load them from saved json output, and show for each inbound " +
+			"filter chain and outbound cluster the SDS secrets, trusted CA, subject alt names, ALPN, TLS versions " +
+			"and cipher suites. Outbound clusters of a service the proxy also serves are checked against its " +
+			"inbound filter chains for the port.",
+		Run: func(cmd *cobra.Command, args []string) {
+			var dump *configDump
+			var err error
+			if len(args) != 0 {
+				dump, err = loadConfigDump(args)
+			} else {
+				ctx, cancel := commandContext()
+				defer cancel()
+				pilotClient := newPilotClient(ctx)
+				defer func() {
+					pilotClient.close()
+				}()
+				pod := findProxy()
+				dump, err = fetchConfigDump(ctx, pilotClient, pod)
+			}
+			if err != nil {
+				fatalf("Cannot get config: %v", err)
+			}
+			report := newTLSReport(dump)
+			if outputFormat == "json" {
+				output, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					fatalf("Cannot convert to JSON: %v", err)
+				}
+				writeOutput(string(output))
+				return
+			}
+			fmt.Println(report.outputShort())
+		},
+	}
+	return localCmd
+}
+
+// Default TLS versions of Envoy when the TLS parameters are not set.
+const (
+	defaultClientMinTLSVersion = auth.TlsParameters_TLSv1_2
+	defaultClientMaxTLSVersion = auth.TlsParameters_TLSv1_2
+	defaultServerMinTLSVersion = auth.TlsParameters_TLSv1_0
+	defaultServerMaxTLSVersion = auth.TlsParameters_TLSv1_3
+)
+
+// tlsSettings are the TLS settings of one side of a connection.
+type tlsSettings struct {
+	// TCP, TLS or MTLS.
+	Mode string `json:"mode"`
+	// SDS secret names as sds:<name>, file paths or inline.
+	Certificates    []string `json:"certificates,omitempty"`
+	TrustedCA       string   `json:"trustedCa,omitempty"`
+	SubjectAltNames []string `json:"subjectAltNames,omitempty"`
+	ALPN            []string `json:"alpn,omitempty"`
+	SNI             string   `json:"sni,omitempty"`
+	TLSVersions     string   `json:"tlsVersions,omitempty"`
+	CipherSuites    []string `json:"cipherSuites,omitempty"`
+
+	minVersion auth.TlsParameters_TlsProtocol
+	maxVersion auth.TlsParameters_TlsProtocol
+}
+
+type inboundTLS struct {
+	Listener    string `json:"listener"`
+	Port        uint32 `json:"port"`
+	FilterChain string `json:"filterChain"`
+	tlsSettings
+
+	// Transport protocol and application protocols the chain is selected for.
+	transportProtocol    string
+	applicationProtocols []string
+}
+
+type outboundTLS struct {
+	Cluster string `json:"cluster"`
+	// Name of the transport socket match, for clusters with AUTO mTLS.
+	SocketMatch string `json:"socketMatch,omitempty"`
+	tlsSettings
+	// yes, no, or - when the proxy has no inbound filter chain for the service.
+	Compatible string   `json:"compatible"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+type tlsReportResult struct {
+	Inbound  []*inboundTLS  `json:"inbound"`
+	Outbound []*outboundTLS `json:"outbound"`
+}
+
+// retrieveDownstreamTLSContext returns the TLS context of a filter chain, or nil if it is not TLS.
+func retrieveDownstreamTLSContext(chain *listener.FilterChain) *auth.DownstreamTlsContext {
+	socket := chain.GetTransportSocket()
+	if socket == nil {
+		return chain.GetTlsContext()
+	}
+	tlsContext := &auth.DownstreamTlsContext{}
+	switch c := socket.GetConfigType().(type) {
+	case *core1.TransportSocket_TypedConfig:
+		if !ptypes.Is(c.TypedConfig, tlsContext) {
+			return nil
+		}
+		if err := ptypes.UnmarshalAny(c.TypedConfig, tlsContext); err != nil {
+			log.Errorf("Cannot unmarshal any proto to TLSContext: %v", err)
+			return nil
+		}
+		return tlsContext
+	case *core1.TransportSocket_Config:
+		if socket.Name != "tls" && socket.Name != "envoy.transport_sockets.tls" {
+			return nil
+		}
+		if err := conversion.StructToMessage(c.Config, tlsContext); err != nil {
+			log.Errorf("Cannot convert struct to TLSContext: %v", err)
+			return nil
+		}
+		return tlsContext
+	}
+	return nil
+}
+
+// describeFilterChainProtocols names the chain by its index and name, and the transport and
+// application protocols it is selected for.
+func describeFilterChainProtocols(i int, chain *listener.FilterChain) string {
+	parts := []string{fmt.Sprintf("#%d", i)}
+	if chain.Name != "" {
+		parts = append(parts, chain.Name)
+	}
+	if p := chain.GetFilterChainMatch().GetTransportProtocol(); p != "" {
+		parts = append(parts, p)
+	}
+	if alpn := chain.GetFilterChainMatch().GetApplicationProtocols(); len(alpn) != 0 {
+		parts = append(parts, strings.Join(alpn, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func retrieveDataSource(ds *core1.DataSource) string {
+	if ds == nil {
+		return ""
+	}
+	if ds.GetFilename() != "" {
+		return ds.GetFilename()
+	}
+	return "inline"
+}
+
+func describeStringMatcher(m *matcher.StringMatcher) string {
+	switch p := m.GetMatchPattern().(type) {
+	case *matcher.StringMatcher_Exact:
+		return p.Exact
+	case *matcher.StringMatcher_Prefix:
+		return "prefix:" + p.Prefix
+	case *matcher.StringMatcher_Suffix:
+		return "suffix:" + p.Suffix
+	case *matcher.StringMatcher_Regex:
+		return "regex:" + p.Regex
+	case *matcher.StringMatcher_SafeRegex:
+		return "regex:" + p.SafeRegex.GetRegex()
+	}
+	return m.String()
+}
+
+func formatTLSVersion(v auth.TlsParameters_TlsProtocol) string {
+	if v == auth.TlsParameters_TLS_AUTO {
+		return "auto"
+	}
+	return v.String()
+}
+
+// newTLSSettings returns the settings of a TLS context, with the TLS versions defaulted to those of
+// Envoy for a client or server.
+func newTLSSettings(common *auth.CommonTlsContext, mode string, minDefault, maxDefault auth.TlsParameters_TlsProtocol) tlsSettings {
+	s := tlsSettings{Mode: mode, ALPN: common.GetAlpnProtocols()}
+	for _, cert := range common.GetTlsCertificates() {
+		s.Certificates = append(s.Certificates, retrieveDataSource(cert.GetCertificateChain()))
+	}
+	for _, sds := range common.GetTlsCertificateSdsSecretConfigs() {
+		s.Certificates = append(s.Certificates, "sds:"+sds.Name)
+	}
+
+	var validation *auth.CertificateValidationContext
+	switch v := common.GetValidationContextType().(type) {
+	case *auth.CommonTlsContext_ValidationContext:
+		validation = v.ValidationContext
+	case *auth.CommonTlsContext_ValidationContextSdsSecretConfig:
+		s.TrustedCA = "sds:" + v.ValidationContextSdsSecretConfig.GetName()
+	case *auth.CommonTlsContext_CombinedValidationContext:
+		validation = v.CombinedValidationContext.GetDefaultValidationContext()
+		s.TrustedCA = "sds:" + v.CombinedValidationContext.GetValidationContextSdsSecretConfig().GetName()
+	}
+	if ca := retrieveDataSource(validation.GetTrustedCa()); ca != "" {
+		s.TrustedCA = ca
+	}
+	s.SubjectAltNames = append(s.SubjectAltNames, validation.GetVerifySubjectAltName()...)
+	for _, m := range validation.GetMatchSubjectAltNames() {
+		s.SubjectAltNames = append(s.SubjectAltNames, describeStringMatcher(m))
+	}
+
+	params := common.GetTlsParams()
+	s.CipherSuites = params.GetCipherSuites()
+	s.TLSVersions = "default"
+	if params != nil {
+		s.TLSVersions = formatTLSVersion(params.GetTlsMinimumProtocolVersion()) + "-" + formatTLSVersion(params.GetTlsMaximumProtocolVersion())
+	}
+	s.minVersion, s.maxVersion = params.GetTlsMinimumProtocolVersion(), params.GetTlsMaximumProtocolVersion()
+	if s.minVersion == auth.TlsParameters_TLS_AUTO {
+		s.minVersion = minDefault
+	}
+	if s.maxVersion == auth.TlsParameters_TLS_AUTO {
+		s.maxVersion = maxDefault
+	}
+	return s
+}
+
+func newUpstreamTLSSettings(tlsContext *auth.UpstreamTlsContext) tlsSettings {
+	if tlsContext == nil {
+		return tlsSettings{Mode: "TCP"}
+	}
+	common := tlsContext.GetCommonTlsContext()
+	mode := "TLS"
+	if len(common.GetTlsCertificates()) != 0 || len(common.GetTlsCertificateSdsSecretConfigs()) != 0 {
+		mode = "MTLS"
+	}
+	s := newTLSSettings(common, mode, defaultClientMinTLSVersion, defaultClientMaxTLSVersion)
+	s.SNI = tlsContext.GetSni()
+	return s
+}
+
+func newDownstreamTLSSettings(tlsContext *auth.DownstreamTlsContext) tlsSettings {
+	if tlsContext == nil {
+		return tlsSettings{Mode: "TCP"}
+	}
+	mode := "TLS"
+	if tlsContext.GetRequireClientCertificate().GetValue() {
+		mode = "MTLS"
+	}
+	return newTLSSettings(tlsContext.GetCommonTlsContext(), mode, defaultServerMinTLSVersion, defaultServerMaxTLSVersion)
+}
+
+func newTLSReport(d *configDump) *tlsReportResult {
+	report := &tlsReportResult{Inbound: []*inboundTLS{}, Outbound: []*outboundTLS{}}
+	for _, l := range d.listeners {
+		if l.TrafficDirection != core1.TrafficDirection_INBOUND && !strings.EqualFold(l.Name, "virtualInbound") {
+			continue
+		}
+		for i, chain := range l.FilterChains {
+			port := retrieveFilterChainPort(chain)
+			if port == 0 {
+				port = retrieveListenerPort(l)
+			}
+			report.Inbound = append(report.Inbound, &inboundTLS{
+				Listener:             l.Name,
+				Port:                 port,
+				FilterChain:          describeFilterChainProtocols(i, chain),
+				tlsSettings:          newDownstreamTLSSettings(retrieveDownstreamTLSContext(chain)),
+				transportProtocol:    chain.GetFilterChainMatch().GetTransportProtocol(),
+				applicationProtocols: chain.GetFilterChainMatch().GetApplicationProtocols(),
+			})
+		}
+	}
+	sort.SliceStable(report.Inbound, func(i, j int) bool {
+		if report.Inbound[i].Port != report.Inbound[j].Port {
+			return report.Inbound[i].Port < report.Inbound[j].Port
+		}
+		return report.Inbound[i].Listener < report.Inbound[j].Listener
+	})
+
+	// Ports of the services the proxy serves, by FQDN, as with the tls-mode-mismatch lint rule.
+	servedPorts := map[string]map[int]bool{}
+	for _, c := range d.clusters {
+		direction, _, fqdn, port := model.ParseSubsetKey(c.Name)
+		if direction != model.TrafficDirectionInbound || len(strings.Split(c.Name, "|")) < 4 {
+			continue
+		}
+		if servedPorts[string(fqdn)] == nil {
+			servedPorts[string(fqdn)] = map[int]bool{}
+		}
+		servedPorts[string(fqdn)][port] = true
+	}
+
+	for _, c := range d.clusters {
+		direction, _, fqdn, port := model.ParseSubsetKey(c.Name)
+		outbound := direction == model.TrafficDirectionOutbound && len(strings.Split(c.Name, "|")) >= 4
+		var entries []*outboundTLS
+		if len(c.TransportSocketMatches) != 0 {
+			for _, m := range c.TransportSocketMatches {
+				entries = append(entries, &outboundTLS{Cluster: c.Name, SocketMatch: m.Name,
+					tlsSettings: newUpstreamTLSSettings(retrieveUpstreamTLSContext(m.TransportSocket))})
+			}
+		}
+		tlsContext := c.GetTlsContext()
+		if c.TransportSocket != nil {
+			tlsContext = retrieveUpstreamTLSContext(c.TransportSocket)
+		}
+		defaultEntry := &outboundTLS{Cluster: c.Name, tlsSettings: newUpstreamTLSSettings(tlsContext)}
+		if len(entries) != 0 {
+			defaultEntry.SocketMatch = "default"
+		}
+		entries = append(entries, defaultEntry)
+		if !outbound && tlsContext == nil && len(c.TransportSocketMatches) == 0 {
+			continue
+		}
+
+		for _, e := range entries {
+			e.Compatible = "-"
+			// With AUTO mTLS the default transport socket is for endpoints without a sidecar, unlike
+			// this proxy.
+			if !outbound || !servedPorts[string(fqdn)][port] || e.SocketMatch == "default" {
+				continue
+			}
+			e.Problems = checkTLSCompatibility(&e.tlsSettings, report.inboundChains(uint32(port)), uint32(port))
+			e.Compatible = "yes"
+			if len(e.Problems) != 0 {
+				e.Compatible = "no"
+			}
+		}
+		report.Outbound = append(report.Outbound, entries...)
+	}
+	sort.SliceStable(report.Outbound, func(i, j int) bool {
+		return report.Outbound[i].Cluster < report.Outbound[j].Cluster
+	})
+	return report
+}
+
+func (r *tlsReportResult) inboundChains(port uint32) []*inboundTLS {
+	var chains []*inboundTLS
+	for _, in := range r.Inbound {
+		if in.Port == port {
+			chains = append(chains, in)
+		}
+	}
+	return chains
+}
+
+// checkTLSCompatibility returns why the inbound filter chains for the port would not accept
+// connections with the client settings, or nil if one of them does.
+func checkTLSCompatibility(client *tlsSettings, chains []*inboundTLS, port uint32) []string {
+	if len(chains) == 0 {
+		return []string{fmt.Sprintf("no inbound filter chain for port %d", port)}
+	}
+	if client.Mode == "TCP" {
+		for _, chain := range chains {
+			if chain.Mode == "TCP" && chain.transportProtocol != "tls" {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("sends plaintext but inbound port %d only accepts TLS", port)}
+	}
+
+	var problems []string
+	tlsChains := 0
+	for _, chain := range chains {
+		if chain.Mode == "TCP" {
+			continue
+		}
+		tlsChains++
+		chainProblems := checkTLSChain(client, chain)
+		if len(chainProblems) == 0 {
+			return nil
+		}
+		for _, p := range chainProblems {
+			problems = appendUnique(problems, p)
+		}
+	}
+	if tlsChains == 0 {
+		return []string{fmt.Sprintf("sends %s but inbound port %d only accepts plaintext", client.Mode, port)}
+	}
+	return problems
+}
+
+func checkTLSChain(client *tlsSettings, chain *inboundTLS) []string {
+	var problems []string
+	if len(chain.applicationProtocols) != 0 && !intersects(client.ALPN, chain.applicationProtocols) {
+		problems = append(problems, fmt.Sprintf("ALPN %v does not match %v of %s", client.ALPN, chain.applicationProtocols, chain.FilterChain))
+	}
+	if chain.Mode == "MTLS" && client.Mode != "MTLS" {
+		problems = append(problems, fmt.Sprintf("%s requires a client certificate", chain.FilterChain))
+	}
+	if client.maxVersion < chain.minVersion || chain.maxVersion < client.minVersion {
+		problems = append(problems, fmt.Sprintf("TLS versions %s-%s do not overlap %s-%s of %s",
+			client.minVersion, client.maxVersion, chain.minVersion, chain.maxVersion, chain.FilterChain))
+	}
+	if len(client.CipherSuites) != 0 && len(chain.CipherSuites) != 0 && !intersects(client.CipherSuites, chain.CipherSuites) {
+		problems = append(problems, fmt.Sprintf("no cipher suite in common with %s", chain.FilterChain))
+	}
+	return problems
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func formatList(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ",")
+}
+
+func (r *tlsReportResult) outputShort() string {
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "LISTENER\tPORT\tCHAIN\tMODE\tCERTIFICATES\tTRUSTED CA\tSANS\tALPN\tTLS VERSIONS\tCIPHERS")
+	for _, in := range r.Inbound {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", in.Listener, in.Port, in.FilterChain, in.Mode,
+			formatList(in.Certificates), orDash(in.TrustedCA), formatList(in.SubjectAltNames), formatList(in.ALPN),
+			orDash(in.TLSVersions), formatList(in.CipherSuites))
+	}
+	w.Flush()
+
+	buf.WriteString("\n")
+	w = new(tabwriter.Writer).Init(&buf, 0, 8, 5, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tSOCKET MATCH\tMODE\tCERTIFICATES\tTRUSTED CA\tSANS\tALPN\tSNI\tTLS VERSIONS\tCIPHERS\tCOMPATIBLE")
+	for _, out := range r.Outbound {
+		compatible := out.Compatible
+		if len(out.Problems) != 0 {
+			compatible += ": " + strings.Join(out.Problems, ", ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", out.Cluster, orDash(out.SocketMatch), out.Mode,
+			formatList(out.Certificates), orDash(out.TrustedCA), formatList(out.SubjectAltNames), formatList(out.ALPN),
+			orDash(out.SNI), orDash(out.TLSVersions), formatList(out.CipherSuites), compatible)
+	}
+	w.Flush()
+	return buf.String()
+}
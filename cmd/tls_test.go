@@ -0,0 +1,259 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func newUpstreamTLSSocket(t *testing.T, tlsContext *auth.UpstreamTlsContext) *core1.TransportSocket {
+	t.Helper()
+	config, err := ptypes.MarshalAny(tlsContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &core1.TransportSocket{Name: "envoy.transport_sockets.tls", ConfigType: &core1.TransportSocket_TypedConfig{TypedConfig: config}}
+}
+
+// istioMTLSContext is the upstream TLS context of Istio mTLS to the service account.
+func istioMTLSContext() *auth.UpstreamTlsContext {
+	return &auth.UpstreamTlsContext{
+		Sni: "outbound_.9080_._.reviews.default.svc.cluster.local",
+		CommonTlsContext: &auth.CommonTlsContext{
+			AlpnProtocols:                  []string{"istio-peer-exchange", "istio"},
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{Name: "default"}},
+			ValidationContextType: &auth.CommonTlsContext_CombinedValidationContext{
+				CombinedValidationContext: &auth.CommonTlsContext_CombinedCertificateValidationContext{
+					DefaultValidationContext: &auth.CertificateValidationContext{
+						MatchSubjectAltNames: []*matcher.StringMatcher{{
+							MatchPattern: &matcher.StringMatcher_Exact{Exact: "spiffe://cluster.local/ns/default/sa/reviews"},
+						}},
+					},
+					ValidationContextSdsSecretConfig: &auth.SdsSecretConfig{Name: "ROOTCA"},
+				},
+			},
+		},
+	}
+}
+
+func TestNewTLSSettings(t *testing.T) {
+	tls13 := &auth.TlsParameters{
+		TlsMinimumProtocolVersion: auth.TlsParameters_TLS_AUTO,
+		TlsMaximumProtocolVersion: auth.TlsParameters_TLSv1_3,
+		CipherSuites:              []string{"ECDHE-ECDSA-AES256-GCM-SHA384"},
+	}
+	cases := []struct {
+		name     string
+		settings tlsSettings
+		want     tlsSettings
+	}{
+		{
+			name:     "plaintext upstream",
+			settings: newUpstreamTLSSettings(nil),
+			want:     tlsSettings{Mode: "TCP"},
+		},
+		{
+			name:     "plaintext downstream",
+			settings: newDownstreamTLSSettings(nil),
+			want:     tlsSettings{Mode: "TCP"},
+		},
+		{
+			name:     "istio mTLS upstream",
+			settings: newUpstreamTLSSettings(istioMTLSContext()),
+			want: tlsSettings{
+				Mode:            "MTLS",
+				Certificates:    []string{"sds:default"},
+				TrustedCA:       "sds:ROOTCA",
+				SubjectAltNames: []string{"spiffe://cluster.local/ns/default/sa/reviews"},
+				ALPN:            []string{"istio-peer-exchange", "istio"},
+				SNI:             "outbound_.9080_._.reviews.default.svc.cluster.local",
+				TLSVersions:     "default",
+				minVersion:      auth.TlsParameters_TLSv1_2,
+				maxVersion:      auth.TlsParameters_TLSv1_2,
+			},
+		},
+		{
+			name: "TLS upstream with file certificates",
+			settings: newUpstreamTLSSettings(&auth.UpstreamTlsContext{CommonTlsContext: &auth.CommonTlsContext{
+				ValidationContextType: &auth.CommonTlsContext_ValidationContext{ValidationContext: &auth.CertificateValidationContext{
+					TrustedCa:            &core1.DataSource{Specifier: &core1.DataSource_Filename{Filename: "/etc/certs/root-cert.pem"}},
+					VerifySubjectAltName: []string{"spiffe://cluster.local/ns/default/sa/ratings"},
+					MatchSubjectAltNames: []*matcher.StringMatcher{{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: "spiffe://cluster.local/"}}},
+				}},
+			}}),
+			want: tlsSettings{
+				Mode:            "TLS",
+				TrustedCA:       "/etc/certs/root-cert.pem",
+				SubjectAltNames: []string{"spiffe://cluster.local/ns/default/sa/ratings", "prefix:spiffe://cluster.local/"},
+				TLSVersions:     "default",
+				minVersion:      auth.TlsParameters_TLSv1_2,
+				maxVersion:      auth.TlsParameters_TLSv1_2,
+			},
+		},
+		{
+			name: "mTLS downstream with TLS parameters",
+			settings: newDownstreamTLSSettings(&auth.DownstreamTlsContext{
+				RequireClientCertificate: &wrappers.BoolValue{Value: true},
+				CommonTlsContext: &auth.CommonTlsContext{
+					TlsCertificates: []*auth.TlsCertificate{{
+						CertificateChain: &core1.DataSource{Specifier: &core1.DataSource_Filename{Filename: "/etc/certs/cert-chain.pem"}},
+					}},
+					TlsParams: tls13,
+				},
+			}),
+			want: tlsSettings{
+				Mode:         "MTLS",
+				Certificates: []string{"/etc/certs/cert-chain.pem"},
+				TLSVersions:  "auto-TLSv1_3",
+				CipherSuites: []string{"ECDHE-ECDSA-AES256-GCM-SHA384"},
+				// The unset minimum is the server default.
+				minVersion: auth.TlsParameters_TLSv1_0,
+				maxVersion: auth.TlsParameters_TLSv1_3,
+			},
+		},
+		{
+			name: "TLS downstream without TLS parameters",
+			settings: newDownstreamTLSSettings(&auth.DownstreamTlsContext{CommonTlsContext: &auth.CommonTlsContext{
+				TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{Name: "default"}},
+			}}),
+			want: tlsSettings{
+				Mode:         "TLS",
+				Certificates: []string{"sds:default"},
+				TLSVersions:  "default",
+				minVersion:   auth.TlsParameters_TLSv1_0,
+				maxVersion:   auth.TlsParameters_TLSv1_3,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if !reflect.DeepEqual(c.settings, c.want) {
+				t.Errorf("settings = %+v, want %+v", c.settings, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckTLSCompatibility(t *testing.T) {
+	client := func(mode string, alpn ...string) *tlsSettings {
+		return &tlsSettings{Mode: mode, ALPN: alpn, minVersion: defaultClientMinTLSVersion, maxVersion: defaultClientMaxTLSVersion}
+	}
+	chain := func(mode, transportProtocol string, alpn ...string) *inboundTLS {
+		return &inboundTLS{
+			FilterChain:          "#0",
+			tlsSettings:          tlsSettings{Mode: mode, minVersion: defaultServerMinTLSVersion, maxVersion: defaultServerMaxTLSVersion},
+			transportProtocol:    transportProtocol,
+			applicationProtocols: alpn,
+		}
+	}
+	tls13Client := client("MTLS")
+	tls13Client.minVersion, tls13Client.maxVersion = auth.TlsParameters_TLSv1_3, auth.TlsParameters_TLSv1_3
+	tls12Chain := chain("MTLS", "tls")
+	tls12Chain.maxVersion = auth.TlsParameters_TLSv1_2
+	cipherClient := client("MTLS")
+	cipherClient.CipherSuites = []string{"ECDHE-ECDSA-AES256-GCM-SHA384"}
+	cipherChain := chain("MTLS", "tls")
+	cipherChain.CipherSuites = []string{"ECDHE-RSA-AES128-GCM-SHA256"}
+
+	cases := []struct {
+		name   string
+		client *tlsSettings
+		chains []*inboundTLS
+		// Substrings of the problems, nil if compatible.
+		want []string
+	}{
+		{"no inbound chain", client("MTLS"), nil, []string{"no inbound filter chain for port 9080"}},
+		{"plaintext to plaintext", client("TCP"), []*inboundTLS{chain("TCP", "")}, nil},
+		{"plaintext to raw_buffer chain", client("TCP"), []*inboundTLS{chain("TCP", "raw_buffer")}, nil},
+		{"plaintext to TCP chain matching tls", client("TCP"), []*inboundTLS{chain("TCP", "tls")}, []string{"only accepts TLS"}},
+		{"plaintext to mTLS", client("TCP"), []*inboundTLS{chain("MTLS", "tls")}, []string{"only accepts TLS"}},
+		{"permissive", client("TCP"), []*inboundTLS{chain("MTLS", "tls"), chain("TCP", "raw_buffer")}, nil},
+		{"mTLS to plaintext", client("MTLS"), []*inboundTLS{chain("TCP", "")}, []string{"only accepts plaintext"}},
+		{"mTLS to mTLS", client("MTLS", "istio"), []*inboundTLS{chain("MTLS", "tls", "istio-peer-exchange", "istio")}, nil},
+		{"TLS to mTLS", client("TLS"), []*inboundTLS{chain("MTLS", "tls")}, []string{"requires a client certificate"}},
+		{"ALPN mismatch", client("MTLS", "h2"), []*inboundTLS{chain("MTLS", "tls", "istio-peer-exchange", "istio")}, []string{"ALPN"}},
+		{"no ALPN required", client("MTLS"), []*inboundTLS{chain("MTLS", "tls")}, nil},
+		{"TLS versions do not overlap", tls13Client, []*inboundTLS{tls12Chain}, []string{"TLS versions"}},
+		{"no cipher in common", cipherClient, []*inboundTLS{cipherChain}, []string{"no cipher suite in common"}},
+		{
+			"one of the chains accepts",
+			client("MTLS", "istio"),
+			[]*inboundTLS{chain("MTLS", "tls", "h2"), chain("MTLS", "tls", "istio")},
+			nil,
+		},
+		{
+			"problems of every chain",
+			client("TLS", "h2"),
+			[]*inboundTLS{chain("MTLS", "tls", "istio")},
+			[]string{"ALPN", "requires a client certificate"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			problems := checkTLSCompatibility(c.client, c.chains, 9080)
+			if len(problems) != len(c.want) {
+				t.Fatalf("problems = %q, want %q", problems, c.want)
+			}
+			for i, want := range c.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %q does not contain %q", problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTLSReport(t *testing.T) {
+	const (
+		reviews = "outbound|9080||reviews.default.svc.cluster.local"
+		ratings = "outbound|9080||ratings.default.svc.cluster.local"
+		details = "outbound|9080||details.default.svc.cluster.local"
+	)
+	d := newConfigDump()
+	// The proxy serves reviews and ratings with mTLS on 9080.
+	d.clusters["inbound|9080|http|reviews.default.svc.cluster.local"] = newEDSCluster("inbound|9080|http|reviews.default.svc.cluster.local")
+	d.clusters["inbound|9080|http|ratings.default.svc.cluster.local"] = newEDSCluster("inbound|9080|http|ratings.default.svc.cluster.local")
+	d.listeners["virtualInbound"] = &xdsapi.Listener{
+		Name:         "virtualInbound",
+		FilterChains: []*listener.FilterChain{newInboundChain(t, 9080, true, true)},
+	}
+	// AUTO mTLS: mTLS to endpoints with a sidecar, plaintext by default.
+	d.clusters[reviews] = newEDSCluster(reviews)
+	d.clusters[reviews].TransportSocketMatches = []*xdsapi.Cluster_TransportSocketMatch{{
+		Name:            "tlsMode-istio",
+		TransportSocket: newUpstreamTLSSocket(t, istioMTLSContext()),
+	}}
+	// Plaintext to a service only accepting mTLS.
+	d.clusters[ratings] = newEDSCluster(ratings)
+	// Not served by the proxy.
+	d.clusters[details] = newMTLSCluster(t, details)
+
+	report := newTLSReport(d)
+	if len(report.Inbound) != 1 || report.Inbound[0].Mode != "MTLS" || report.Inbound[0].Port != 9080 {
+		t.Errorf("inbound = %+v, want one MTLS chain for 9080", report.Inbound)
+	}
+	type entry struct {
+		cluster, socketMatch, mode, compatible string
+	}
+	var got []entry
+	for _, out := range report.Outbound {
+		got = append(got, entry{out.Cluster, out.SocketMatch, out.Mode, out.Compatible})
+	}
+	want := []entry{
+		{details, "", "MTLS", "-"},
+		{ratings, "", "TCP", "no"},
+		{reviews, "tlsMode-istio", "MTLS", "yes"},
+		{reviews, "default", "TCP", "-"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("outbound = %+v, want %+v", got, want)
+	}
+}
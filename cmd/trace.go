@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/spf13/cobra"
+
+	"istio.io/pkg/log"
+)
+
+func trace() *cobra.Command {
+	t := &tracer{}
+	localCmd := &cobra.Command{
+		Use:   "trace",
+		Short: "Trace a request through listeners, routes, clusters and endpoints",
+		Long: "Trace a synthetic request through the proxy config: select the listener and filter chain, " +
+			"then the virtual host and route for HTTP, the cluster(s) and finally the endpoints.",
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := commandContext()
+			defer cancel()
+			pilotClient := newPilotClient(ctx)
+			defer func() {
+				pilotClient.close()
+			}()
+
+			pod := findProxy()
+			if t.destinationIP == "" && t.direction == "inbound" {
+				t.destinationIP = pod.IP
+			}
+			if t.sourceIP == "" && t.direction == "outbound" {
+				t.sourceIP = pod.IP
+			}
+			dump, err := fetchConfigDump(ctx, pilotClient, pod)
+			if err != nil {
+				fatalf("Cannot fetch config: %v", err)
+			}
+			w := new(tabwriter.Writer).Init(os.Stdout, 0, 8, 5, ' ', 0)
+			t.trace(w, dump)
+			_ = w.Flush()
+		},
+	}
+	localCmd.Flags().StringVarP(&t.direction, "direction", "d", "outbound", "Traffic direction: outbound or inbound")
+	localCmd.Flags().StringVarP(&t.destinationIP, "ip", "", "", "Destination IP. Defaults to the pod IP for inbound")
+	localCmd.Flags().Uint32VarP(&t.destinationPort, "port", "p", 0, "Destination port")
+	localCmd.Flags().StringVarP(&t.sourceIP, "source-ip", "", "", "Source IP. Defaults to the pod IP for outbound")
+	localCmd.Flags().Uint32VarP(&t.sourcePort, "source-port", "", 0, "Source port")
+	localCmd.Flags().StringVarP(&t.sni, "sni", "", "", "TLS server name")
+	localCmd.Flags().StringVarP(&t.transportProtocol, "transport-protocol", "", "",
+		"Transport protocol detected by the listener filters. Defaults to tls if --sni is set, raw_buffer otherwise")
+	localCmd.Flags().StringSliceVarP(&t.applicationProtocols, "alpn", "", nil, "Application protocols, e.g. istio,h2 or http/1.1")
+	localCmd.Flags().StringVarP(&t.host, "host", "", "", "Host header. Defaults to the destination IP:port")
+	localCmd.Flags().StringVarP(&t.path, "path", "", "/", "Request path, may include a query string")
+	localCmd.Flags().StringVarP(&t.method, "method", "", "GET", "Request method")
+	localCmd.Flags().StringArrayVarP(&t.headers, "header", "H", nil, "Request header as name:value. Can be repeated")
+	return localCmd
+}
+
+type tracer struct {
+	direction            string
+	destinationIP        string
+	destinationPort      uint32
+	sourceIP             string
+	sourcePort           uint32
+	sni                  string
+	transportProtocol    string
+	applicationProtocols []string
+	host                 string
+	path                 string
+	method               string
+	headers              []string
+}
+
+func (t *tracer) connection() (*connectionInfo, error) {
+	conn := &connectionInfo{
+		destinationIP:        net.ParseIP(t.destinationIP),
+		destinationPort:      t.destinationPort,
+		sourceIP:             net.ParseIP(t.sourceIP),
+		sourcePort:           t.sourcePort,
+		serverName:           t.sni,
+		transportProtocol:    t.transportProtocol,
+		applicationProtocols: t.applicationProtocols,
+	}
+	if conn.destinationIP == nil {
+		return nil, fmt.Errorf("invalid destination IP %q", t.destinationIP)
+	}
+	if conn.transportProtocol == "" {
+		conn.transportProtocol = "raw_buffer"
+		if t.sni != "" {
+			conn.transportProtocol = "tls"
+		}
+	}
+	return conn, nil
+}
+
+func (t *tracer) request() *httpRequest {
+	req := &httpRequest{
+		host:    t.host,
+		path:    t.path,
+		method:  t.method,
+		headers: map[string]string{},
+	}
+	if req.host == "" {
+		req.host = fmt.Sprintf("%s:%d", t.destinationIP, t.destinationPort)
+	}
+	for _, h := range t.headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			log.Warnf("Ignore malformed header %q", h)
+			continue
+		}
+		req.headers[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return req
+}
+
+// trace walks the config dump for the request and writes the decision made at each step.
+func (t *tracer) trace(w *tabwriter.Writer, dump *configDump) {
+	conn, err := t.connection()
+	if err != nil {
+		fmt.Fprintf(w, "ERROR\t%v\n", err)
+		return
+	}
+	l, reason := selectListener(dump.listeners, t.direction, conn.destinationIP, conn.destinationPort)
+	if l == nil {
+		fmt.Fprintf(w, "LISTENER\tnone for %s:%d\n", conn.destinationIP, conn.destinationPort)
+		return
+	}
+	fmt.Fprintf(w, "LISTENER\t%s (%s)\n", l.Name, reason)
+
+	i, steps := selectFilterChain(l.FilterChains, conn)
+	for _, step := range steps {
+		fmt.Fprintf(w, "  %s\t%d chain(s) left %v\n", step.criterion, len(step.chains), step.chains)
+	}
+	if i < 0 {
+		fmt.Fprintf(w, "FILTER CHAIN\tnone matched, connection is closed\n")
+		return
+	}
+	chain := l.FilterChains[i]
+	fmt.Fprintf(w, "FILTER CHAIN\t%s %s\n", describeFilterChain(i, chain), retrieveTransportProtocol(chain))
+
+	for _, c := range t.traceFilters(w, l, chain, dump) {
+		t.traceCluster(w, c, dump)
+	}
+}
+
+func describeFilterChain(i int, chain *listener.FilterChain) string {
+	name := fmt.Sprintf("#%d", i)
+	if chain.Name != "" {
+		name += " " + chain.Name
+	}
+	if m := chain.GetFilterChainMatch(); m != nil {
+		return fmt.Sprintf("%s {%v}", name, m)
+	}
+	return name + " {}"
+}
+
+// traceFilters walks the network filters of the chain up to the terminal one and returns the
+// clusters it routes to.
+func (t *tracer) traceFilters(w *tabwriter.Writer, l *xdsapi.Listener, chain *listener.FilterChain, dump *configDump) []weightedCluster {
+	for _, filter := range chain.Filters {
+		switch filter.Name {
+		case HTTPListener:
+			manager := &hcm.HttpConnectionManager{}
+			if err := retrieveFilterConfig(filter, manager); err != nil {
+				fmt.Fprintf(w, "NETWORK FILTER\t%s: cannot decode config: %v\n", filter.Name, err)
+				return nil
+			}
+			fmt.Fprintf(w, "NETWORK FILTER\t%s\n", filter.Name)
+			return t.traceHTTP(w, manager, dump)
+		case TCPListener:
+			proxy := &tcp.TcpProxy{}
+			if err := retrieveFilterConfig(filter, proxy); err != nil {
+				fmt.Fprintf(w, "NETWORK FILTER\t%s: cannot decode config: %v\n", filter.Name, err)
+				return nil
+			}
+			fmt.Fprintf(w, "NETWORK FILTER\t%s\n", filter.Name)
+			return retrieveTCPProxyClusters(proxy)
+		default:
+			fmt.Fprintf(w, "NETWORK FILTER\t%s\n", filter.Name)
+		}
+	}
+	fmt.Fprintf(w, "NETWORK FILTER\tno terminal filter in listener %s\n", l.Name)
+	return nil
+}
+
+func (t *tracer) traceHTTP(w *tabwriter.Writer, manager *hcm.HttpConnectionManager, dump *configDump) []weightedCluster {
+	rc := manager.GetRouteConfig()
+	if rds := manager.GetRds(); rds != nil {
+		rc = dump.routes[rds.RouteConfigName]
+		if rc == nil {
+			fmt.Fprintf(w, "ROUTE CONFIG\t%s not found in RDS\n", rds.RouteConfigName)
+			return nil
+		}
+		fmt.Fprintf(w, "ROUTE CONFIG\t%s (RDS)\n", rc.Name)
+	} else if rc != nil {
+		fmt.Fprintf(w, "ROUTE CONFIG\tinline\n")
+	} else {
+		fmt.Fprintf(w, "ROUTE CONFIG\tunsupported route specifier\n")
+		return nil
+	}
+
+	req := t.request()
+	vh, domain := selectVirtualHost(rc, req.host)
+	if vh == nil {
+		fmt.Fprintf(w, "VIRTUAL HOST\tnone for host %q, 404\n", req.host)
+		return nil
+	}
+	fmt.Fprintf(w, "VIRTUAL HOST\t%s (domain %q)\n", vh.Name, domain)
+
+	i := selectRoute(vh, req)
+	if i < 0 {
+		fmt.Fprintf(w, "ROUTE\tnone for %s %s, 404\n", req.method, req.path)
+		return nil
+	}
+	r := vh.Routes[i]
+	fmt.Fprintf(w, "ROUTE\t%s {%v}\n", describeRoute(i, r), r.GetMatch())
+	if redirect := r.GetRedirect(); redirect != nil {
+		fmt.Fprintf(w, "ACTION\tredirect {%v}\n", redirect)
+		return nil
+	}
+	if direct := r.GetDirectResponse(); direct != nil {
+		fmt.Fprintf(w, "ACTION\tdirect response %d\n", direct.Status)
+		return nil
+	}
+	return retrieveRouteClusters(r.GetRoute(), req)
+}
+
+func retrieveTCPProxyClusters(proxy *tcp.TcpProxy) []weightedCluster {
+	switch c := proxy.GetClusterSpecifier().(type) {
+	case *tcp.TcpProxy_Cluster:
+		return []weightedCluster{{name: c.Cluster, weight: 1, total: 1}}
+	case *tcp.TcpProxy_WeightedClusters:
+		var total uint32
+		for _, w := range c.WeightedClusters.Clusters {
+			total += w.Weight
+		}
+		var ret []weightedCluster
+		for _, w := range c.WeightedClusters.Clusters {
+			ret = append(ret, weightedCluster{name: w.Name, weight: w.Weight, total: total})
+		}
+		return ret
+	}
+	return nil
+}
+
+func (t *tracer) traceCluster(w *tabwriter.Writer, wc weightedCluster, dump *configDump) {
+	share := ""
+	if wc.total > 1 {
+		share = fmt.Sprintf(" weight %d/%d", wc.weight, wc.total)
+	}
+	c := dump.clusters[wc.name]
+	if c == nil {
+		fmt.Fprintf(w, "CLUSTER\t%s%s not found in CDS, 503\n", wc.name, share)
+		return
+	}
+	fmt.Fprintf(w, "CLUSTER\t%s%s (%v)\n", c.Name, share, c.GetType())
+
+	la := c.GetLoadAssignment()
+	switch c.GetType() {
+	case xdsapi.Cluster_EDS:
+		la = dump.endpoints[retrieveEDSServiceName(c)]
+		if la == nil {
+			fmt.Fprintf(w, "ENDPOINTS\tnone in EDS for %s, 503\n", retrieveEDSServiceName(c))
+			return
+		}
+	case xdsapi.Cluster_ORIGINAL_DST:
+		fmt.Fprintf(w, "ENDPOINTS\toriginal destination %s:%d\n", t.destinationIP, t.destinationPort)
+		return
+	}
+	n := 0
+	for _, locality := range la.GetEndpoints() {
+		for _, lb := range locality.LbEndpoints {
+			address := lb.GetEndpoint().GetAddress().GetSocketAddress()
+			fmt.Fprintf(w, "  ENDPOINT\t%s:%d %v locality=%s/%s/%s weight=%d\n", address.GetAddress(), address.GetPortValue(),
+				lb.HealthStatus, locality.GetLocality().GetRegion(), locality.GetLocality().GetZone(),
+				locality.GetLocality().GetSubZone(), lb.GetLoadBalancingWeight().GetValue())
+			n++
+		}
+	}
+	if n == 0 {
+		fmt.Fprintf(w, "ENDPOINTS\tnone, 503\n")
+	}
+}
@@ -5,9 +5,11 @@ go 1.14
 replace istio.io/istio => github.com/istio/istio v0.0.0-20200218044045-88b0085faa96
 
 require (
+	github.com/cncf/udpa/go v0.0.0-20191209042840-269d4d468f6f
 	github.com/envoyproxy/go-control-plane v0.9.4
 	github.com/golang/protobuf v1.3.3
 	github.com/spf13/cobra v0.0.5
+	google.golang.org/genproto v0.0.0-20191223191004-3caeed10a8bf
 	google.golang.org/grpc v1.27.1
 	istio.io/istio v0.0.0-20200218044045-88b0085faa96
 	istio.io/pkg v0.0.0-20200214155848-e5ca416a8c07
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Endpoint is an address backing a port of a Kubernetes service.
+type Endpoint struct {
+	IP   string
+	Port uint32
+	// Name of the pod, if the endpoint targets one.
+	Pod   string
+	Ready bool
+}
+
+// ServiceEndpoints returns the endpoints of the service port from the EndpointSlices of the
+// service, or from its Endpoints if it has no EndpointSlices, along with the kind of resource used.
+func ServiceEndpoints(kubeconfig, namespace, service string, port uint32) ([]*Endpoint, string, error) {
+	clientset, err := newClientset(kubeconfig)
+	if err != nil {
+		return nil, "", err
+	}
+	svc, err := clientset.CoreV1().Services(namespace).Get(service, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot get service %s.%s: %w", service, namespace, err)
+	}
+	portName := ""
+	found := false
+	for _, p := range svc.Spec.Ports {
+		if uint32(p.Port) == port {
+			portName = p.Name
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, "", fmt.Errorf("%w: service %s.%s has no port %d", ErrNotFound, service, namespace, port)
+	}
+
+	// EndpointSlices are beta and may not be served.
+	if endpoints, err := endpointSliceEndpoints(clientset, namespace, service, portName); err == nil && len(endpoints) != 0 {
+		return endpoints, "EndpointSlice", nil
+	}
+	endpoints, err := endpointsEndpoints(clientset, namespace, service, portName)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot get endpoints of %s.%s: %w", service, namespace, err)
+	}
+	return endpoints, "Endpoints", nil
+}
+
+func endpointSliceEndpoints(clientset *kubernetes.Clientset, namespace, service, portName string) ([]*Endpoint, error) {
+	slices, err := clientset.DiscoveryV1beta1().EndpointSlices(namespace).List(
+		meta_v1.ListOptions{LabelSelector: discovery.LabelServiceName + "=" + service})
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Endpoint
+	for _, slice := range slices.Items {
+		for _, p := range slice.Ports {
+			if p.Port == nil || (p.Name != nil && *p.Name != portName) || (p.Name == nil && portName != "") {
+				continue
+			}
+			for _, e := range slice.Endpoints {
+				for _, ip := range e.Addresses {
+					ret = append(ret, &Endpoint{
+						IP:    ip,
+						Port:  uint32(*p.Port),
+						Pod:   targetPod(e.TargetRef),
+						Ready: e.Conditions.Ready == nil || *e.Conditions.Ready,
+					})
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+func endpointsEndpoints(clientset *kubernetes.Clientset, namespace, service, portName string) ([]*Endpoint, error) {
+	endpoints, err := clientset.CoreV1().Endpoints(namespace).Get(service, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Endpoint
+	for _, subset := range endpoints.Subsets {
+		for _, p := range subset.Ports {
+			if p.Name != portName {
+				continue
+			}
+			for _, a := range subset.Addresses {
+				ret = append(ret, &Endpoint{IP: a.IP, Port: uint32(p.Port), Pod: targetPod(a.TargetRef), Ready: true})
+			}
+			for _, a := range subset.NotReadyAddresses {
+				ret = append(ret, &Endpoint{IP: a.IP, Port: uint32(p.Port), Pod: targetPod(a.TargetRef), Ready: false})
+			}
+		}
+	}
+	return ret, nil
+}
+
+func targetPod(ref *v1.ObjectReference) string {
+	if ref == nil || ref.Kind != "Pod" {
+		return ""
+	}
+	return ref.Name
+}
@@ -0,0 +1,155 @@
+// Package proxy finds the pods of the mesh and the node they connect to pilot as.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp" //nolint
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ErrNotFound is wrapped by the error returned when no pod matches.
+var ErrNotFound = errors.New("pod not found")
+
+// Pod holds information to identify the proxy of a pod.
+type Pod struct {
+	Name      string
+	Namespace string
+	IP        string
+	// sidecar, router or ingress. Guessed from the name if empty.
+	ProxyType string
+}
+
+// NodeID returns the node ID the proxy of the pod uses, type~ip~name.namespace~namespace.svc.cluster.local.
+func (p Pod) NodeID() string {
+	if p.ProxyType != "" {
+		return fmt.Sprintf("%s~%s~%s.%s~%s.svc.cluster.local", p.ProxyType, p.IP, p.Name, p.Namespace, p.Namespace)
+	}
+	if strings.HasPrefix(p.Name, "istio-ingressgateway") || strings.HasPrefix(p.Name, "istio-egressgateway") {
+		return fmt.Sprintf("router~%s~%s.%s~%s.svc.cluster.local", p.IP, p.Name, p.Namespace, p.Namespace)
+	}
+	if strings.HasPrefix(p.Name, "istio-ingress") {
+		return fmt.Sprintf("ingress~%s~%s.%s~%s.svc.cluster.local", p.IP, p.Name, p.Namespace, p.Namespace)
+	}
+	return fmt.Sprintf("sidecar~%s~%s.%s~%s.svc.cluster.local", p.IP, p.Name, p.Namespace, p.Namespace)
+}
+
+// Node returns the node to send in xDS requests on behalf of the proxy.
+func (p Pod) Node() *core1.Node {
+	return &core1.Node{
+		Id: p.NodeID(),
+	}
+}
+
+func newClientset(kubeconfig string) (*kubernetes.Clientset, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+// ListPods returns the pods of the namespace (all if empty) matching the label selector.
+func ListPods(kubeconfig, namespace, selector string) (*v1.PodList, error) {
+	clientset, err := newClientset(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientset.CoreV1().Pods(namespace).List(meta_v1.ListOptions{LabelSelector: selector})
+}
+
+// SidecarPods returns the running pods with an istio-proxy container, in the namespace (all if
+// empty) and matching the label selector.
+func SidecarPods(kubeconfig, namespace, selector string) ([]*Pod, error) {
+	pods, err := ListPods(kubeconfig, namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+		for _, c := range pod.Spec.Containers {
+			if c.Name == "istio-proxy" {
+				ret = append(ret, &Pod{
+					Name:      pod.Name,
+					Namespace: pod.Namespace,
+					IP:        pod.Status.PodIP,
+				})
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Find returns the first pod whose name, app label or istio label is nameOrLabel. The proxy type is
+// set for matches on the name or app label; gateways matched by their istio label keep it empty so
+// that it is guessed from the name. An empty nameOrLabel is an error rather than matching unlabeled pods.
+func Find(kubeconfig, nameOrLabel, proxyType string) (*Pod, error) {
+	if nameOrLabel == "" {
+		return nil, errors.New("no pod name or label to find")
+	}
+	pods, err := ListPods(kubeconfig, meta_v1.NamespaceAll, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		app, ok := pod.Labels["app"]
+		if pod.Name == nameOrLabel || ok && app == nameOrLabel {
+			return &Pod{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+				IP:        pod.Status.PodIP,
+				ProxyType: proxyType,
+			}, nil
+		}
+		if istio, ok := pod.Labels["istio"]; ok && istio == nameOrLabel {
+			return &Pod{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+				IP:        pod.Status.PodIP,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no pod with name or app label matching %q", ErrNotFound, nameOrLabel)
+}
+
+// Labels returns the labels of the pod.
+func Labels(kubeconfig string, pod *Pod) (map[string]string, error) {
+	pods, err := ListPods(kubeconfig, pod.Namespace, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pods.Items {
+		if p.Name == pod.Name {
+			return p.Labels, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s.%s", ErrNotFound, pod.Name, pod.Namespace)
+}
+
+// PilotPods returns the names of all pilot (istiod) pods.
+func PilotPods(kubeconfig string) ([]string, error) {
+	pods, err := ListPods(kubeconfig, meta_v1.NamespaceAll, "")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		if pod.Labels["istio"] == "pilot" {
+			names = append(names, pod.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%w: cannot find istio-pilot pod", ErrNotFound)
+	}
+	return names, nil
+}
@@ -0,0 +1,237 @@
+// Package xdsclient is a client of the Aggregated Discovery Service of pilot, or of any xDS server,
+// that can be used from Go code such as tests.
+package xdsclient
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	ads "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// DefaultMaxRecvMsgSize is the largest response accepted if not set in the options. gRPC defaults to
+// 4MB, which the CDS and EDS responses of large meshes exceed.
+const DefaultMaxRecvMsgSize = 512 * 1024 * 1024
+
+// DefaultKeepaliveTime is the keepalive ping interval if not set in the options. gRPC servers without
+// an enforcement policy, such as pilot, close the connection with too_many_pings when pinged more often.
+const DefaultKeepaliveTime = 5 * time.Minute
+
+// Options configures a Client.
+type Options struct {
+	// Address of the server, e.g. localhost:15010.
+	URL string
+
+	// How long to wait for the first response of a stream. 0 to wait forever.
+	Timeout time.Duration
+
+	// How long to wait for the connection to the server. 0 to not wait for it to be ready.
+	ConnectTimeout time.Duration
+
+	// Largest response accepted, in bytes. DefaultMaxRecvMsgSize if 0.
+	MaxRecvMsgSize int
+
+	// Interval of keepalive pings while a stream is open. DefaultKeepaliveTime if 0.
+	KeepaliveTime time.Duration
+}
+
+// Client opens ADS streams to a server.
+type Client struct {
+	opts Options
+}
+
+// New returns a client with the options. No connection is made until a request is sent.
+func New(opts Options) *Client {
+	if opts.MaxRecvMsgSize == 0 {
+		opts.MaxRecvMsgSize = DefaultMaxRecvMsgSize
+	}
+	if opts.KeepaliveTime == 0 {
+		opts.KeepaliveTime = DefaultKeepaliveTime
+	}
+	return &Client{opts: opts}
+}
+
+// URL returns the address of the server.
+func (c *Client) URL() string {
+	return c.opts.URL
+}
+
+// Dial opens a gRPC connection to the server, waiting for it to be ready up to the connect timeout.
+func (c *Client) Dial(ctx context.Context) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    c.opts.KeepaliveTime,
+			Timeout: 10 * time.Second,
+		}),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(c.opts.MaxRecvMsgSize)),
+	}
+	if c.opts.ConnectTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.ConnectTimeout)
+		defer cancel()
+		opts = append(opts, grpc.WithBlock())
+	}
+	conn, err := grpc.DialContext(ctx, c.opts.URL, opts...)
+	if err != nil {
+		return nil, &ConnectError{URL: c.opts.URL, Timeout: c.opts.ConnectTimeout, Err: err}
+	}
+	return conn, nil
+}
+
+// Stream is an ADS stream on its own connection.
+type Stream struct {
+	conn    *grpc.ClientConn
+	stream  ads.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+	// One of waiting, received or timedOut.
+	state int32
+}
+
+const (
+	waiting int32 = iota
+	received
+	timedOut
+)
+
+// Stream connects to the server and opens an ADS stream. It is closed when the context is done.
+func (c *Client) Stream(ctx context.Context) (*Stream, error) {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := ads.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		cancel()
+		_ = conn.Close()
+		return nil, convertError(err)
+	}
+	s := &Stream{
+		conn:    conn,
+		stream:  stream,
+		cancel:  cancel,
+		timeout: c.opts.Timeout,
+	}
+	if s.timeout != 0 {
+		s.timer = time.AfterFunc(s.timeout, func() {
+			// Only if no response was received yet.
+			if atomic.CompareAndSwapInt32(&s.state, waiting, timedOut) {
+				cancel()
+			}
+		})
+	}
+	return s, nil
+}
+
+// Send sends a request on the stream.
+func (s *Stream) Send(req *xdsapi.DiscoveryRequest) error {
+	return s.stream.Send(req)
+}
+
+// Recv waits for the next response. The first one is waited for up to the timeout of the client, and
+// an error wrapping ErrNoResponse is returned if it does not come in time.
+func (s *Stream) Recv() (*xdsapi.DiscoveryResponse, error) {
+	res, err := s.stream.Recv()
+	if err != nil {
+		if atomic.LoadInt32(&s.state) == timedOut {
+			return nil, noResponseError(s.timeout)
+		}
+		return nil, convertError(err)
+	}
+	if !atomic.CompareAndSwapInt32(&s.state, waiting, received) && atomic.LoadInt32(&s.state) == timedOut {
+		// The timeout expired just as the response arrived.
+		return nil, noResponseError(s.timeout)
+	}
+	return res, nil
+}
+
+// Close closes the stream and its connection.
+func (s *Stream) Close() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.cancel()
+	_ = s.conn.Close()
+}
+
+// NewRequest returns the initial request for the resources of the type. No names subscribes to all
+// resources for LDS and CDS.
+func NewRequest(node *core1.Node, typeURL string, names []string) *xdsapi.DiscoveryRequest {
+	return &xdsapi.DiscoveryRequest{
+		Node:          node,
+		TypeUrl:       typeURL,
+		ResourceNames: names,
+	}
+}
+
+// ACK returns the request that ACKs the response to the request.
+func ACK(req *xdsapi.DiscoveryRequest, res *xdsapi.DiscoveryResponse) *xdsapi.DiscoveryRequest {
+	return &xdsapi.DiscoveryRequest{
+		VersionInfo:   res.VersionInfo,
+		ResponseNonce: res.Nonce,
+		TypeUrl:       req.TypeUrl,
+		Node:          req.Node,
+		ResourceNames: req.ResourceNames,
+	}
+}
+
+// Fetch sends a single request for the resources of the type and returns the first response, which
+// is not ACKed.
+func (c *Client) Fetch(ctx context.Context, node *core1.Node, typeURL string, names []string) (*xdsapi.DiscoveryResponse, error) {
+	s, err := c.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if err := s.Send(NewRequest(node, typeURL, names)); err != nil {
+		return nil, convertError(err)
+	}
+	return s.Recv()
+}
+
+// Watch subscribes to the resources of the type and ACKs every response. The responses are sent on
+// the first channel, which is closed when the context is done or the stream ends. If the stream
+// failed, the error is then sent on the second channel. Both channels are closed at the end.
+func (c *Client) Watch(ctx context.Context, node *core1.Node, typeURL string, names []string) (<-chan *xdsapi.DiscoveryResponse, <-chan error) {
+	responses := make(chan *xdsapi.DiscoveryResponse)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(responses)
+		s, err := c.Stream(ctx)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer s.Close()
+		req := NewRequest(node, typeURL, names)
+		for {
+			if err := s.Send(req); err != nil {
+				errs <- convertError(err)
+				return
+			}
+			res, err := s.Recv()
+			if err != nil {
+				if ctx.Err() == nil {
+					errs <- err
+				}
+				return
+			}
+			select {
+			case responses <- res:
+			case <-ctx.Done():
+				return
+			}
+			req = ACK(req, res)
+		}
+	}()
+	return responses, errs
+}
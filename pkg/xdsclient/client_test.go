@@ -0,0 +1,239 @@
+package xdsclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core1 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	ads "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/server"
+	"google.golang.org/grpc"
+
+	"xdscli/pkg/xdsclient"
+)
+
+const clusterType = "type.googleapis.com/envoy.api.v2.Cluster"
+
+var node = &core1.Node{Id: "sidecar~10.0.0.1~httpbin-1.default~default.svc.cluster.local"}
+
+// testServer is an in-process ADS server serving snapshots of clusters to the test node.
+type testServer struct {
+	cache cache.SnapshotCache
+	url   string
+}
+
+type nodeHash struct{}
+
+func (nodeHash) ID(n *core1.Node) string {
+	return n.GetId()
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	snapshotCache := cache.NewSnapshotCache(false, nodeHash{}, nil)
+	grpcServer := grpc.NewServer()
+	ads.RegisterAggregatedDiscoveryServiceServer(grpcServer, server.NewServer(ctx, snapshotCache, nil))
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = grpcServer.Serve(lis)
+	}()
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		cancel()
+	})
+	return &testServer{cache: snapshotCache, url: lis.Addr().String()}
+}
+
+// setClusters serves n clusters at the version.
+func (s *testServer) setClusters(t *testing.T, version string, n int) {
+	t.Helper()
+	var clusters []cache.Resource
+	for i := 0; i < n; i++ {
+		clusters = append(clusters, &xdsapi.Cluster{Name: fmt.Sprintf("outbound|%d||httpbin.default.svc.cluster.local", 8000+i)})
+	}
+	if err := s.cache.SetSnapshot(node.Id, cache.NewSnapshot(version, nil, clusters, nil, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestFetch(t *testing.T) {
+	s := newTestServer(t)
+	s.setClusters(t, "1", 2)
+	client := xdsclient.New(xdsclient.Options{URL: s.url, Timeout: 5 * time.Second})
+
+	res, err := client.Fetch(testContext(t), node, clusterType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.VersionInfo != "1" || res.TypeUrl != clusterType || len(res.Resources) != 2 {
+		t.Errorf("Fetch() = version %q type %q with %d resources, want version 1 type %s with 2",
+			res.VersionInfo, res.TypeUrl, len(res.Resources), clusterType)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := newTestServer(t)
+	s.setClusters(t, "1", 1)
+	client := xdsclient.New(xdsclient.Options{URL: s.url, Timeout: 5 * time.Second})
+
+	stream, err := client.Stream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	req := xdsclient.NewRequest(node, clusterType, nil)
+	if err := stream.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.VersionInfo != "1" {
+		t.Fatalf("first response at version %q, want 1", res.VersionInfo)
+	}
+
+	// After the ACK, the next response is the next version.
+	ack := xdsclient.ACK(req, res)
+	if ack.VersionInfo != "1" || ack.ResponseNonce != res.Nonce || ack.TypeUrl != clusterType {
+		t.Errorf("ACK() = %v", ack)
+	}
+	if err := stream.Send(ack); err != nil {
+		t.Fatal(err)
+	}
+	s.setClusters(t, "2", 3)
+	res, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.VersionInfo != "2" || len(res.Resources) != 3 {
+		t.Errorf("second response at version %q with %d resources, want 2 with 3", res.VersionInfo, len(res.Resources))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := newTestServer(t)
+	s.setClusters(t, "1", 1)
+	client := xdsclient.New(xdsclient.Options{URL: s.url, Timeout: 5 * time.Second})
+
+	ctx, cancel := context.WithCancel(testContext(t))
+	responses, errs := client.Watch(ctx, node, clusterType, nil)
+	for i, want := range []string{"1", "2", "3"} {
+		select {
+		case res := <-responses:
+			if res.VersionInfo != want {
+				t.Fatalf("response at version %q, want %s", res.VersionInfo, want)
+			}
+		case err := <-errs:
+			t.Fatalf("Watch() failed: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no response at version %s", want)
+		}
+		// Watch ACKs the response, so a new version is pushed.
+		s.setClusters(t, fmt.Sprint(i+2), 1)
+	}
+
+	cancel()
+	for range responses {
+	}
+	if err, ok := <-errs; ok {
+		t.Errorf("Watch() error after cancel = %v, want none", err)
+	}
+}
+
+func TestNoResponseTimeout(t *testing.T) {
+	s := newTestServer(t)
+	// No snapshot for the node: the server never responds.
+	client := xdsclient.New(xdsclient.Options{URL: s.url, Timeout: 200 * time.Millisecond})
+
+	start := time.Now()
+	_, err := client.Fetch(testContext(t), node, clusterType, nil)
+	if !errors.Is(err, xdsclient.ErrNoResponse) {
+		t.Fatalf("Fetch() error = %v, want ErrNoResponse", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Fetch() returned after %v, want about the timeout", elapsed)
+	}
+}
+
+func TestTimeoutOnlyAppliesToFirstResponse(t *testing.T) {
+	s := newTestServer(t)
+	s.setClusters(t, "1", 1)
+	client := xdsclient.New(xdsclient.Options{URL: s.url, Timeout: 200 * time.Millisecond})
+
+	stream, err := client.Stream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	req := xdsclient.NewRequest(node, clusterType, nil)
+	if err := stream.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(xdsclient.ACK(req, res)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	s.setClusters(t, "2", 1)
+	if res, err = stream.Recv(); err != nil {
+		t.Fatalf("Recv() after the timeout = %v, want the next response", err)
+	}
+	if res.VersionInfo != "2" {
+		t.Errorf("response at version %q, want 2", res.VersionInfo)
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	s.setClusters(t, "1", 100)
+	client := xdsclient.New(xdsclient.Options{URL: s.url, Timeout: 5 * time.Second, MaxRecvMsgSize: 1024})
+
+	_, err := client.Fetch(testContext(t), node, clusterType, nil)
+	if !errors.Is(err, xdsclient.ErrMessageTooLarge) {
+		t.Fatalf("Fetch() error = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	// A port nothing listens on.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := lis.Addr().String()
+	_ = lis.Close()
+	client := xdsclient.New(xdsclient.Options{URL: url, ConnectTimeout: 200 * time.Millisecond})
+
+	_, err = client.Fetch(testContext(t), node, clusterType, nil)
+	var connectErr *xdsclient.ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("Fetch() error = %v, want a ConnectError", err)
+	}
+	if connectErr.URL != url || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ConnectError = %+v, want URL %s and a deadline exceeded", connectErr, url)
+	}
+	if !strings.Contains(err.Error(), "within 200ms") {
+		t.Errorf("error message %q does not mention the connect timeout", err.Error())
+	}
+}
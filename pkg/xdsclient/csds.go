@@ -0,0 +1,27 @@
+package xdsclient
+
+import (
+	"context"
+
+	csds "github.com/envoyproxy/go-control-plane/envoy/service/status/v2"
+)
+
+// FetchClientStatus calls the Client Status Discovery Service of the server, which reports the config
+// status of the proxies connected to it.
+func (c *Client) FetchClientStatus(ctx context.Context, req *csds.ClientStatusRequest) (*csds.ClientStatusResponse, error) {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if c.opts.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+	resp, err := csds.NewClientStatusDiscoveryServiceClient(conn).FetchClientStatus(ctx, req)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, noResponseError(c.opts.Timeout)
+	}
+	return resp, convertError(err)
+}
@@ -0,0 +1,56 @@
+package xdsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrNoResponse is wrapped by the error returned when the server does not respond within the
+	// timeout.
+	ErrNoResponse = errors.New("no response")
+
+	// ErrMessageTooLarge is wrapped by the error returned when a response exceeds the max receive
+	// message size.
+	ErrMessageTooLarge = errors.New("response larger than the max receive message size")
+)
+
+// ConnectError is returned when the connection to the server cannot be made.
+type ConnectError struct {
+	URL     string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *ConnectError) Error() string {
+	if errors.Is(e.Err, context.DeadlineExceeded) && e.Timeout != 0 {
+		return fmt.Sprintf("cannot connect to %s within %v", e.URL, e.Timeout)
+	}
+	return fmt.Sprintf("cannot connect to %s: %v", e.URL, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+func noResponseError(timeout time.Duration) error {
+	return fmt.Errorf("%w within %v", ErrNoResponse, timeout)
+}
+
+// convertError returns the typed error for the errors of gRPC that have one.
+func convertError(err error) error {
+	if err == io.EOF {
+		return err
+	}
+	if s, ok := status.FromError(err); ok && s.Code() == codes.ResourceExhausted && strings.Contains(s.Message(), "larger than max") {
+		return fmt.Errorf("%w: %s", ErrMessageTooLarge, s.Message())
+	}
+	return err
+}
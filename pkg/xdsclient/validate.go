@@ -0,0 +1,51 @@
+package xdsclient
+
+import (
+	"fmt"
+	"strings"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// ValidationError lists the resources of a response that fail validation.
+type ValidationError struct {
+	// Resources failing their generated (PGV) validation, which Envoy would reject.
+	Invalid []string
+	// Resources of a linked in type that cannot be decoded.
+	Undecodable []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(append(append([]string{}, e.Invalid...), e.Undecodable...), "; ")
+}
+
+// ValidateResources decodes every resource of the response and runs its generated (PGV) validation,
+// which Envoy also does before accepting config. Resources whose message type is not linked in cannot
+// be validated and are skipped. The error is a *ValidationError.
+func ValidateResources(resp *xdsapi.DiscoveryResponse) error {
+	verr := &ValidationError{}
+	for _, res := range resp.Resources {
+		if name, err := ptypes.AnyMessageName(res); err != nil || proto.MessageType(name) == nil {
+			continue
+		}
+		var msg ptypes.DynamicAny
+		if err := ptypes.UnmarshalAny(res, &msg); err != nil {
+			verr.Undecodable = append(verr.Undecodable, fmt.Sprintf("%s: %v", res.TypeUrl, err))
+			continue
+		}
+		validator, ok := msg.Message.(interface{ Validate() error })
+		if !ok {
+			continue
+		}
+		if err := validator.Validate(); err != nil {
+			verr.Invalid = append(verr.Invalid, fmt.Sprintf("%s: %v", cache.GetResourceName(msg.Message), err))
+		}
+	}
+	if len(verr.Invalid) == 0 && len(verr.Undecodable) == 0 {
+		return nil
+	}
+	return verr
+}
@@ -0,0 +1,53 @@
+package xdsclient_test
+
+import (
+	"errors"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/ptypes"
+	any "github.com/golang/protobuf/ptypes/any"
+
+	"xdscli/pkg/xdsclient"
+)
+
+func TestValidateResources(t *testing.T) {
+	toAny := func(cluster *xdsapi.Cluster) *any.Any {
+		res, err := ptypes.MarshalAny(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	cases := []struct {
+		name            string
+		res             *any.Any
+		wantInvalid     bool
+		wantUndecodable bool
+	}{
+		{"valid", toAny(&xdsapi.Cluster{Name: "outbound|80||a.default.svc.cluster.local"}), false, false},
+		{"fails validation", toAny(&xdsapi.Cluster{}), true, false},
+		{"malformed", &any.Any{TypeUrl: clusterType, Value: []byte{0xff}}, false, true},
+		{"unknown type", &any.Any{TypeUrl: "type.googleapis.com/istio.networking.nds.v1.NameTable", Value: []byte{0xff}}, false, false},
+		{"no type", &any.Any{}, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := xdsclient.ValidateResources(&xdsapi.DiscoveryResponse{Resources: []*any.Any{c.res}})
+			if !c.wantInvalid && !c.wantUndecodable {
+				if err != nil {
+					t.Errorf("ValidateResources() = %v, want nil", err)
+				}
+				return
+			}
+			var verr *xdsclient.ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("ValidateResources() = %v, want a ValidationError", err)
+			}
+			if (len(verr.Invalid) != 0) != c.wantInvalid || (len(verr.Undecodable) != 0) != c.wantUndecodable {
+				t.Errorf("ValidateResources() = invalid %v undecodable %v, want invalid %v undecodable %v",
+					verr.Invalid, verr.Undecodable, c.wantInvalid, c.wantUndecodable)
+			}
+		})
+	}
+}
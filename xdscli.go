@@ -28,6 +28,18 @@
 // ```bash
 // go run xds.go lds --proxytag httpbin --kubeconfig path/to/kube/config
 // ```
+//
+// To serve saved JSON output to a local Envoy (or any xDS client) as an ADS server on port 15010:
+// ```bash
+// go run xds.go lds --proxytag httpbin -f lds.json --all
+// go run xds.go cds --proxytag httpbin -f cds.json --all
+// go run xds.go serve lds.json cds.json --address :15010
+// ```
+//
+// To trace how the proxy would handle a request to reviews:9080:
+// ```bash
+// go run xds.go trace --proxytag productpage --ip 10.0.0.12 --port 9080 --host reviews:9080 --path /reviews/0
+// ```
 package main
 
 import (